@@ -0,0 +1,168 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// maxAliasDepth stops aliases that expand to themselves, directly or not
+const maxAliasDepth = 10
+
+// aliasMu guards config.Aliases, which Tab completion reads from the UI
+var aliasMu sync.Mutex
+
+// aliasDepth is how many aliases deep the command being run is
+var aliasDepth int
+
+// aliasRunning are the aliases being expanded; one that names itself, like
+// "/alias join /join $1; /history 5", runs the built in command instead
+var aliasRunning = make(map[string]bool)
+
+// lookupAlias returns the expansion of /name, if it is an alias that is not
+// already being expanded
+func lookupAlias(name string) (string, bool) {
+	aliasMu.Lock()
+	defer aliasMu.Unlock()
+	name = strings.TrimPrefix(name, "/")
+	body, ok := config.Aliases[name]
+	return body, ok && !aliasRunning[name]
+}
+
+func aliasNames() []string {
+	aliasMu.Lock()
+	defer aliasMu.Unlock()
+	names := make([]string, 0, len(config.Aliases))
+	for name := range config.Aliases {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// expandAlias substitutes $1 to $9, $* (every argument), $nick, $chan and $$
+// in body; a body that uses no arguments gets them appended, so
+// "/alias j /join" works like "/alias j /join $*"
+func expandAlias(body string, args []string) string {
+	var out strings.Builder
+	used := false
+	for i := 0; i < len(body); i++ {
+		if body[i] != '$' || i+1 == len(body) {
+			out.WriteByte(body[i])
+			continue
+		}
+		rest := body[i+1:]
+		switch {
+		case rest[0] >= '1' && rest[0] <= '9':
+			if n := int(rest[0] - '1'); n < len(args) {
+				out.WriteString(args[n])
+			}
+			used = true
+			i++
+		case rest[0] == '*':
+			out.WriteString(strings.Join(args, " "))
+			used = true
+			i++
+		case rest[0] == '$':
+			out.WriteByte('$')
+			i++
+		case strings.HasPrefix(rest, "nick"):
+			out.WriteString(nickname)
+			i += len("nick")
+		case strings.HasPrefix(rest, "chan"):
+			out.WriteString(channel)
+			i += len("chan")
+		default:
+			out.WriteByte('$')
+		}
+	}
+	if !used && len(args) > 0 {
+		out.WriteString(" " + strings.Join(args, " "))
+	}
+	return out.String()
+}
+
+// runAlias runs each ";" separated command of the alias's expansion as if
+// the user had typed it
+func runAlias(name string, body string, args []string) {
+	if aliasDepth >= maxAliasDepth {
+		say("error: runAlias, " + name + " nests aliases more than " + strconv.Itoa(maxAliasDepth) + " deep")
+		return
+	}
+	name = strings.TrimPrefix(name, "/")
+	aliasDepth++
+	aliasRunning[name] = true
+	defer func() {
+		aliasDepth--
+		delete(aliasRunning, name)
+	}()
+	for _, line := range strings.Split(expandAlias(body, args), ";") {
+		if line = strings.TrimSpace(line); line != "" {
+			checkCommands(line)
+		}
+	}
+}
+
+// aliasCommand handles /alias: on its own it lists the aliases, with a name
+// it shows that alias, and with a name and commands it defines it
+func aliasCommand(tok []string) {
+	if len(tok) == 1 {
+		names := aliasNames()
+		if len(names) == 0 {
+			say("No aliases, define one with /alias [Name] [Commands]")
+		}
+		for _, name := range names {
+			aliasMu.Lock()
+			body := config.Aliases[name]
+			aliasMu.Unlock()
+			sayf("/%-12s %s", name, body)
+		}
+		return
+	}
+	name := strings.TrimPrefix(tok[1], "/")
+	if name == "" || name == "alias" || name == "unalias" {
+		say("error: aliasCommand, /alias and /unalias cannot be aliased")
+		return
+	}
+	if len(tok) == 2 {
+		if body, ok := lookupAlias(name); ok {
+			sayf("/%s is an alias for %s", name, body)
+		} else {
+			say("/" + name + " is not an alias")
+		}
+		return
+	}
+	body := strings.Join(tok[2:], " ")
+	aliasMu.Lock()
+	if config.Aliases == nil {
+		config.Aliases = make(map[string]string)
+	}
+	config.Aliases[name] = body
+	aliasMu.Unlock()
+	if err := saveConfig(configFile, config); err != nil {
+		reportError("aliasCommand", "save the config", err)
+	}
+	sayf("/%s is now an alias for %s", name, body)
+}
+
+// unaliasCommand handles /unalias [Name]
+func unaliasCommand(tok []string) {
+	if len(tok) != 2 {
+		say("error: checkCommands, failed /unalias call; check out /help for more info")
+		return
+	}
+	name := strings.TrimPrefix(tok[1], "/")
+	aliasMu.Lock()
+	_, ok := config.Aliases[name]
+	delete(config.Aliases, name)
+	aliasMu.Unlock()
+	if !ok {
+		say("/" + name + " is not an alias")
+		return
+	}
+	if err := saveConfig(configFile, config); err != nil {
+		reportError("unaliasCommand", "save the config", err)
+	}
+	say("Removed the alias /" + name)
+}
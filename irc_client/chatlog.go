@@ -0,0 +1,235 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ChatLogConfig struct is the config file's settings for logging
+// conversations to disk
+type ChatLogConfig struct {
+	// Dir holds a directory per server, with a file per target and day
+	Dir string `json:"dir,omitempty"`
+	// Format is text (like irssi's), jsonl or html
+	Format string `json:"format,omitempty"`
+	// Disabled turns logging off for targets that Targets does not mention
+	Disabled bool `json:"disabled,omitempty"`
+	// Targets turns logging on or off for single channels ("#name") and
+	// conversations ("@nick")
+	Targets map[string]bool `json:"targets,omitempty"`
+}
+
+// chatLogFormats maps each format to the extension of its files
+var chatLogFormats = map[string]string{"text": ".log", "jsonl": ".jsonl", "html": ".html"}
+
+// chatLogFile struct is the open file of one target, for the day it is for
+type chatLogFile struct {
+	file *os.File
+	day  string
+}
+
+// chatLogger struct writes each target's chats to its file for the day,
+// opening the next day's file when the date changes
+type chatLogger struct {
+	mu     sync.Mutex
+	dir    string
+	format string
+	files  map[string]*chatLogFile
+	// since is when we started; the first poll replays older chats, which
+	// an earlier session has logged already
+	since int64
+}
+
+// chatLog is nil until main sets it up, and then logs every conversation
+// that the config does not turn off
+var chatLog *chatLogger
+
+// defaultChatLogDir is logs/ next to the config file
+func defaultChatLogDir() string {
+	return filepath.Join(filepath.Dir(configFile), "logs")
+}
+
+// newChatLogger logs to a directory under dir for the server at domain
+func newChatLogger(dir string, format string) (*chatLogger, error) {
+	if _, ok := chatLogFormats[format]; !ok {
+		return nil, fmt.Errorf("error: newChatLogger, unknown chat log format %q, use text, jsonl or html", format)
+	}
+	host := domain
+	if u, err := url.Parse(domain); err == nil && u.Host != "" {
+		host = u.Host
+	}
+	return &chatLogger{dir: filepath.Join(dir, safeFileName(host)), format: format, files: make(map[string]*chatLogFile), since: time.Now().Unix()}, nil
+}
+
+// safeFileName keeps a target or host from escaping the log directory or
+// using characters some filesystems refuse
+func safeFileName(name string) string {
+	name = strings.NewReplacer("/", "_", "\\", "_", ":", "_").Replace(name)
+	if name == "" || name == "." || name == ".." {
+		name = "_" + name
+	}
+	return name
+}
+
+// chatLogEnabled reports whether the config logs target; the poll loops
+// call it with chatLog.mu held, since /log changes the config
+func chatLogEnabled(target string) bool {
+	if on, ok := config.ChatLog.Targets[target]; ok {
+		return on
+	}
+	return !config.ChatLog.Disabled
+}
+
+// logChat appends chat to target's log, if logging is on for it
+func logChat(target string, chat Chat) {
+	if chatLog == nil {
+		return
+	}
+	if err := chatLog.write(target, chat); err != nil {
+		logger.Error("writing chat log", "func", "logChat", "target", target, "err", err)
+	}
+}
+
+func (l *chatLogger) write(target string, chat Chat) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !chatLogEnabled(target) || (chat.Timestamp != 0 && chat.Timestamp < l.since) {
+		return nil
+	}
+	when := time.Unix(chat.Timestamp, 0)
+	if chat.Timestamp == 0 {
+		when = time.Now()
+	}
+	f, err := l.open(target, when)
+	if err != nil {
+		return err
+	}
+	var line string
+	switch l.format {
+	case "jsonl":
+		dat, _ := json.Marshal(chat)
+		line = string(dat) + "\n"
+	case "html":
+		nick := "&lt;" + html.EscapeString(chat.Sender) + "&gt;"
+		if chat.Kind == chatKindNotice {
+			nick = "-" + html.EscapeString(chat.Sender) + "-"
+		}
+		line = fmt.Sprintf("<div class=\"line\"><span class=\"time\">%s</span> <span class=\"nick\">%s</span> %s</div>\n", when.Format("15:04:05"), nick, html.EscapeString(chat.Text))
+	default:
+		nick := "<" + chat.Sender + ">"
+		if chat.Kind == chatKindNotice {
+			nick = "-" + chat.Sender + "-"
+		}
+		line = when.Format("15:04") + " " + nick + " " + chat.Text + "\n"
+	}
+	_, err = f.file.WriteString(line)
+	return err
+}
+
+// open returns target's file for the day of when, closing the previous
+// day's; new files start with a header, which for html is the page's head
+// since the log is appended to and never closed
+func (l *chatLogger) open(target string, when time.Time) (*chatLogFile, error) {
+	day := when.Format("2006-01-02")
+	if f, ok := l.files[target]; ok {
+		if f.day == day {
+			return f, nil
+		}
+		f.file.Close()
+		delete(l.files, target)
+	}
+	if err := os.MkdirAll(l.dir, 0700); err != nil {
+		return nil, fmt.Errorf("error: open, creating %s: %s", l.dir, err)
+	}
+	name := filepath.Join(l.dir, safeFileName(target)+"-"+day+chatLogFormats[l.format])
+	file, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("error: open, opening %s: %s", name, err)
+	}
+	if info, err := file.Stat(); err == nil && info.Size() == 0 {
+		switch l.format {
+		case "html":
+			title := html.EscapeString(target + " " + day)
+			fmt.Fprintf(file, "<!DOCTYPE html>\n<html><head><meta charset=\"utf-8\"><title>%s</title>\n<style>body{font-family:monospace} .time{color:gray} .nick{font-weight:bold}</style></head>\n<body><h1>%s</h1>\n", title, title)
+		case "text":
+			fmt.Fprintf(file, "--- Log opened %s\n", when.Format("Mon Jan 02 15:04:05 2006"))
+		}
+	}
+	f := &chatLogFile{file: file, day: day}
+	l.files[target] = f
+	return f, nil
+}
+
+// close closes every open log file
+func (l *chatLogger) close() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for target, f := range l.files {
+		f.file.Close()
+		delete(l.files, target)
+	}
+}
+
+// logCommand handles /log: on its own it shows whether the active target is
+// logged, "/log on|off [target]" turns logging on or off for a target, "*"
+// meaning every target without a setting of its own
+func logCommand(tok []string) {
+	target := display.active()
+	if target == "" || target == statusWindow {
+		target = ""
+		if channel != "" {
+			target = "#" + channel
+		}
+	}
+	if len(tok) == 3 {
+		target = tok[2]
+	}
+	if chatLog == nil {
+		say("Chat logging is not set up")
+		return
+	}
+	if len(tok) == 1 {
+		if target == "" {
+			sayf("Logging %s chats to %s", chatLog.format, chatLog.dir)
+			return
+		}
+		state := "off"
+		if chatLogEnabled(target) {
+			state = "on"
+		}
+		sayf("Logging is %s for %s, in %s as %s", state, target, chatLog.dir, chatLog.format)
+		return
+	}
+	if (tok[1] != "on" && tok[1] != "off") || len(tok) > 3 || target == "" {
+		say("error: checkCommands, failed /log call; check out /help for more info")
+		return
+	}
+	on := tok[1] == "on"
+	chatLog.mu.Lock()
+	if target == "*" {
+		config.ChatLog.Disabled = !on
+		config.ChatLog.Targets = nil
+	} else {
+		if config.ChatLog.Targets == nil {
+			config.ChatLog.Targets = make(map[string]bool)
+		}
+		config.ChatLog.Targets[target] = on
+	}
+	if f, ok := chatLog.files[target]; ok && !on {
+		f.file.Close()
+		delete(chatLog.files, target)
+	}
+	err := saveConfig(configFile, config)
+	chatLog.mu.Unlock()
+	if err != nil {
+		reportError("logCommand", "save the config", err)
+	}
+	sayf("Logging turned %s for %s", tok[1], target)
+}
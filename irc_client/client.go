@@ -1,25 +1,47 @@
 package main
 
 import (
-	"bufio"
 	"bytes"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"os"
 	"strconv"
 	"strings"
 	"time"
+
+	"golang.org/x/term"
 )
 
 var channel string
 var nickname string
-var domain string = "http://34.207.139.127:7777/"
+
+// domain is the URL of the server, from the profile we connect with
+var domain = defaultServer
+
+// operToken is handed out by the server after a successful /oper
+var operToken string
+
+// nickToken is handed out by the server once we identify to an account, and
+// proves we own our nickname
+var nickToken string
 
 var privateTimestamp int64
 var channelTimestamp int64
 
+// lastPrivateID and lastChannelID are the newest chats we have shown, so a
+// poll after a reconnect picks up exactly what we missed
+var lastPrivateID int64
+var lastChannelID int64
+
+// identifiedAccount and identifiedPassword are kept in memory only, to
+// identify again if the server restarts under us
+var identifiedAccount string
+var identifiedPassword string
+
 // User struct that contains information of users of this irc
 type User struct {
 	Nickname   string `json:"nickname"`
@@ -33,20 +55,103 @@ type Channel struct {
 	ID          int      `json:"id"`
 	Operators   []string `json:"operators"`
 	Connected   []string `json:"connected"`
+	Banned      []string `json:"banned,omitempty"`
+	Creator     string   `json:"creator,omitempty"`
+	HalfOps     []string `json:"halfops,omitempty"`
+	Voiced      []string `json:"voiced,omitempty"`
+	Founder     string   `json:"founder,omitempty"`
+	Archived    bool     `json:"archived,omitempty"`
+	Settings    *struct {
+		Topic string `json:"topic,omitempty"`
+	} `json:"settings,omitempty"`
 }
 
 // Chat struct that contains the text, timestamp, and other information about chat
 type Chat struct {
+	ID        int64  `json:"id,omitempty"`
 	Timestamp int64  `json:"timestamp"`
 	Sender    string `json:"sender"`
 	Receiver  string `json:"receiver"`
 	Text      string `json:"text"`
+	Kind      string `json:"kind,omitempty"`
+}
+
+// chats of this Kind are notices from the server rather than from a user
+const chatKindNotice = "notice"
+
+// serverName is the sender of notices from the server itself
+const serverName = "*server*"
+
+// ServerInfo struct is what the server's /info endpoint returns
+type ServerInfo struct {
+	Name     string         `json:"name"`
+	Version  string         `json:"version"`
+	Started  int64          `json:"started"`
+	Uptime   int64          `json:"uptime"`
+	Features []string       `json:"features"`
+	Limits   map[string]int `json:"limits"`
+	MOTD     string         `json:"motd"`
+}
+
+// server is what we learned about the server when connecting
+var server ServerInfo
+
+func fetchServerInfo() (ServerInfo, error) {
+	var info ServerInfo
+	response, err := http.Get(domain + "info")
+	if err != nil {
+		return info, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return info, fmt.Errorf("server answered %s", response.Status)
+	}
+	data, _ := ioutil.ReadAll(response.Body)
+	err = json.Unmarshal(data, &info)
+	return info, err
+}
+
+func showServerInfo(info ServerInfo) {
+	sayf("Connected to %s (version %s), up for %s\n", info.Name, info.Version, time.Duration(info.Uptime)*time.Second)
+	if len(info.Features) > 0 {
+		say("Features: " + strings.Join(info.Features, ", "))
+	}
+}
+
+// fetchMOTD asks the server for its message of the day, which it may have
+// changed since we fetched /info
+func fetchMOTD() (string, error) {
+	response, err := http.Get(domain + "motd")
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("server answered %s", response.Status)
+	}
+	var jsonData map[string]string
+	data, _ := ioutil.ReadAll(response.Body)
+	err = json.Unmarshal(data, &jsonData)
+	return jsonData["motd"], err
+}
+
+func showMOTD() {
+	motd, err := fetchMOTD()
+	if err != nil {
+		// servers from before /motd send it with /info
+		logger.Warn("fetching message of the day", "err", err)
+		motd = server.MOTD
+	}
+	if motd != "" {
+		say("- Message of the day -")
+		say(motd)
+	}
 }
 
 func showAllChannels() string {
 	response, err := http.Get(domain + "channels/")
 	if err != nil {
-		fmt.Printf("error: showAllChannels, the HTTP request failed with error %s\n", err)
+		reportError("showAllChannels", "list channels", err)
 		return "The HTTP request failed with error"
 	}
 	data, _ := ioutil.ReadAll(response.Body)
@@ -54,9 +159,13 @@ func showAllChannels() string {
 	var result string
 	json.Unmarshal(data, &channels)
 	for _, line := range channels {
-		result += line.ChannelName + "\n"
+		result += line.ChannelName
+		if line.Archived {
+			result += " (archived)"
+		}
+		result += "\n"
 	}
-	fmt.Println("\nList of All Channels:")
+	say("\nList of All Channels:")
 	return result
 }
 
@@ -65,39 +174,141 @@ func createChannel(channelName string, names ...string) string {
 		ID:        0,
 		Operators: names,
 		Connected: []string{},
+		Creator:   nickname,
 	}
 	jsonValue, _ := json.Marshal(jsonData)
 	response, err := http.Post(domain+"channel", "application/json", bytes.NewBuffer(jsonValue))
 	if err != nil {
-		fmt.Printf("error: createChannel, the HTTP request failed with error %s\n", err)
+		reportError("createChannel", "create "+channelName, err)
 		return "FAIL"
 	}
 	data, _ := ioutil.ReadAll(response.Body)
-	fmt.Println(string(data))
+	say(string(data))
 	return string(data)
 }
 
 func joinChannel(channelName string) error {
+	switching, left := channelName != channel, channel
+	if switching {
+		// the backlog takes over from here; until then, poll only for chats
+		// from now on rather than from wherever the last channel was
+		channelTimestamp, lastChannelID, historyBefore = time.Now().Unix(), 0, 0
+	}
 	channel = channelName
 	jsonData := map[string]string{"user": nickname, "channel": channelName}
 	jsonValue, _ := json.Marshal(jsonData)
 	response, err := http.Post(domain+"join", "application/json", bytes.NewBuffer(jsonValue))
 	if err != nil {
-		fmt.Printf("error: joinChannel, the HTTP request failed with error %s\n", err)
+		reportError("joinChannel", "join "+channelName, err)
 	} else {
 		data, _ := ioutil.ReadAll(response.Body)
+		if response.StatusCode != http.StatusOK {
+			channel = ""
+			say("Could not join " + channelName + ": " + strings.TrimSpace(string(data)))
+			return fmt.Errorf("error: joinChannel, %s", response.Status)
+		}
 		var chat Channel
 		json.Unmarshal(data, &chat)
-		fmt.Println("Welcome to " + channelName + ", " + nickname)
-		fmt.Println("Current Operators: ", chat.Operators)
-		fmt.Println("Current Users Connected: ", chat.Connected)
+		display.open("#" + channelName)
+		say("Welcome to " + channelName + ", " + nickname)
+		if chat.Settings != nil && chat.Settings.Topic != "" {
+			say("Topic: " + chat.Settings.Topic)
+		}
+		say("Current Operators: ", chat.Operators)
+		say("Current Users Connected: ", chat.Connected)
+		if switching {
+			loadBacklog(channelName)
+			if left != "" {
+				scriptEvent("part", left)
+			}
+			scriptEvent("join", channelName)
+		}
 	}
 	return err
 }
 
+// backlogSize is how many of a channel's chats joining it shows, and /history
+// shows by default
+const backlogSize = 20
+
+// historyBefore is the ID of the oldest chat shown of the channel, which
+// /history pages back from
+var historyBefore int64
+
+func fetchHistory(channelName string, before int64, limit int) ([]Chat, error) {
+	var chats []Chat
+	query := "?limit=" + strconv.Itoa(limit)
+	if before > 0 {
+		query += "&before=" + strconv.FormatInt(before, 10)
+	}
+	response, err := http.Get(domain + "chatchannel/" + channelName + "/history" + query)
+	if err != nil {
+		return chats, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return chats, fmt.Errorf("server answered %s", response.Status)
+	}
+	data, _ := ioutil.ReadAll(response.Body)
+	err = json.Unmarshal(data, &chats)
+	return chats, err
+}
+
+// loadBacklog shows the channel's last chats, and has the poll go on from the
+// newest of them
+func loadBacklog(channelName string) {
+	chats, err := fetchHistory(channelName, 0, backlogSize)
+	if err != nil {
+		logger.Warn("fetching backlog", "func", "loadBacklog", "channel", channelName, "err", err)
+		return
+	}
+	if len(chats) == 0 {
+		return
+	}
+	showBacklog(channelName, chats, fmt.Sprintf("Backlog of #%s, last %d chats", channelName, len(chats)))
+	last := chats[len(chats)-1]
+	channelTimestamp, lastChannelID = last.Timestamp, last.ID
+}
+
+// showBacklog shows chats set apart from the live conversation
+func showBacklog(channelName string, chats []Chat, label string) {
+	display.show("#"+channelName, "----- "+label+" -----")
+	for _, line := range chats {
+		if ignored("#"+channelName, line) {
+			continue
+		}
+		display.show("#"+channelName, time.Unix(line.Timestamp, 0).String()+": "+line.Sender+": "+line.Text)
+	}
+	display.show("#"+channelName, "----- End of backlog -----")
+	historyBefore = chats[0].ID
+}
+
+// showHistory pages n chats further back in the channel than shown so far
+func showHistory(n int) {
+	if channel == "" {
+		say("error: checkCommands, join a channel to see its history")
+		return
+	}
+	if historyBefore <= 1 {
+		say("No earlier chats in #" + channel)
+		return
+	}
+	chats, err := fetchHistory(channel, historyBefore, n)
+	if err != nil {
+		reportError("showHistory", "fetch the history of "+channel, err)
+		return
+	}
+	if len(chats) == 0 {
+		historyBefore = 1
+		say("No earlier chats in #" + channel)
+		return
+	}
+	showBacklog(channel, chats, fmt.Sprintf("Earlier in #%s, %d chats", channel, len(chats)))
+}
+
 func sendPrivateMessage(personName string, body ...string) string {
 	if !readUser(personName) {
-		fmt.Println("Person does not exist.")
+		say("Person does not exist.")
 		return "Person does not exist."
 	}
 	var result string
@@ -111,30 +322,81 @@ func sendPrivateMessage(personName string, body ...string) string {
 		Receiver:  "@" + personName,
 		Text:      result,
 	}
-	jsonValue, _ := json.Marshal(jsonData)
-	_, err := http.Post(domain+"chat/send", "application/json", bytes.NewBuffer(jsonValue))
+	refusal, err := postChat(jsonData)
 	if err != nil {
-		fmt.Printf("error: sendPrivateMessage, the HTTP request failed with error %s\n", err)
+		reportError("sendPrivateMessage", "send private message to "+personName, err)
 		return "FAIL"
 	}
+	if refusal != "" {
+		say("-!- Could not send to " + personName + ": " + refusal)
+		return "FAIL"
+	}
+	display.echo("@"+personName, nickname+": "+jsonData.Text)
+	completion.addPartner(personName)
+	logChat("@"+personName, jsonData)
 	return jsonData.Text
 }
 
 func receivePrivateMessages() {
 	for {
-		response, err := http.Get(domain + "chat/recv/-" + nickname + "/" + strconv.FormatInt(privateTimestamp, 10))
+		serverLink.wait()
+		response, err := http.Get(domain + "chat/recv/-" + nickname + "/" + strconv.FormatInt(privateTimestamp, 10) + "?after=" + strconv.FormatInt(lastPrivateID, 10))
 		if err != nil {
-			fmt.Printf("error: receivePrivateMessages, the HTTP request failed with error %s\n", err)
+			logger.Error("polling private messages", "func", "receivePrivateMessages", "err", err)
+			serverLink.down(err)
+		} else if unavailable(response) {
+			response.Body.Close()
+			serverLink.down(fmt.Errorf("server answered %s", response.Status))
+		} else if response.StatusCode == http.StatusForbidden {
+			// the server refuses our polls once an admin has killed us
+			data, _ := ioutil.ReadAll(response.Body)
+			say("Disconnected by server: " + strings.TrimSpace(string(data)))
+			exit(1)
+		} else if response.StatusCode == http.StatusConflict {
+			// we did not identify for a registered nickname in time
+			var reply map[string]string
+			data, _ := ioutil.ReadAll(response.Body)
+			json.Unmarshal(data, &reply)
+			sayf("-!- %s is registered to an account, you are now known as %s\n", nickname, reply["nick"])
+			nickname = reply["nick"]
+			nickToken = ""
+			compileNickHighlight()
 		} else {
 			data, _ := ioutil.ReadAll(response.Body)
 			var chats []Chat
 			json.Unmarshal(data, &chats)
 			for _, line := range chats {
-				result := "Private Message from " + line.Sender + ": " + line.Text
-				fmt.Println(result)
 				privateTimestamp = line.Timestamp
+				if line.ID > lastPrivateID {
+					lastPrivateID = line.ID
+				}
+				if line.Sender != serverName {
+					var ok bool
+					if suppress("@"+line.Sender, line) {
+						continue
+					}
+					if line, ok = scriptIncoming("@"+line.Sender, line); !ok {
+						continue
+					}
+				}
+				result := "Private Message from " + line.Sender + ": " + line.Text
+				if line.Kind == chatKindNotice && line.Sender == serverName {
+					result = "-!- Server notice: " + line.Text
+				} else if line.Kind == chatKindNotice {
+					result = "-" + line.Sender + "- " + line.Text
+				}
+				if line.Sender != serverName {
+					logChat("@"+line.Sender, line)
+				}
+				if line.Kind == chatKindNotice {
+					say(result)
+				} else {
+					completion.addPartner(line.Sender)
+					showChat("@"+line.Sender, line, result)
+				}
 			}
 		}
+		time.Sleep(pollInterval)
 	}
 }
 
@@ -146,37 +408,124 @@ func sendChannelChat(body string, channelName string) string {
 		Receiver:  "#" + channelName,
 		Text:      body,
 	}
-	jsonValue, _ := json.Marshal(jsonData)
-	_, err := http.Post(domain+"chat/send", "application/json", bytes.NewBuffer(jsonValue))
+	refusal, err := postChat(jsonData)
 	if err != nil {
-		fmt.Printf("error: sendChannelChat, the HTTP request failed with error %s\n", err)
+		reportError("sendChannelChat", "send to "+channelName, err)
+		return "FAIL"
+	}
+	if refusal != "" {
+		say("-!- Could not send to #" + channelName + ": " + refusal)
 		return "FAIL"
 	}
 	return jsonData.Text
 }
 
+// postChat sends chat to the server; if the server refuses it, because we
+// are muted or the channel is archived say, the reason is returned
+func postChat(chat Chat) (string, error) {
+	jsonValue, _ := json.Marshal(chat)
+	response, err := http.Post(domain+"chat/send", "application/json", bytes.NewBuffer(jsonValue))
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+	data, _ := ioutil.ReadAll(response.Body)
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return firstOf(strings.TrimSpace(string(data)), response.Status), nil
+	}
+	return "", nil
+}
+
 func readChannelChat() {
 	for {
 		if channel == "" {
+			time.Sleep(pollInterval)
 			continue
 		}
-		response, err := http.Get(domain + "chat/recv/+" + channel + "/" + strconv.FormatInt(channelTimestamp, 10))
+		serverLink.wait()
+		response, err := http.Get(domain + "chat/recv/+" + channel + "/" + strconv.FormatInt(channelTimestamp, 10) + "?after=" + strconv.FormatInt(lastChannelID, 10))
 		if err != nil {
-			fmt.Printf("error: readChannelChat, the HTTP request failed with error %s\n", err)
+			logger.Error("polling channel", "func", "readChannelChat", "channel", channel, "err", err)
+			serverLink.down(err)
+		} else if unavailable(response) {
+			response.Body.Close()
+			serverLink.down(fmt.Errorf("server answered %s", response.Status))
+		} else if response.StatusCode == http.StatusNotFound {
+			// the channel was renamed or deleted
+			followChannel()
 		} else {
 			data, _ := ioutil.ReadAll(response.Body)
 			var chats []Chat
 			json.Unmarshal(data, &chats)
 			for _, line := range chats {
-				result := time.Unix(line.Timestamp, 0).String() + ": " + line.Sender + ": " + line.Text
-				fmt.Println(result)
 				channelTimestamp = line.Timestamp
+				if line.ID > lastChannelID {
+					lastChannelID = line.ID
+				}
+				if historyBefore == 0 {
+					historyBefore = line.ID
+				}
+				if suppress("#"+channel, line) {
+					continue
+				}
+				var ok bool
+				if line, ok = scriptIncoming("#"+channel, line); !ok {
+					continue
+				}
+				result := time.Unix(line.Timestamp, 0).String() + ": " + line.Sender + ": " + line.Text
+				showChat("#"+channel, line, result)
+				logChat("#"+channel, line)
 			}
 		}
+		time.Sleep(pollInterval)
 	}
 
 }
 
+// followChannel switches to whichever channel the server has us in now
+func followChannel() {
+	response, err := http.Get(domain + "user/" + nickname)
+	if err != nil {
+		logger.Error("looking up our channel", "func", "followChannel", "err", err)
+		return
+	}
+	data, _ := ioutil.ReadAll(response.Body)
+	var user User
+	json.Unmarshal(data, &user)
+	if user.Connection == channel {
+		return
+	}
+	left := channel
+	channel = user.Connection
+	if channel == "" {
+		say("You are no longer in a channel")
+	} else {
+		say("You are now in " + channel)
+	}
+	if left != "" {
+		scriptEvent("part", left)
+	}
+	if channel != "" {
+		scriptEvent("join", channel)
+	}
+}
+
+// fetchChannel looks up a channel, for its members and their statuses
+func fetchChannel(name string) (Channel, error) {
+	var ch Channel
+	response, err := http.Get(domain + "channel/" + name)
+	if err != nil {
+		return ch, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return ch, fmt.Errorf("server answered %s", response.Status)
+	}
+	data, _ := ioutil.ReadAll(response.Body)
+	err = json.Unmarshal(data, &ch)
+	return ch, err
+}
+
 func readUser(name string) bool {
 	jsonData := User{
 		Nickname:   name,
@@ -185,14 +534,14 @@ func readUser(name string) bool {
 	}
 	jsonValue, _ := json.Marshal(jsonData)
 	response, err := http.Post(domain+"user/"+name, "application/json", bytes.NewBuffer(jsonValue))
-
+	if err != nil {
+		reportError("readUser", "look up "+name, err)
+		return false
+	}
 	data, _ := ioutil.ReadAll(response.Body)
 	var user User
 	json.Unmarshal(data, &user)
-	if err != nil {
-		fmt.Printf("error: readUser, the HTTP request failed with error %s\n", err)
-		return false
-	} else if user.Nickname != name {
+	if user.Nickname != name {
 		return false
 	} else {
 		return true
@@ -210,13 +559,195 @@ func createUser(name string) error {
 	_, err := http.Post(domain+"user", "application/json", bytes.NewBuffer(jsonValue))
 
 	if err != nil {
-		fmt.Printf("error: createUser, the HTTP request failed with error %s\n", err)
+		reportError("createUser", "create user "+name, err)
 	} else {
-		fmt.Println("Logged in as:", jsonData.Nickname)
+		say("Logged in as:", jsonData.Nickname)
+	}
+	return err
+}
+
+// postJSON sends body to one of the server's JSON endpoints, with our operator
+// token if we have one, returning the server's reply
+func postJSON(path string, body map[string]string) (string, error) {
+	jsonValue, _ := json.Marshal(body)
+	request, err := http.NewRequest("POST", domain+path, bytes.NewBuffer(jsonValue))
+	if err != nil {
+		return "", err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("X-Oper-Token", operToken)
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+	data, _ := ioutil.ReadAll(response.Body)
+	if response.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s", strings.TrimSpace(string(data)))
+	}
+	return string(data), nil
+}
+
+func operLogin(name string, password string) error {
+	data, err := postJSON("oper", map[string]string{"user": nickname, "name": name, "password": password})
+	if err != nil {
+		reportError("operLogin", "log in as operator "+name, err)
+		return err
+	}
+	var reply map[string]string
+	json.Unmarshal([]byte(data), &reply)
+	operToken = reply["token"]
+	say("You are now a server operator")
+	return nil
+}
+
+// nickRegistered asks the server whether name is registered to an account
+func nickRegistered(name string) bool {
+	response, err := http.Get(domain + "nickserv/info/" + name)
+	if err != nil {
+		logger.Warn("looking up nickname registration", "nick", name, "err", err)
+		return false
+	}
+	defer response.Body.Close()
+	var info struct {
+		Registered bool `json:"registered"`
+	}
+	data, _ := ioutil.ReadAll(response.Body)
+	json.Unmarshal(data, &info)
+	return info.Registered
+}
+
+// nickServ sends body to one of the /nickserv endpoints and keeps the token
+// it hands back, if any
+func nickServ(path string, body map[string]string) (map[string]string, error) {
+	body["user"] = nickname
+	data, err := postJSON("nickserv/"+path, body)
+	if err != nil {
+		return nil, err
+	}
+	var reply map[string]string
+	json.Unmarshal([]byte(data), &reply)
+	if reply["token"] != "" {
+		nickToken = reply["token"]
+	}
+	return reply, nil
+}
+
+func identify(account string, password string) error {
+	reply, err := nickServ("identify", map[string]string{"account": account, "password": password})
+	if err != nil {
+		reportError("identify", "identify", err)
+		return err
+	}
+	identifiedAccount, identifiedPassword = reply["account"], password
+	say("You are now identified for " + reply["account"])
+	return nil
+}
+
+func registerNick(password string) error {
+	_, err := nickServ("register", map[string]string{"password": password})
+	if err != nil {
+		reportError("registerNick", "register "+nickname, err)
+		return err
+	}
+	identifiedAccount, identifiedPassword = nickname, password
+	say(nickname + " is now registered to your account")
+	return nil
+}
+
+func ghostNick(target string, password string) error {
+	_, err := nickServ("ghost", map[string]string{"target": target, "password": password})
+	if err != nil {
+		reportError("ghostNick", "ghost "+target, err)
+		return err
+	}
+	say(target + " has been ghosted")
+	return nil
+}
+
+// recoverNick ghosts a nickname we own and switches to it
+func recoverNick(target string, password string) error {
+	reply, err := nickServ("recover", map[string]string{"target": target, "password": password})
+	if err != nil {
+		reportError("recoverNick", "recover "+target, err)
+		return err
+	}
+	nickname = reply["nick"]
+	channel = ""
+	compileNickHighlight()
+	say("You are now known as " + nickname)
+	return nil
+}
+
+// chanServ sends a command to ChanServ and prints its reply
+func chanServ(command string) error {
+	data, err := postJSON("chanserv", map[string]string{"user": nickname, "command": command})
+	if err != nil {
+		reportError("chanServ", command, err)
+		return err
+	}
+	var reply map[string]string
+	json.Unmarshal([]byte(data), &reply)
+	for _, line := range strings.Split(reply["reply"], "\n") {
+		say("-ChanServ- " + line)
+	}
+	return nil
+}
+
+// manageChannel asks the server to delete, rename or archive a channel we own
+func manageChannel(channelName string, action string, body map[string]interface{}) error {
+	body["user"] = nickname
+	jsonValue, _ := json.Marshal(body)
+	response, err := http.Post(domain+"channel/"+channelName+"/"+action, "application/json", bytes.NewBuffer(jsonValue))
+	if err != nil {
+		reportError("manageChannel", action+" "+channelName, err)
+		return err
+	}
+	defer response.Body.Close()
+	data, _ := ioutil.ReadAll(response.Body)
+	if response.StatusCode != http.StatusOK {
+		err = fmt.Errorf("%s", strings.TrimSpace(string(data)))
+		reportError("manageChannel", action+" "+channelName, err)
+		return err
+	}
+	if action == "rename" && channel == channelName {
+		channel = body["name"].(string)
+	} else if action == "delete" && channel == channelName {
+		channel = ""
+	}
+	say("Done: " + action + " " + channelName)
+	return nil
+}
+
+// searchChannel prints the chats in a channel that contain text
+func searchChannel(channelName string, text string) error {
+	response, err := http.Get(domain + "chatchannel/" + channelName + "/search?q=" + url.QueryEscape(text))
+	if err != nil {
+		reportError("searchChannel", "search "+channelName, err)
+		return err
+	}
+	data, _ := ioutil.ReadAll(response.Body)
+	var chats []Chat
+	json.Unmarshal(data, &chats)
+	for _, line := range chats {
+		say(time.Unix(line.Timestamp, 0).String() + ": " + line.Sender + ": " + line.Text)
+	}
+	sayf("%d chats found\n", len(chats))
+	return nil
+}
+
+func operCommand(path string, body map[string]string) error {
+	_, err := postJSON(path, body)
+	if err != nil {
+		reportError("operCommand", path, err)
 	}
 	return err
 }
 
+func setMode(channelName string, mode string, target string) error {
+	return operCommand("mode", map[string]string{"user": nickname, "channel": channelName, "mode": mode, "target": target})
+}
+
 func receiveMessages() {
 	go receivePrivateMessages()
 	go readChannelChat()
@@ -224,75 +755,385 @@ func receiveMessages() {
 
 func checkCommands(line string) {
 	tok := strings.Split(line, " ")
+	// aliases come first, so they can stand in for built in commands
+	if body, ok := lookupAlias(tok[0]); ok && strings.HasPrefix(tok[0], "/") {
+		runAlias(tok[0], body, strings.Fields(strings.Join(tok[1:], " ")))
+		return
+	}
 	switch tok[0] {
 	case "/help":
-		fmt.Println("/create [ChannelName] [Name1] [Name2] [Name3...]	creates a channel, if one already exists then creates a 2nd one for it. Subsequent names are operators for the channel. Must have at least 1")
-		fmt.Println("/channels											shows all channels")
-		fmt.Println("/join [ChannelName] [UserName]						joins that respect channel under that username")
-		fmt.Println("/pm [Name] [Text]									sends private message to that user")
-		fmt.Println("/exit												exits the program")
+		say("/create [ChannelName] [Name1] [Name2] [Name3...]	creates a channel, if one already exists then creates a 2nd one for it. Subsequent names are operators for the channel. Must have at least 1")
+		say("/channels											shows all channels")
+		say("/join [ChannelName] [UserName]						joins that respect channel under that username")
+		say("/pm [Name] [Text]									sends private message to that user")
+		say("/mode [ChannelName] [+o|-o|+h|-h|+v|-v|+b|-b] [Name]	changes a channel mode, if you are an operator of that channel (halfops may voice)")
+		say("/oper [OperName] [Password]						logs in as a server operator, once you have used /identify")
+		say("/kill [Name] [Reason]							ends a user's session (server operators only)")
+		say("/wallops [Text]									sends a notice to everyone online (server operators only)")
+		say("/sajoin [Name] [ChannelName]						forces a user into a channel (server operators only)")
+		say("/sapart [Name]									forces a user out of their channel (server operators only)")
+		say("/register [Password]								registers your nickname to a new account")
+		say("/identify [Account] [Password]						identifies you to an account, by default your nickname's")
+		say("/ghost [Name] [Password]							disconnects whoever is using a nickname you own")
+		say("/recover [Name] [Password]							ghosts a nickname you own and switches you to it")
+		say("/delchan [ChannelName]								deletes a channel you own")
+		say("/renamechan [ChannelName] [NewName]					renames a channel you own, keeping its history")
+		say("/archive [ChannelName] [on|off]						makes a channel you own read-only, or writable again")
+		say("/history [Number]									shows earlier chats of your channel, 20 at a time by default")
+		say("/search [ChannelName] [Text]						shows a channel's chats that contain the text")
+		say("/cs [Command]										sends a command to ChanServ, /cs help lists them")
+		say("/query [Name]										opens a window for private messages with that user")
+		say("/win [Number|Name]									switches window; Ctrl-N and Ctrl-P, or Alt-1 to Alt-9, do too")
+		say("/close												closes the active window")
+		say("/log [on|off] [Target|*]							shows or sets whether a channel or conversation is logged to disk")
+		say("/alias [Name] [Commands]							makes /Name run the commands, separated by ;, with $1-$9, $*, $nick and $chan filled in")
+		say("/unalias [Name]										removes an alias")
+		say("/script [list|reload]								lists the loaded Lua scripts, or loads the scripts directory again")
+		say("/highlight [add|del] [Word|/Regexp/]					lists, adds or removes the words that make a chat stand out")
+		say("/mentions											shows the recent chats that mentioned you or a highlight word")
+		say("/ignore [Nick|Mask|/Regexp/] [pm|channel|all|#Channel]	hides chats from matching nicknames, or with matching text; on its own lists what is ignored")
+		say("/unignore [Nick|Mask|/Regexp/]						stops ignoring")
+		say("/profiles											lists the server profiles in the config file")
+		say("/motd												shows the message of the day")
+		say("/exit												exits the program")
+		say("Tab completes commands, nicknames and channel names; press it again for the next match, Shift-Tab for the one before")
 	case "/channels":
-		fmt.Println(showAllChannels())
+		say(showAllChannels())
 	case "/create":
 		if len(tok) >= 2 {
 			createChannel(tok[1], tok[2:]...)
 		} else {
-			fmt.Println("error: checkCommands, failed /create call; check out /help for more info")
+			say("error: checkCommands, failed /create call; check out /help for more info")
 		}
 	case "/join": //Done
 		if len(tok) == 2 {
 			joinChannel(tok[1])
 		} else {
-			fmt.Println("error: checkCommands, failed /join call; check out /help for more info")
+			say("error: checkCommands, failed /join call; check out /help for more info")
 		}
 	case "/pm":
 		if len(tok) >= 3 {
-			sendPrivateMessage(tok[1], tok[2:]...)
+			if text, ok := scriptOutgoing("@"+tok[1], strings.Join(tok[2:], " ")); ok {
+				sendPrivateMessage(tok[1], text)
+			}
+		} else {
+			say("error: checkCommands, failed /pm call; check out /help for more info")
+		}
+	case "/mode":
+		if len(tok) == 4 {
+			setMode(tok[1], tok[2], tok[3])
+		} else {
+			say("error: checkCommands, failed /mode call; check out /help for more info")
+		}
+	case "/oper":
+		if len(tok) == 3 {
+			operLogin(tok[1], tok[2])
+		} else {
+			say("error: checkCommands, failed /oper call; check out /help for more info")
+		}
+	case "/kill":
+		if len(tok) >= 2 {
+			operCommand("oper/kill", map[string]string{"target": tok[1], "reason": strings.Join(tok[2:], " ")})
+		} else {
+			say("error: checkCommands, failed /kill call; check out /help for more info")
+		}
+	case "/wallops":
+		if len(tok) >= 2 {
+			operCommand("oper/wallops", map[string]string{"text": strings.Join(tok[1:], " ")})
+		} else {
+			say("error: checkCommands, failed /wallops call; check out /help for more info")
+		}
+	case "/sajoin":
+		if len(tok) == 3 {
+			operCommand("oper/join", map[string]string{"target": tok[1], "channel": tok[2]})
+		} else {
+			say("error: checkCommands, failed /sajoin call; check out /help for more info")
+		}
+	case "/sapart":
+		if len(tok) == 2 {
+			operCommand("oper/part", map[string]string{"target": tok[1]})
 		} else {
-			fmt.Println("error: checkCommands, failed /pm call; check out /help for more info")
+			say("error: checkCommands, failed /sapart call; check out /help for more info")
 		}
+	case "/register":
+		if len(tok) == 2 {
+			registerNick(tok[1])
+		} else {
+			say("error: checkCommands, failed /register call; check out /help for more info")
+		}
+	case "/identify":
+		if len(tok) == 2 {
+			identify("", tok[1])
+		} else if len(tok) == 3 {
+			identify(tok[1], tok[2])
+		} else {
+			say("error: checkCommands, failed /identify call; check out /help for more info")
+		}
+	case "/ghost":
+		if len(tok) >= 2 {
+			ghostNick(tok[1], strings.Join(tok[2:], " "))
+		} else {
+			say("error: checkCommands, failed /ghost call; check out /help for more info")
+		}
+	case "/recover":
+		if len(tok) >= 2 {
+			recoverNick(tok[1], strings.Join(tok[2:], " "))
+		} else {
+			say("error: checkCommands, failed /recover call; check out /help for more info")
+		}
+	case "/delchan":
+		if len(tok) == 2 {
+			manageChannel(tok[1], "delete", map[string]interface{}{})
+		} else {
+			say("error: checkCommands, failed /delchan call; check out /help for more info")
+		}
+	case "/renamechan":
+		if len(tok) == 3 {
+			manageChannel(tok[1], "rename", map[string]interface{}{"name": tok[2]})
+		} else {
+			say("error: checkCommands, failed /renamechan call; check out /help for more info")
+		}
+	case "/archive":
+		if len(tok) == 2 || len(tok) == 3 {
+			manageChannel(tok[1], "archive", map[string]interface{}{"archived": len(tok) == 2 || tok[2] != "off"})
+		} else {
+			say("error: checkCommands, failed /archive call; check out /help for more info")
+		}
+	case "/search":
+		if len(tok) >= 3 {
+			searchChannel(tok[1], strings.Join(tok[2:], " "))
+		} else {
+			say("error: checkCommands, failed /search call; check out /help for more info")
+		}
+	case "/history":
+		n := backlogSize
+		if len(tok) == 2 {
+			n, _ = strconv.Atoi(tok[1])
+		}
+		if len(tok) <= 2 && n > 0 {
+			showHistory(n)
+		} else {
+			say("error: checkCommands, failed /history call; check out /help for more info")
+		}
+	case "/cs":
+		chanServ(strings.Join(tok[1:], " "))
+	case "/query":
+		if len(tok) == 2 {
+			completion.addPartner(tok[1])
+			display.open("@" + tok[1])
+		} else {
+			say("error: checkCommands, failed /query call; check out /help for more info")
+		}
+	case "/win", "/close":
+		tuiCommand(tok)
+	case "/log":
+		logCommand(tok)
+	case "/alias":
+		aliasCommand(tok)
+	case "/unalias":
+		unaliasCommand(tok)
+	case "/script":
+		scriptCommand(tok)
+	case "/highlight":
+		highlightCommand(tok)
+	case "/mentions":
+		showMentions()
+	case "/ignore":
+		ignoreCommand(tok)
+	case "/unignore":
+		unignoreCommand(tok)
+	case "/profiles":
+		showProfiles()
+	case "/motd":
+		showMOTD()
 	case "/exit":
-		os.Exit(0)
+		exit(0)
 	default:
-		if channel != "" {
-			sendChannelChat(line, channel)
+		// chats go to the conversation in the active window
+		target := display.active()
+		if strings.HasPrefix(target, "@") {
+			if text, ok := scriptOutgoing(target, line); ok {
+				sendPrivateMessage(target[1:], text)
+			}
+		} else if target != "" && target[1:] != channel {
+			say("error: checkCommands, you are not in " + target + ", /join it first")
+		} else if channel != "" {
+			if text, ok := scriptOutgoing("#"+channel, line); ok {
+				sendChannelChat(text, channel)
+			}
 		} else {
-			fmt.Println("error: checkCommands, please enter a channel or use a command")
+			say("error: checkCommands, please enter a channel or use a command")
 		}
 	}
 }
 
 func main() {
+	flag.StringVar(&configFile, "config", envOr("IRC_CONFIG", defaultConfigFile()), "client config file holding the server profiles")
+	profileName := flag.String("profile", os.Getenv("IRC_PROFILE"), "profile to connect with, instead of the config file's default")
+	setup := flag.Bool("setup", false, "run the setup wizard and save a profile, even if the config file exists")
+	// these override the profile, which the IRC_* environment variables
+	// override first
+	var overrides Profile
+	flag.StringVar(&overrides.Server, "server", "", "URL of the IRC server, https:// for TLS")
+	flag.StringVar(&overrides.Nickname, "nick", "", "nickname to log in with")
+	autoJoin := flag.String("join", "", "comma separated channels to join, the first that lets us in")
+	flag.StringVar(&overrides.CA, "ca", "", "PEM bundle of CAs to trust instead of the system ones")
+	flag.StringVar(&overrides.Pin, "pin", "", "hex sha256 of the server certificate's public key")
+	flag.StringVar(&overrides.Cert, "cert", "", "PEM client certificate, for servers that ask for one")
+	flag.StringVar(&overrides.Key, "key", "", "PEM private key for -cert")
+	logFileName := flag.String("log-file", "irc_client.log", "file to append logs to, - for stderr")
+	logFormat := flag.String("log-format", "text", "log format: text (logfmt) or json")
+	logLevelName := flag.String("log-level", "info", "minimum log level: debug, info, warn or error")
+	plain := flag.Bool("plain", false, "print lines instead of using the full-screen UI")
+	chatLogDir := flag.String("chatlog-dir", "", "directory to log conversations to, instead of the config file's or logs/ beside it")
+	chatLogFormat := flag.String("chatlog-format", "", "conversation log format: text, jsonl or html")
+	noChatLog := flag.Bool("no-chatlog", false, "do not log conversations to disk")
+	flag.Parse()
+	if err := setupLogging(*logFileName, *logFormat, *logLevelName); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	var found bool
+	var err error
+	config, found, err = loadConfig(configFile)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	var profile Profile
+	if *setup || (!found && term.IsTerminal(int(os.Stdin.Fd()))) {
+		profile = setupWizard(&config)
+	} else if profile, err = config.profile(*profileName); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	profile.applyEnv()
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "server":
+			profile.Server = overrides.Server
+		case "nick":
+			profile.Nickname = overrides.Nickname
+		case "join":
+			profile.AutoJoin = strings.Split(*autoJoin, ",")
+		case "ca":
+			profile.CA = overrides.CA
+		case "pin":
+			profile.Pin = overrides.Pin
+		case "cert":
+			profile.Cert = overrides.Cert
+		case "key":
+			profile.Key = overrides.Key
+		}
+	})
+	domain = profile.Server
+	if !strings.HasSuffix(domain, "/") {
+		domain += "/"
+	}
+	tlsConfig, err := clientTLSConfig(profile.CA, profile.Pin, profile.Cert, profile.Key)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	configureTLS(tlsConfig)
+	if !*noChatLog {
+		dir := firstOf(*chatLogDir, config.ChatLog.Dir, defaultChatLogDir())
+		if chatLog, err = newChatLogger(dir, firstOf(*chatLogFormat, config.ChatLog.Format, "text")); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
 
-	response, err := http.Get(domain)
+	server, err = fetchServerInfo()
 	if err != nil {
-		fmt.Printf("error: main: the HTTP request failed with error %s\n", err)
+		// servers from before /info only have the welcome page
+		logger.Warn("fetching server info", "err", err)
+		response, err := http.Get(domain)
+		if err != nil {
+			reportError("main", "reach "+domain, err)
+		} else {
+			data, _ := ioutil.ReadAll(response.Body)
+			say(string(data))
+		}
 	} else {
-		data, _ := ioutil.ReadAll(response.Body)
-		fmt.Println(string(data))
+		showServerInfo(server)
 	}
 
-	var user string
-	fmt.Println("What username would you like to use? No spaces")
-	fmt.Scanln(&user)
+	user := profile.Nickname
+	for max := server.Limits["max_nick_length"]; user == "" || strings.ContainsAny(user, " \t") || (max > 0 && len(user) > max); {
+		if max > 0 && len(user) > max {
+			sayf("Usernames can be at most %d characters, try again", max)
+		}
+		user = ask("What username would you like to use? No spaces", "")
+	}
 
 	if readUser(user) {
-		fmt.Println("Username exists. Logging in.")
+		say("Username exists. Logging in.")
 		nickname = user
 	} else {
-		fmt.Println("Username does not exist. Creating.")
+		say("Username does not exist. Creating.")
 		createUser(user)
 		nickname = user
 	}
+	if nickRegistered(nickname) {
+		if password := askPassword("This nickname is registered. Enter its password, or nothing to continue unidentified and be renamed shortly"); password != "" {
+			identify("", password)
+		}
+	}
+	showMOTD()
+
+	if !*plain && term.IsTerminal(int(os.Stdout.Fd())) {
+		if t, err := newTUI(); err != nil {
+			reportError("main", "start the full-screen UI", err)
+		} else {
+			display = t
+		}
+	}
+	if err := compileHighlights(); err != nil {
+		say(err)
+	}
+	if err := compileIgnores(); err != nil {
+		say(err)
+	}
+	if n := loadScripts(scriptsDir()); n > 0 {
+		sayf("Loaded %d scripts from %s", n, scriptsDir())
+	}
+	for _, name := range profile.AutoJoin {
+		if name = strings.TrimPrefix(strings.TrimSpace(name), "#"); name != "" && joinChannel(name) == nil {
+			break
+		}
+	}
 
 	receiveMessages()
 
+	// the user's commands and the scripts' actions take turns
+	lines := make(chan string)
+	if t, ok := display.(*tui); ok {
+		lines = t.lines
+	} else {
+		go readLines(lines)
+	}
 	for {
-		scanner := bufio.NewScanner(os.Stdin)
-		if scanner.Scan() {
-			line := scanner.Text()
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				exit(0)
+			}
 			checkCommands(line)
+		case action := <-scriptActions:
+			action()
 		}
 	}
+}
 
+// readLines sends each line of stdin to lines, closing it at the end
+func readLines(lines chan<- string) {
+	for {
+		line, err := stdin.ReadString('\n')
+		if err != nil {
+			close(lines)
+			return
+		}
+		lines <- strings.TrimRight(line, "\r\n")
+	}
 }
@@ -1,9 +1,16 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"path/filepath"
+	"regexp"
+	"strings"
 	"testing"
+	"time"
 	"fmt"
 )
 
@@ -120,3 +127,420 @@ func TestJoinChannel(t *testing.T){
 		t.Errorf("joinChannel('General') = %s", ans)		
 	}
 }
+
+// Test Case 8:
+// Only connect to a TLS server whose certificate matches the pin
+func TestCertificatePinning(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "")
+	}))
+	defer ts.Close()
+
+	sum := sha256.Sum256(ts.Certificate().RawSubjectPublicKeyInfo)
+	for _, tc := range []struct {
+		pin string
+		ok  bool
+	}{
+		{hex.EncodeToString(sum[:]), true},
+		{strings.Repeat("00", 32), false},
+	} {
+		config, err := clientTLSConfig("", tc.pin, "", "")
+		if err != nil {
+			t.Fatalf("clientTLSConfig() = %s", err)
+		}
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: config}}
+		_, err = client.Get(ts.URL)
+		if (err == nil) != tc.ok {
+			t.Errorf("GET with pin %s = %v; Should succeed: %t", tc.pin, err, tc.ok)
+		}
+	}
+}
+
+// Test Case 9:
+// A script hook that never returns is stopped at the deadline and unloaded,
+// letting the chat through
+func TestScriptTimeout(t *testing.T) {
+	dir := t.TempDir()
+	ioutil.WriteFile(filepath.Join(dir, "spin.lua"), []byte(`irc.on("message", function(target, sender, text) while true do end end)`), 0600)
+	if n := loadScripts(dir); n != 1 {
+		t.Fatalf("loadScripts() = %d; Should load 1 script", n)
+	}
+	start := time.Now()
+	text, ok := scriptFilter("message", "hi", "#General", "Matt")
+	if text != "hi" || !ok {
+		t.Errorf("scriptFilter() = %q, %t; Should let the chat through", text, ok)
+	}
+	if took := time.Since(start); took > 2*scriptTimeout {
+		t.Errorf("scriptFilter() took %s; Should stop after %s", took, scriptTimeout)
+	}
+	scriptMu.Lock()
+	defer scriptMu.Unlock()
+	if len(scripts) != 0 {
+		t.Errorf("%d scripts loaded after the timeout; Should be unloaded", len(scripts))
+	}
+}
+
+// Test Case 10:
+// Long lines wrap at a space where there is one, continue indented, and are
+// left alone when the screen is too narrow to wrap them sensibly
+func TestWrap(t *testing.T) {
+	for _, tc := range []struct {
+		line  string
+		width int
+		want  []string
+	}{
+		{"hello", 20, []string{"hello"}},
+		{"aaaa bbbb cccc dddd", 5, []string{"aaaa bbbb cccc dddd"}},
+		{"aaaa bbbb cccc dddd", 10, []string{"aaaa bbbb", "      cccc", "      dddd"}},
+		{strings.Repeat("x", 25), 10, []string{"xxxxxxxxxx", "      xxxx", "      xxxx", "      xxxx", "      xxx"}},
+		{"ééééé ééééé", 10, []string{"ééééé éééé", "      é"}},
+	} {
+		got := wrap(tc.line, tc.width)
+		if strings.Join(got, "|") != strings.Join(tc.want, "|") {
+			t.Errorf("wrap(%q, %d) = %q; Should be %q", tc.line, tc.width, got, tc.want)
+		}
+	}
+}
+
+// Test Case 11:
+// The wait between reconnect attempts doubles up to reconnectMax, jittered
+// down to no less than half of it
+func TestBackoff(t *testing.T) {
+	for _, tc := range []struct {
+		attempts int
+		max      time.Duration
+	}{
+		{0, reconnectBase},
+		{1, 2 * reconnectBase},
+		{3, 8 * reconnectBase},
+		{6, reconnectMax},
+		{16, reconnectMax},
+		{100, reconnectMax},
+	} {
+		for i := 0; i < 20; i++ {
+			if d := backoff(tc.attempts); d < tc.max/2 || d > tc.max {
+				t.Errorf("backoff(%d) = %s; Should be between %s and %s", tc.attempts, d, tc.max/2, tc.max)
+			}
+		}
+	}
+}
+
+// Test Case 12:
+// Targets and hosts become file names that stay inside the log directory
+func TestSafeFileName(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		want string
+	}{
+		{"#General", "#General"},
+		{"@Matt", "@Matt"},
+		{"localhost:7777", "localhost_7777"},
+		{"../../etc/passwd", ".._.._etc_passwd"},
+		{`a\b`, "a_b"},
+		{"", "_"},
+		{".", "_."},
+		{"..", "_.."},
+	} {
+		if got := safeFileName(tc.name); got != tc.want {
+			t.Errorf("safeFileName(%q) = %q; Should be %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+// Test Case 13:
+// Chats are logged to a file per target and day in the configured format,
+// skipping chats from before the session and targets logging is off for
+func TestChatLoggerWrite(t *testing.T) {
+	when := time.Date(2024, 1, 2, 15, 4, 5, 0, time.Local)
+	chat := Chat{Timestamp: when.Unix(), Sender: "Matt", Receiver: "#General", Text: "<b>hi</b>"}
+	for _, tc := range []struct {
+		format string
+		file   string
+		want   string
+	}{
+		{"text", "#General-2024-01-02.log", "15:04 <Matt> <b>hi</b>\n"},
+		{"jsonl", "#General-2024-01-02.jsonl", `"sender":"Matt","receiver":"#General"`},
+		{"html", "#General-2024-01-02.html", `<span class="nick">&lt;Matt&gt;</span> &lt;b&gt;hi&lt;/b&gt;</div>`},
+	} {
+		dir := t.TempDir()
+		l := &chatLogger{dir: dir, format: tc.format, files: make(map[string]*chatLogFile)}
+		if err := l.write("#General", chat); err != nil {
+			t.Fatalf("write() in %s = %s", tc.format, err)
+		}
+		l.close()
+		dat, err := ioutil.ReadFile(filepath.Join(dir, tc.file))
+		if err != nil || !strings.Contains(string(dat), tc.want) {
+			t.Errorf("%s log = %q, %v; Should contain %q", tc.format, dat, err, tc.want)
+		}
+	}
+
+	dir := t.TempDir()
+	l := &chatLogger{dir: dir, format: "text", files: make(map[string]*chatLogFile), since: when.Unix() + 1}
+	config.ChatLog.Targets = map[string]bool{"@Kobo": false}
+	defer func() { config.ChatLog.Targets = nil }()
+	l.write("#General", chat)
+	l.write("@Kobo", Chat{Sender: "Kobo", Receiver: "@tester", Text: "hi"})
+	l.close()
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Errorf("logged %d files; Should skip old chats and targets logging is off for", len(files))
+	}
+}
+
+// Test Case 14:
+// Tab completes commands and aliases at the start of the line, channels after
+// "#" or a command that takes one, and nicknames otherwise, leaving us out
+func TestComplete(t *testing.T) {
+	c := &completer{
+		members:  []string{"Matt", "kobo", "tester"},
+		partners: map[string]bool{"Jass": true},
+		channels: []string{"General", "Random"},
+	}
+	config.Aliases = map[string]string{"j": "/join $1"}
+	defer func() { config.Aliases = nil }()
+	for _, tc := range []struct {
+		line   string
+		cursor int
+		start  int
+		want   []string
+	}{
+		{"/he", 3, 0, []string{"/help "}},
+		{"/j", 2, 0, []string{"/j ", "/join "}},
+		{"hello #Ge", 9, 6, []string{"#General "}},
+		{"/join r", 7, 6, []string{"Random "}},
+		{"ma", 2, 0, []string{"Matt: "}},
+		{"ma hi", 2, 0, []string{"Matt: "}},
+		{"hi K", 4, 3, []string{"kobo "}},
+		{"hi ", 3, 3, []string{"Jass ", "kobo ", "Matt "}},
+		{"hi te", 5, 3, nil},
+	} {
+		start, got := c.complete([]rune(tc.line), tc.cursor)
+		if start != tc.start || strings.Join(got, "|") != strings.Join(tc.want, "|") {
+			t.Errorf("complete(%q, %d) = %d, %q; Should be %d, %q", tc.line, tc.cursor, start, got, tc.start, tc.want)
+		}
+	}
+}
+
+// Test Case 15:
+// Aliases substitute their arguments, our nickname and channel, and get the
+// arguments appended when they use none
+func TestExpandAlias(t *testing.T) {
+	old := channel
+	channel = "General"
+	defer func() { channel = old }()
+	for _, tc := range []struct {
+		body string
+		args []string
+		want string
+	}{
+		{"/join $1; /history 5", []string{"Random"}, "/join Random; /history 5"},
+		{"/pm $2 $1", []string{"hi", "Matt"}, "/pm Matt hi"},
+		{"/pm Matt $*", []string{"hello", "there"}, "/pm Matt hello there"},
+		{"/join", []string{"Random"}, "/join Random"},
+		{"/join", nil, "/join"},
+		{"/pm $3", []string{"a"}, "/pm "},
+		{"I am $nick in $chan", nil, "I am tester in General"},
+		{"costs $$5 $", []string{"x"}, "costs $5 $ x"},
+		{"$x$", nil, "$x$"},
+	} {
+		if got := expandAlias(tc.body, tc.args); got != tc.want {
+			t.Errorf("expandAlias(%q, %q) = %q; Should be %q", tc.body, tc.args, got, tc.want)
+		}
+	}
+}
+
+// Test Case 16:
+// A chat is a highlight when someone else mentions our nickname or a highlight
+// word as a whole word, or matches a /regexp/ word
+func TestIsHighlight(t *testing.T) {
+	for _, tc := range []struct {
+		word string
+		text string
+		want bool
+	}{
+		{"go", "Go is fun", true},
+		{"go", "let's go!", true},
+		{"go", "gopher", false},
+		{"go", "ergo", false},
+		{"c++", "I like C++ too", true},
+		{"naïve", "so naïve", true},
+	} {
+		if got := regexp.MustCompile(wordPattern(tc.word)).MatchString(tc.text); got != tc.want {
+			t.Errorf("wordPattern(%q) matching %q = %t; Should be %t", tc.word, tc.text, got, tc.want)
+		}
+	}
+
+	config.Highlights = HighlightConfig{Words: []string{"deploy", "/ba+d/"}}
+	defer func() {
+		config.Highlights = HighlightConfig{}
+		compileHighlights()
+	}()
+	if err := compileHighlights(); err != nil {
+		t.Fatalf("compileHighlights() = %s", err)
+	}
+	for _, tc := range []struct {
+		chat Chat
+		want bool
+	}{
+		{Chat{Sender: "Matt", Text: "hey tester, look"}, true},
+		{Chat{Sender: "Matt", Text: "the testers are in"}, false},
+		{Chat{Sender: "Matt", Text: "Deploy is done"}, true},
+		{Chat{Sender: "Matt", Text: "this is baaad"}, true},
+		{Chat{Sender: "Matt", Text: "nothing here"}, false},
+		{Chat{Sender: "tester", Text: "I said deploy"}, false},
+		{Chat{Sender: serverName, Text: "tester joined"}, false},
+	} {
+		if got := isHighlight(tc.chat); got != tc.want {
+			t.Errorf("isHighlight(%+v) = %t; Should be %t", tc.chat, got, tc.want)
+		}
+	}
+	old := nickname
+	nickname = "Guest0042"
+	compileNickHighlight()
+	if !isHighlight(Chat{Sender: "Matt", Text: "hey Guest0042"}) || isHighlight(Chat{Sender: "Matt", Text: "hey tester"}) {
+		t.Errorf("isHighlight() after renaming to Guest0042 still follows the old nickname")
+	}
+	nickname = old
+	config.Highlights.NoNick = true
+	compileNickHighlight()
+	if isHighlight(Chat{Sender: "Matt", Text: "hey tester"}) {
+		t.Errorf("isHighlight() with no_nick = true; Should ignore our nickname")
+	}
+}
+
+// Test Case 17:
+// Ignore masks are split off their scope, a /regexp/ keeping its spaces, and
+// hide chats from matching nicknames or with matching text in their scope,
+// but never the server's notices
+func TestIgnore(t *testing.T) {
+	for _, tc := range []struct {
+		args string
+		mask string
+		rest string
+	}{
+		{"spam*", "spam*", ""},
+		{"spam* pm", "spam*", "pm"},
+		{"  bot!*@* #General ", "bot!*@*", "#General"},
+		{"/buy now/ channel", "/buy now/", "channel"},
+		{"/buy now/", "/buy now/", ""},
+		{"", "", ""},
+	} {
+		if mask, rest := splitMask(tc.args); mask != tc.mask || rest != tc.rest {
+			t.Errorf("splitMask(%q) = %q, %q; Should be %q, %q", tc.args, mask, rest, tc.mask, tc.rest)
+		}
+	}
+
+	for _, mask := range []string{"/(/", "[spam"} {
+		if _, err := newIgnoreMatcher(IgnoreRule{Mask: mask, Scope: "all"}); err == nil {
+			t.Errorf("newIgnoreMatcher(%q) = nil; Should be an error", mask)
+		}
+	}
+
+	var matchers []ignoreMatcher
+	for _, rule := range []IgnoreRule{
+		{Mask: "Spam*", Scope: "all"},
+		{Mask: "bot!*@*", Scope: "pm"},
+		{Mask: "/buy now/", Scope: "channel"},
+		{Mask: "Kobo", Scope: "#Random"},
+	} {
+		m, err := newIgnoreMatcher(rule)
+		if err != nil {
+			t.Fatalf("newIgnoreMatcher(%+v) = %s", rule, err)
+		}
+		matchers = append(matchers, m)
+	}
+	ignoreMu.Lock()
+	ignoreMatchers = matchers
+	ignoreMu.Unlock()
+	defer func() {
+		ignoreMu.Lock()
+		ignoreMatchers = nil
+		ignoreMu.Unlock()
+	}()
+	for _, tc := range []struct {
+		target string
+		chat   Chat
+		want   bool
+	}{
+		{"#General", Chat{Sender: "spammer", Text: "hi"}, true},
+		{"@spammer", Chat{Sender: "spammer", Text: "hi"}, true},
+		{"@bot", Chat{Sender: "bot", Text: "hi"}, true},
+		{"#General", Chat{Sender: "bot", Text: "hi"}, false},
+		{"#General", Chat{Sender: "Matt", Text: "buy now!"}, true},
+		{"@Matt", Chat{Sender: "Matt", Text: "buy now!"}, false},
+		{"#random", Chat{Sender: "Kobo", Text: "hi"}, true},
+		{"#General", Chat{Sender: "Kobo", Text: "hi"}, false},
+		{"#General", Chat{Sender: serverName, Text: "spam buy now"}, false},
+		{"#General", Chat{Sender: "Matt", Text: "hi"}, false},
+	} {
+		if got := ignored(tc.target, tc.chat); got != tc.want {
+			t.Errorf("ignored(%q, %+v) = %t; Should be %t", tc.target, tc.chat, got, tc.want)
+		}
+	}
+}
+
+// recordScreen struct keeps what the client shows, for tests to check
+type recordScreen struct {
+	lines  []string
+	echoes []string
+}
+
+func (s *recordScreen) show(target string, line string)  { s.lines = append(s.lines, line) }
+func (s *recordScreen) echo(target string, line string)  { s.echoes = append(s.echoes, line) }
+func (s *recordScreen) open(target string)               {}
+func (s *recordScreen) alert(target string, line string) { s.lines = append(s.lines, line) }
+func (s *recordScreen) beep()                            {}
+func (s *recordScreen) notify(text string)               {}
+func (s *recordScreen) active() string                   { return "" }
+func (s *recordScreen) close()                           {}
+
+// refusingServer answers every chat with 403 and msg, and knows the user Kobo
+func refusingServer(t *testing.T, msg string) *recordScreen {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/chat/send" {
+			http.Error(w, msg, http.StatusForbidden)
+			return
+		}
+		fmt.Fprint(w, `{"nickname":"Kobo"}`)
+	}))
+	oldDomain, oldDisplay := domain, display
+	rec := &recordScreen{}
+	domain, display = ts.URL+"/", rec
+	t.Cleanup(func() {
+		ts.Close()
+		domain, display = oldDomain, oldDisplay
+	})
+	return rec
+}
+
+// Test Case 18:
+// A private message the server refuses, as it does while we are muted for
+// flooding, is reported and not echoed as if it had been sent
+func TestSendPrivateMessageRefused(t *testing.T) {
+	rec := refusingServer(t, "muted for flooding")
+	if ans := sendPrivateMessage("Kobo", "hi"); ans != "FAIL" {
+		t.Errorf("sendPrivateMessage() = %q; Should be FAIL", ans)
+	}
+	if len(rec.echoes) != 0 {
+		t.Errorf("refused private message was echoed: %q", rec.echoes)
+	}
+	if !strings.Contains(strings.Join(rec.lines, "\n"), "muted for flooding") {
+		t.Errorf("shown %q; Should show the server's refusal", rec.lines)
+	}
+	completion.mu.Lock()
+	defer completion.mu.Unlock()
+	if completion.partners["Kobo"] {
+		t.Errorf("refused private message added Kobo to completion")
+	}
+}
+
+// Test Case 19:
+// Posting to an archived channel shows the server's refusal
+func TestSendChannelChatArchived(t *testing.T) {
+	rec := refusingServer(t, "channel is archived")
+	if ans := sendChannelChat("hi", "Lobby"); ans != "FAIL" {
+		t.Errorf("sendChannelChat() = %q; Should be FAIL", ans)
+	}
+	if shown := strings.Join(rec.lines, "\n"); !strings.Contains(shown, "#Lobby") || !strings.Contains(shown, "channel is archived") {
+		t.Errorf("shown %q; Should tell the user #Lobby is archived", rec.lines)
+	}
+}
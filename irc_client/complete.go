@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// completionRefresh is how often the nicknames and channels that Tab
+// completes are fetched again
+const completionRefresh = 5 * time.Second
+
+// commands are what Tab completes after a "/", kept in the order /help lists
+// them
+var commands = []string{
+	"/help", "/create", "/channels", "/join", "/pm", "/mode", "/oper", "/kill",
+	"/wallops", "/sajoin", "/sapart", "/register", "/identify", "/ghost",
+	"/recover", "/delchan", "/renamechan", "/archive", "/history", "/search",
+	"/cs", "/query", "/win", "/close", "/log", "/alias", "/unalias", "/script",
+	"/highlight", "/mentions", "/ignore", "/unignore", "/profiles", "/motd",
+	"/exit",
+}
+
+// channelCommands take a channel name, without "#", as their first argument
+var channelCommands = map[string]bool{
+	"/join": true, "/delchan": true, "/renamechan": true, "/archive": true, "/search": true,
+}
+
+// completer struct holds what Tab can complete besides commands: the
+// members of our channel, who we have had private conversations with, and
+// the server's channels
+type completer struct {
+	mu       sync.Mutex
+	members  []string
+	partners map[string]bool
+	channels []string
+}
+
+var completion = &completer{partners: make(map[string]bool)}
+
+// addPartner remembers name as someone we have talked to in private
+func (c *completer) addPartner(name string) {
+	c.mu.Lock()
+	c.partners[name] = true
+	c.mu.Unlock()
+}
+
+// refresh fetches our channel's members and the channel list, so completion
+// follows people joining and leaving
+func (c *completer) refresh() {
+	var members []string
+	if name := channel; name != "" {
+		if ch, err := fetchChannel(name); err == nil {
+			members = ch.Connected
+		} else {
+			logger.Debug("fetching members for completion", "channel", name, "err", err)
+		}
+	}
+	channels, err := fetchChannelNames()
+	if err != nil {
+		logger.Debug("fetching channels for completion", "err", err)
+	}
+	c.mu.Lock()
+	c.members = members
+	if err == nil {
+		c.channels = channels
+	}
+	c.mu.Unlock()
+}
+
+func (c *completer) refreshLoop() {
+	c.refresh()
+	for range time.Tick(completionRefresh) {
+		c.refresh()
+	}
+}
+
+func fetchChannelNames() ([]string, error) {
+	response, err := http.Get(domain + "channels/")
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	data, _ := ioutil.ReadAll(response.Body)
+	var channels []Channel
+	if err = json.Unmarshal(data, &channels); err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(channels))
+	for _, ch := range channels {
+		names = append(names, ch.ChannelName)
+	}
+	return names, nil
+}
+
+// nicks are the channel's members and our conversation partners, without us
+func (c *completer) nicks() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	seen := map[string]bool{nickname: true}
+	var nicks []string
+	for _, name := range c.members {
+		if !seen[name] {
+			seen[name] = true
+			nicks = append(nicks, name)
+		}
+	}
+	for name := range c.partners {
+		if !seen[name] {
+			seen[name] = true
+			nicks = append(nicks, name)
+		}
+	}
+	return nicks
+}
+
+// complete returns where the word before cursor starts, and what it can be
+// completed to: commands at the start of the line, channels after "#" or as
+// the argument of a command that takes one, and nicknames otherwise; a
+// nickname at the start of the line is addressed with ": " as is custom
+func (c *completer) complete(line []rune, cursor int) (int, []string) {
+	start := cursor
+	for start > 0 && line[start-1] != ' ' {
+		start--
+	}
+	word := strings.ToLower(string(line[start:cursor]))
+	first := strings.Fields(string(line[:start]))
+	var candidates []string
+	suffix := " "
+	switch {
+	case start == 0 && strings.HasPrefix(word, "/"):
+		candidates = append([]string(nil), commands...)
+		for _, name := range aliasNames() {
+			candidates = append(candidates, "/"+name)
+		}
+	case strings.HasPrefix(word, "#"):
+		c.mu.Lock()
+		for _, name := range c.channels {
+			candidates = append(candidates, "#"+name)
+		}
+		c.mu.Unlock()
+	case len(first) == 1 && channelCommands[first[0]]:
+		c.mu.Lock()
+		candidates = append(candidates, c.channels...)
+		c.mu.Unlock()
+	default:
+		candidates = c.nicks()
+		if start == 0 {
+			suffix = ": "
+		}
+	}
+	var matches []string
+	for _, candidate := range candidates {
+		if strings.HasPrefix(strings.ToLower(candidate), word) {
+			matches = append(matches, candidate+suffix)
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool { return strings.ToLower(matches[i]) < strings.ToLower(matches[j]) })
+	return start, matches
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"golang.org/x/term"
+)
+
+// defaultServer is where new profiles point until the user says otherwise
+const defaultServer = "http://localhost:7777/"
+
+// Profile struct is one server we know how to connect to, and who we are there
+type Profile struct {
+	Server   string   `json:"server"`
+	Nickname string   `json:"nickname,omitempty"`
+	AutoJoin []string `json:"autojoin,omitempty"`
+	CA       string   `json:"ca,omitempty"`
+	Pin      string   `json:"pin,omitempty"`
+	Cert     string   `json:"cert,omitempty"`
+	Key      string   `json:"key,omitempty"`
+}
+
+// Config struct is the client's config file: named profiles, which of them
+// to use when none is asked for, how to log chats, the user's aliases,
+// where their scripts are, what to highlight and whom to ignore
+type Config struct {
+	Default  string             `json:"default"`
+	Profiles map[string]Profile `json:"profiles"`
+	ChatLog  ChatLogConfig      `json:"chatlog"`
+	// Aliases maps a command name, without "/", to the commands it runs
+	Aliases map[string]string `json:"aliases,omitempty"`
+	// ScriptsDir holds the .lua scripts to load, scripts/ beside the config
+	// file if not set
+	ScriptsDir string          `json:"scripts_dir,omitempty"`
+	Highlights HighlightConfig `json:"highlights"`
+	Ignores    []IgnoreRule    `json:"ignores,omitempty"`
+}
+
+// config is what was loaded from configFile
+var config Config
+
+// configFile is where config is loaded from and saved to
+var configFile string
+
+// stdin is shared by the prompts and the plain input loop, so neither loses
+// what the other has buffered
+var stdin = bufio.NewReader(os.Stdin)
+
+// defaultConfigFile is irc_client/config.json in the user's config directory
+func defaultConfigFile() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "irc_client.json"
+	}
+	return filepath.Join(dir, "irc_client", "config.json")
+}
+
+// loadConfig reads name; a missing file is not an error, and leaves an empty
+// config for the first-run wizard to fill in
+func loadConfig(name string) (Config, bool, error) {
+	c := Config{Profiles: make(map[string]Profile)}
+	dat, err := ioutil.ReadFile(name)
+	if os.IsNotExist(err) {
+		return c, false, nil
+	} else if err != nil {
+		return c, false, fmt.Errorf("error: loadConfig, reading %s: %s", name, err)
+	}
+	if err = json.Unmarshal(dat, &c); err != nil {
+		return c, false, fmt.Errorf("error: loadConfig, unmarshaling %s: %s", name, err)
+	}
+	if c.Profiles == nil {
+		c.Profiles = make(map[string]Profile)
+	}
+	return c, true, nil
+}
+
+// saveConfig writes c to name, readable only by us since profiles name our
+// key files
+func saveConfig(name string, c Config) error {
+	dat, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error: saveConfig, marshaling: %s", err)
+	}
+	if err = os.MkdirAll(filepath.Dir(name), 0700); err != nil {
+		return fmt.Errorf("error: saveConfig, creating %s: %s", filepath.Dir(name), err)
+	}
+	if err = ioutil.WriteFile(name, append(dat, '\n'), 0600); err != nil {
+		return fmt.Errorf("error: saveConfig, writing %s: %s", name, err)
+	}
+	return nil
+}
+
+// profile returns the named profile, the default one if name is empty
+func (c Config) profile(name string) (Profile, error) {
+	if name == "" {
+		name = c.Default
+	}
+	if name == "" {
+		return Profile{Server: defaultServer}, nil
+	}
+	p, ok := c.Profiles[name]
+	if !ok {
+		return p, fmt.Errorf("error: profile, no profile %q in %s, have %s", name, configFile, strings.Join(c.profileNames(), ", "))
+	}
+	return p, nil
+}
+
+func (c Config) profileNames() []string {
+	names := make([]string, 0, len(c.Profiles))
+	for name := range c.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// applyEnv overrides the profile with the IRC_* environment variables that
+// are set
+func (p *Profile) applyEnv() {
+	for env, field := range map[string]*string{
+		"IRC_SERVER": &p.Server,
+		"IRC_NICK":   &p.Nickname,
+		"IRC_CA":     &p.CA,
+		"IRC_PIN":    &p.Pin,
+		"IRC_CERT":   &p.Cert,
+		"IRC_KEY":    &p.Key,
+	} {
+		if v := os.Getenv(env); v != "" {
+			*field = v
+		}
+	}
+	if v := os.Getenv("IRC_AUTOJOIN"); v != "" {
+		p.AutoJoin = strings.Split(v, ",")
+	}
+}
+
+func envOr(name string, def string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return def
+}
+
+// firstOf returns the first of values that is set
+func firstOf(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// ask prompts for a line of input, returning def if the user enters nothing
+func ask(prompt string, def string) string {
+	if def != "" {
+		fmt.Printf("%s [%s]: ", prompt, def)
+	} else {
+		fmt.Printf("%s: ", prompt)
+	}
+	line, _ := stdin.ReadString('\n')
+	if line = strings.TrimSpace(line); line != "" {
+		return line
+	}
+	return def
+}
+
+// askPassword prompts for a password without echoing it, where the terminal
+// lets us
+func askPassword(prompt string) string {
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		return ask(prompt, "")
+	}
+	fmt.Print(prompt + ": ")
+	password, _ := term.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Println()
+	return strings.TrimSpace(string(password))
+}
+
+// setupWizard asks for the settings of a new profile, saves it as the default
+// and returns it
+func setupWizard(c *Config) Profile {
+	fmt.Println("Setting up irc_client; press enter to take the suggestion in brackets")
+	name := ask("Profile name", "default")
+	p := c.Profiles[name]
+	if p.Server == "" {
+		p.Server = defaultServer
+	}
+	p.Server = ask("Server URL, https:// for TLS", p.Server)
+	p.Nickname = ask("Nickname, no spaces", p.Nickname)
+	p.AutoJoin = strings.Fields(strings.Replace(ask("Channels to join, in order of preference", strings.Join(p.AutoJoin, " ")), ",", " ", -1))
+	if strings.HasPrefix(p.Server, "https://") {
+		p.CA = ask("CA bundle to trust instead of the system's, if any", p.CA)
+		p.Pin = ask("sha256 pin of the server's public key, if any", p.Pin)
+		p.Cert = ask("Client certificate, if the server asks for one", p.Cert)
+		if p.Cert != "" {
+			p.Key = ask("Private key for that certificate", p.Key)
+		}
+	}
+	c.Profiles[name] = p
+	c.Default = name
+	if err := saveConfig(configFile, *c); err != nil {
+		fmt.Println(err)
+	} else {
+		fmt.Println("Saved profile " + name + " to " + configFile)
+	}
+	return p
+}
+
+// showProfiles lists the profiles in the config file, marking the default
+func showProfiles() {
+	if len(config.Profiles) == 0 {
+		say("No profiles in " + configFile + ", run with -setup to make one")
+		return
+	}
+	for _, name := range config.profileNames() {
+		p := config.Profiles[name]
+		mark := " "
+		if name == config.Default {
+			mark = "*"
+		}
+		sayf("%s %-12s %s as %s, joins %s", mark, name, p.Server, p.Nickname, strings.Join(p.AutoJoin, " "))
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// reconnectBase and reconnectMax bound the wait between reconnect attempts,
+// which doubles after every failure
+const reconnectBase = time.Second
+const reconnectMax = time.Minute
+
+// link struct tracks whether the server is reachable; the poll loops report
+// failures to it and wait while it reconnects
+type link struct {
+	mu   sync.Mutex
+	up   bool
+	cond *sync.Cond
+	// attempts is how many reconnects have failed since the link went down
+	attempts int
+}
+
+var serverLink = newLink()
+
+func newLink() *link {
+	l := &link{up: true}
+	l.cond = sync.NewCond(&l.mu)
+	return l
+}
+
+// isUp reports whether the server was reachable last we knew
+func (l *link) isUp() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.up
+}
+
+// down marks the link as lost and, for the first caller only, starts
+// reconnecting
+func (l *link) down(err error) {
+	l.mu.Lock()
+	if !l.up {
+		l.mu.Unlock()
+		return
+	}
+	l.up = false
+	l.attempts = 0
+	l.mu.Unlock()
+	logger.Warn("lost connection to server", "err", err)
+	say("-!- Lost connection to the server, reconnecting")
+	go l.reconnect()
+}
+
+// unavailable reports whether a response came from a proxy whose server is
+// down rather than from the server itself
+func unavailable(response *http.Response) bool {
+	return response.StatusCode == http.StatusBadGateway || response.StatusCode == http.StatusServiceUnavailable || response.StatusCode == http.StatusGatewayTimeout
+}
+
+// wait blocks until the link is up
+func (l *link) wait() {
+	l.mu.Lock()
+	for !l.up {
+		l.cond.Wait()
+	}
+	l.mu.Unlock()
+}
+
+// backoff is how long to wait before the attempt after n failed ones:
+// exponential up to reconnectMax, with jitter so clients that lost the same
+// server do not all come back at once
+func backoff(n int) time.Duration {
+	d := reconnectMax
+	if n < 16 {
+		if d = reconnectBase << uint(n); d > reconnectMax {
+			d = reconnectMax
+		}
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// reconnect retries the server until it answers, then logs back in and
+// rejoins before letting the poll loops go on from the last chats they saw
+func (l *link) reconnect() {
+	for {
+		l.mu.Lock()
+		attempt := l.attempts
+		l.attempts++
+		l.mu.Unlock()
+		time.Sleep(backoff(attempt))
+		info, err := fetchServerInfo()
+		if err != nil {
+			logger.Info("reconnect failed", "attempt", attempt+1, "err", err)
+			continue
+		}
+		resync(info)
+		l.mu.Lock()
+		l.up = true
+		l.cond.Broadcast()
+		l.mu.Unlock()
+		say("-!- Reconnected to " + info.Name)
+		return
+	}
+}
+
+// resync brings a server that may have restarted back to where we left it:
+// our user, our account and our channel
+func resync(info ServerInfo) {
+	restarted := info.Started != server.Started
+	server = info
+	if !restarted {
+		return
+	}
+	logger.Info("server restarted, logging in again", "started", info.Started)
+	// tokens do not survive a restart
+	nickToken = ""
+	if operToken != "" {
+		operToken = ""
+		say("-!- The server restarted, use /oper again for operator status")
+	}
+	if !readUser(nickname) {
+		createUser(nickname)
+	}
+	if identifiedAccount != "" {
+		identify(identifiedAccount, identifiedPassword)
+	}
+	if channel != "" {
+		joinChannel(channel)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/term"
+)
+
+// statusWindow is the target of the window for everything that is not a
+// channel ("#name") or a private conversation ("@nick")
+const statusWindow = "*status*"
+
+// screen interface is how the client shows things to the user: the
+// full-screen UI, or plain lines on stdout
+type screen interface {
+	// show adds a line to the target's window; "" is the active window
+	show(target string, line string)
+	// echo shows a chat we sent, which plain output leaves to the terminal
+	echo(target string, line string)
+	// open makes a window for target, if there is none, and switches to it
+	open(target string)
+	// alert adds a line that mentions us, drawn so it stands out
+	alert(target string, line string)
+	// beep rings the terminal's bell
+	beep()
+	// notify pops up a desktop notification with text, which has no control
+	// characters, on terminals that understand OSC 9
+	notify(text string)
+	// active is the target of the window the user is typing in
+	active() string
+	close()
+}
+
+// display is where the client's output goes; main switches it to the
+// full-screen UI when stdout is a terminal
+var display screen = plainScreen{}
+
+// plainScreen prints every line to stdout, as the client always has
+type plainScreen struct{}
+
+func (plainScreen) show(target string, line string) {
+	fmt.Println(line)
+}
+
+func (plainScreen) echo(target string, line string) {}
+
+// alert prints the line in bold, when stdout is a terminal that shows it
+func (plainScreen) alert(target string, line string) {
+	if term.IsTerminal(int(os.Stdout.Fd())) {
+		line = "\x1b[1m" + line + "\x1b[0m"
+	}
+	fmt.Println(line)
+}
+
+func (plainScreen) beep() {
+	if term.IsTerminal(int(os.Stdout.Fd())) {
+		fmt.Print("\a")
+	}
+}
+
+// notify sends OSC 9, which terminals that understand it turn into a
+// notification and the rest ignore
+func (plainScreen) notify(text string) {
+	if term.IsTerminal(int(os.Stdout.Fd())) {
+		fmt.Print("\x1b]9;" + text + "\x07")
+	}
+}
+
+func (plainScreen) open(target string) {}
+
+func (plainScreen) active() string {
+	return ""
+}
+
+func (plainScreen) close() {}
+
+// say shows a line of output in the active window, the way fmt.Println would
+func say(a ...interface{}) {
+	display.show("", strings.TrimSuffix(fmt.Sprintln(a...), "\n"))
+}
+
+func sayf(format string, a ...interface{}) {
+	display.show("", strings.TrimSuffix(fmt.Sprintf(format, a...), "\n"))
+}
+
+// exit puts the terminal back the way we found it before leaving
+func exit(code int) {
+	display.close()
+	if chatLog != nil {
+		chatLog.close()
+	}
+	os.Exit(code)
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// maxMentions is how many highlights /mentions keeps
+const maxMentions = 100
+
+// notifyTimeout is how long the notification command may run
+const notifyTimeout = 10 * time.Second
+
+// HighlightConfig struct is the config file's settings for which chats stand
+// out and how we are told about them
+type HighlightConfig struct {
+	// Words highlight a chat containing them as a whole word, ignoring case;
+	// a word written /like this/ is a regular expression instead
+	Words []string `json:"words,omitempty"`
+	// NoNick stops our own nickname from being a highlight word
+	NoNick bool `json:"no_nick,omitempty"`
+	// Notify is bell (the default), osc9, both or none; OSC 9 notifications
+	// are only sent by the plain output, not the full-screen UI
+	Notify string `json:"notify,omitempty"`
+	// Command is run through the shell on every highlight, with the chat in
+	// IRC_TARGET, IRC_SENDER and IRC_TEXT
+	Command string `json:"command,omitempty"`
+}
+
+// mention struct is a highlight kept for /mentions
+type mention struct {
+	target string
+	chat   Chat
+}
+
+// highlightMu guards highlightRules, nickRule, mentions and
+// config.Highlights, which the poll loops use
+var highlightMu sync.Mutex
+var highlightRules []*regexp.Regexp
+var mentions []mention
+
+// nickRule matches our nickname, unless the config turns that off; it is made
+// again whenever the nickname changes
+var nickRule *regexp.Regexp
+
+// wordPattern matches word on its own, not inside a longer word
+func wordPattern(word string) string {
+	return `(?i)(^|[^\pL\pN_])` + regexp.QuoteMeta(word) + `($|[^\pL\pN_])`
+}
+
+// compileHighlights turns the config's highlight words into rules
+func compileHighlights() error {
+	var rules []*regexp.Regexp
+	for _, word := range config.Highlights.Words {
+		pattern := wordPattern(word)
+		if len(word) > 2 && strings.HasPrefix(word, "/") && strings.HasSuffix(word, "/") {
+			pattern = word[1 : len(word)-1]
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return fmt.Errorf("error: compileHighlights, %s: %s", word, err)
+		}
+		rules = append(rules, re)
+	}
+	highlightMu.Lock()
+	highlightRules = rules
+	highlightMu.Unlock()
+	compileNickHighlight()
+	return nil
+}
+
+// compileNickHighlight makes nickRule for our current nickname
+func compileNickHighlight() {
+	highlightMu.Lock()
+	defer highlightMu.Unlock()
+	nickRule = nil
+	if !config.Highlights.NoNick && nickname != "" {
+		nickRule = regexp.MustCompile(wordPattern(nickname))
+	}
+}
+
+// isHighlight reports whether a chat someone else sent mentions us or one of
+// the highlight words
+func isHighlight(chat Chat) bool {
+	if chat.Sender == nickname || chat.Sender == serverName {
+		return false
+	}
+	highlightMu.Lock()
+	defer highlightMu.Unlock()
+	if nickRule != nil && nickRule.MatchString(chat.Text) {
+		return true
+	}
+	for _, re := range highlightRules {
+		if re.MatchString(chat.Text) {
+			return true
+		}
+	}
+	return false
+}
+
+// showChat shows line in target's window, and if the chat is a highlight
+// makes it stand out, keeps it for /mentions and notifies the user
+func showChat(target string, chat Chat, line string) {
+	if !isHighlight(chat) {
+		display.show(target, line)
+		return
+	}
+	display.alert(target, line)
+	highlightMu.Lock()
+	mentions = append(mentions, mention{target: target, chat: chat})
+	if len(mentions) > maxMentions {
+		mentions = mentions[len(mentions)-maxMentions:]
+	}
+	highlightMu.Unlock()
+	notify(target, chat)
+}
+
+// notify rings the bell or sends an OSC 9 desktop notification, as the
+// config says, and runs the notification command
+func notify(target string, chat Chat) {
+	highlightMu.Lock()
+	highlights := config.Highlights
+	highlightMu.Unlock()
+	how := firstOf(highlights.Notify, "bell")
+	if how == "bell" || how == "both" {
+		display.beep()
+	}
+	if how == "osc9" || how == "both" {
+		// any control character, not just BEL and ESC, could end the
+		// sequence early or start one of the sender's choosing
+		display.notify(strings.Map(func(r rune) rune {
+			if unicode.IsControl(r) {
+				return -1
+			}
+			return r
+		}, chat.Sender+" in "+target+": "+chat.Text))
+	}
+	if highlights.Command == "" {
+		return
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+		defer cancel()
+		cmd := exec.CommandContext(ctx, "sh", "-c", highlights.Command)
+		cmd.Env = append(os.Environ(), "IRC_TARGET="+target, "IRC_SENDER="+chat.Sender, "IRC_TEXT="+chat.Text)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			logger.Error("running notification command", "func", "notify", "err", err, "output", string(out))
+		}
+	}()
+}
+
+// showMentions lists the recent highlights across every window
+func showMentions() {
+	highlightMu.Lock()
+	defer highlightMu.Unlock()
+	if len(mentions) == 0 {
+		say("No mentions yet")
+		return
+	}
+	say("----- Mentions -----")
+	for _, m := range mentions {
+		sayf("%s %s <%s> %s", time.Unix(m.chat.Timestamp, 0).Format("Jan 02 15:04"), m.target, m.chat.Sender, m.chat.Text)
+	}
+	say("----- End of mentions -----")
+}
+
+// setHighlightWords changes the highlight words; only the main loop does
+func setHighlightWords(words []string) {
+	highlightMu.Lock()
+	config.Highlights.Words = words
+	highlightMu.Unlock()
+}
+
+// highlightCommand handles /highlight: on its own it lists the highlight
+// words, "add" and "del" change them
+func highlightCommand(tok []string) {
+	if len(tok) == 1 {
+		if !config.Highlights.NoNick {
+			say("Highlighting your nickname, " + nickname)
+		}
+		for _, word := range config.Highlights.Words {
+			say("Highlighting " + word)
+		}
+		return
+	}
+	word := strings.Join(tok[2:], " ")
+	if len(tok) < 3 || (tok[1] != "add" && tok[1] != "del") {
+		say("error: checkCommands, failed /highlight call; check out /help for more info")
+		return
+	}
+	words := config.Highlights.Words
+	var changed []string
+	if tok[1] == "add" {
+		changed = append(append(changed, words...), word)
+	} else {
+		for _, w := range words {
+			if w != word {
+				changed = append(changed, w)
+			}
+		}
+	}
+	setHighlightWords(changed)
+	if err := compileHighlights(); err != nil {
+		setHighlightWords(words)
+		say(err)
+		return
+	}
+	if err := saveConfig(configFile, config); err != nil {
+		reportError("highlightCommand", "save the config", err)
+	}
+	say("Highlight words: " + strings.Join(config.Highlights.Words, ", "))
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// IgnoreRule struct is one entry of the ignore list: chats from nicknames
+// matching Mask, a glob like "spam*" or "bot!*@*", or whose text matches
+// Mask written /like this/, are not shown
+type IgnoreRule struct {
+	Mask string `json:"mask"`
+	// Scope is pm, channel, all, or a single "#channel"
+	Scope string `json:"scope"`
+}
+
+// ignoreMatcher struct is an IgnoreRule ready to match chats
+type ignoreMatcher struct {
+	IgnoreRule
+	nick string
+	re   *regexp.Regexp
+}
+
+// ignoreMu guards ignoreMatchers and suppressed, which the poll loops and
+// the status bar use
+var ignoreMu sync.Mutex
+var ignoreMatchers []ignoreMatcher
+
+// suppressed counts, per target, the chats the ignore list has hidden
+var suppressed = make(map[string]int)
+
+func newIgnoreMatcher(rule IgnoreRule) (ignoreMatcher, error) {
+	m := ignoreMatcher{IgnoreRule: rule}
+	if len(rule.Mask) > 2 && strings.HasPrefix(rule.Mask, "/") && strings.HasSuffix(rule.Mask, "/") {
+		re, err := regexp.Compile(rule.Mask[1 : len(rule.Mask)-1])
+		if err != nil {
+			return m, fmt.Errorf("error: newIgnoreMatcher, %s: %s", rule.Mask, err)
+		}
+		m.re = re
+		return m, nil
+	}
+	// only nicknames reach the client, so the rest of a full mask matches
+	// anyone
+	m.nick = strings.ToLower(strings.SplitN(rule.Mask, "!", 2)[0])
+	if _, err := path.Match(m.nick, ""); err != nil {
+		return m, fmt.Errorf("error: newIgnoreMatcher, %s: %s", rule.Mask, err)
+	}
+	return m, nil
+}
+
+// compileIgnores turns the config's ignore list into matchers
+func compileIgnores() error {
+	var matchers []ignoreMatcher
+	for _, rule := range config.Ignores {
+		m, err := newIgnoreMatcher(rule)
+		if err != nil {
+			return err
+		}
+		matchers = append(matchers, m)
+	}
+	ignoreMu.Lock()
+	ignoreMatchers = matchers
+	ignoreMu.Unlock()
+	return nil
+}
+
+// inScope reports whether the rule covers target, "#channel" or "@nick"
+func (m ignoreMatcher) inScope(target string) bool {
+	switch m.Scope {
+	case "pm":
+		return strings.HasPrefix(target, "@")
+	case "channel":
+		return strings.HasPrefix(target, "#")
+	case "all", "":
+		return true
+	}
+	return strings.EqualFold(m.Scope, target)
+}
+
+// ignored reports whether the ignore list hides chat in target; notices from
+// the server always get through
+func ignored(target string, chat Chat) bool {
+	if chat.Sender == serverName {
+		return false
+	}
+	ignoreMu.Lock()
+	defer ignoreMu.Unlock()
+	for _, m := range ignoreMatchers {
+		if !m.inScope(target) {
+			continue
+		}
+		if m.re != nil && m.re.MatchString(chat.Text) {
+			return true
+		}
+		if ok, _ := path.Match(m.nick, strings.ToLower(chat.Sender)); m.re == nil && ok {
+			return true
+		}
+	}
+	return false
+}
+
+// suppress hides chat in target if it is ignored, counting it
+func suppress(target string, chat Chat) bool {
+	if !ignored(target, chat) {
+		return false
+	}
+	ignoreMu.Lock()
+	suppressed[target]++
+	ignoreMu.Unlock()
+	return true
+}
+
+func suppressedCount(target string) int {
+	ignoreMu.Lock()
+	defer ignoreMu.Unlock()
+	return suppressed[target]
+}
+
+// ignoreCommand handles /ignore: on its own it lists the ignore list and how
+// many chats it has hidden where, with a mask and optional scope it adds to
+// the list
+func ignoreCommand(tok []string) {
+	if len(tok) == 1 {
+		if len(config.Ignores) == 0 {
+			say("Ignoring no one")
+		}
+		for _, rule := range config.Ignores {
+			sayf("Ignoring %s in %s", rule.Mask, rule.Scope)
+		}
+		ignoreMu.Lock()
+		var counts []string
+		for target, n := range suppressed {
+			counts = append(counts, fmt.Sprintf("%s %d", target, n))
+		}
+		ignoreMu.Unlock()
+		sort.Strings(counts)
+		if len(counts) > 0 {
+			say("Hidden so far: " + strings.Join(counts, ", "))
+		}
+		return
+	}
+	mask, rest := splitMask(strings.Join(tok[1:], " "))
+	rule := IgnoreRule{Mask: mask, Scope: "all"}
+	if rest != "" {
+		rule.Scope = rest
+	}
+	if mask == "" || strings.Contains(rule.Scope, " ") || (rule.Scope != "pm" && rule.Scope != "channel" && rule.Scope != "all" && !strings.HasPrefix(rule.Scope, "#")) {
+		say("error: checkCommands, failed /ignore call; check out /help for more info")
+		return
+	}
+	if _, err := newIgnoreMatcher(rule); err != nil {
+		say(err)
+		return
+	}
+	rules := config.Ignores
+	config.Ignores = nil
+	for _, r := range rules {
+		if r.Mask != rule.Mask {
+			config.Ignores = append(config.Ignores, r)
+		}
+	}
+	config.Ignores = append(config.Ignores, rule)
+	saveIgnores()
+	sayf("Ignoring %s in %s", rule.Mask, rule.Scope)
+}
+
+// unignoreCommand handles /unignore [Mask]
+func unignoreCommand(tok []string) {
+	mask, rest := splitMask(strings.Join(tok[1:], " "))
+	if mask == "" || rest != "" {
+		say("error: checkCommands, failed /unignore call; check out /help for more info")
+		return
+	}
+	rules := config.Ignores
+	config.Ignores = nil
+	for _, r := range rules {
+		if r.Mask != mask {
+			config.Ignores = append(config.Ignores, r)
+		}
+	}
+	if len(config.Ignores) == len(rules) {
+		say("Not ignoring " + mask)
+		return
+	}
+	saveIgnores()
+	say("No longer ignoring " + mask)
+}
+
+// splitMask takes the mask off the front of args, a /regexp/ running to
+// its closing slash since it may hold spaces
+func splitMask(args string) (string, string) {
+	args = strings.TrimSpace(args)
+	if strings.HasPrefix(args, "/") {
+		if end := strings.LastIndex(args, "/"); end > 0 {
+			return args[:end+1], strings.TrimSpace(args[end+1:])
+		}
+	}
+	fields := strings.SplitN(args, " ", 2)
+	if len(fields) == 1 {
+		return fields[0], ""
+	}
+	return fields[0], strings.TrimSpace(fields[1])
+}
+
+// saveIgnores puts a changed ignore list to use and saves it
+func saveIgnores() {
+	if err := compileIgnores(); err != nil {
+		say(err)
+	}
+	if err := saveConfig(configFile, config); err != nil {
+		reportError("saveIgnores", "save the config", err)
+	}
+}
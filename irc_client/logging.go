@@ -0,0 +1,62 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+)
+
+// logLevel is the minimum level the client logs
+var logLevel slog.LevelVar
+
+// logger is where errors and diagnostics go, so they never land in the
+// middle of the chat; main points it at the -log-file
+var logger = slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: &logLevel}))
+
+// logFile is shown to the user when something fails, so they know where to look
+var logFile = "stderr"
+
+// setupLogging sends the client's logs to name, "-" meaning stderr, in format
+// text (logfmt) or json, at level and above
+func setupLogging(name string, format string, level string) error {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		return fmt.Errorf("error: setupLogging, unknown log level %q, use debug, info, warn or error", level)
+	}
+	logLevel.Set(l)
+	var w io.Writer = os.Stderr
+	if name != "-" && name != "" {
+		f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			return fmt.Errorf("error: setupLogging, opening %s: %s", name, err)
+		}
+		w = f
+		logFile = name
+	}
+	opts := &slog.HandlerOptions{Level: &logLevel}
+	switch format {
+	case "json":
+		logger = slog.New(slog.NewJSONHandler(w, opts))
+	case "text", "logfmt":
+		logger = slog.New(slog.NewTextHandler(w, opts))
+	default:
+		return fmt.Errorf("error: setupLogging, unknown log format %q, use text or json", format)
+	}
+	return nil
+}
+
+// reportError logs err and tells the user, in one short line, what did not
+// work; background loops only log
+func reportError(fn string, action string, err error) {
+	logger.Error(action, "func", fn, "err", err)
+	sayf("Could not %s, see %s for details\n", action, logFile)
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// scriptEvents are what scripts can hook with irc.on: "message" gets
+// (target, sender, text) for every chat we receive, "send" gets
+// (target, text) for every chat we send, and "join" and "part" get the
+// channel. message and send hooks return nothing to let the chat through,
+// false to drop it, or a string to use instead of its text
+var scriptEvents = map[string]bool{"message": true, "send": true, "join": true, "part": true}
+
+// scriptTimeout is how long loading a script or a single call into it may
+// run; a script that takes longer is unloaded, since every hook holds up the
+// client
+const scriptTimeout = 2 * time.Second
+
+// script struct is one loaded .lua file, in a Lua state of its own so a
+// broken script cannot break the others
+type script struct {
+	name   string
+	L      *lua.LState
+	hooks  map[string][]*lua.LFunction
+	stop   chan struct{}
+	closed bool
+}
+
+// scriptMu guards scripts and serializes every call into Lua, since Lua
+// states are not safe to share between goroutines
+var scriptMu sync.Mutex
+var scripts []*script
+
+// scriptActions carries what scripts ask the client to do to the main loop,
+// which runs them between the user's commands; running them from inside a
+// hook could call the hooks again
+var scriptActions = make(chan func(), 64)
+
+// defaultScriptsDir is scripts/ next to the config file
+func defaultScriptsDir() string {
+	return filepath.Join(filepath.Dir(configFile), "scripts")
+}
+
+func scriptsDir() string {
+	return firstOf(config.ScriptsDir, defaultScriptsDir())
+}
+
+// loadScripts unloads every script and loads each .lua file in dir, in name
+// order; a script that fails to load is reported and skipped
+func loadScripts(dir string) int {
+	scriptMu.Lock()
+	defer scriptMu.Unlock()
+	for _, s := range scripts {
+		s.unload()
+	}
+	scripts = nil
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		logger.Debug("reading scripts", "func", "loadScripts", "dir", dir, "err", err)
+		return 0
+	}
+	var names []string
+	for _, f := range files {
+		if !f.IsDir() && strings.HasSuffix(f.Name(), ".lua") {
+			names = append(names, f.Name())
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		s := newScript(name)
+		ctx, cancel := context.WithTimeout(context.Background(), scriptTimeout)
+		s.L.SetContext(ctx)
+		err := s.L.DoFile(filepath.Join(dir, name))
+		s.L.RemoveContext()
+		cancel()
+		if err != nil {
+			reportError("loadScripts", "load the script "+name, err)
+			s.unload()
+			continue
+		}
+		scripts = append(scripts, s)
+		logger.Info("loaded script", "name", name, "hooks", len(s.hooks))
+	}
+	return len(scripts)
+}
+
+// newScript makes the Lua state for a script, with the irc table as its API
+func newScript(name string) *script {
+	s := &script{name: name, L: lua.NewState(), hooks: make(map[string][]*lua.LFunction), stop: make(chan struct{})}
+	api := map[string]lua.LGFunction{
+		// irc.on(event, fn) hooks fn to one of scriptEvents
+		"on": func(L *lua.LState) int {
+			event := L.CheckString(1)
+			if !scriptEvents[event] {
+				L.ArgError(1, "unknown event "+event+", use message, send, join or part")
+			}
+			s.hooks[event] = append(s.hooks[event], L.CheckFunction(2))
+			return 0
+		},
+		// irc.every(seconds, fn) calls fn every so many seconds
+		"every": func(L *lua.LState) int {
+			s.timer(time.Duration(float64(L.CheckNumber(1))*float64(time.Second)), L.CheckFunction(2), true)
+			return 0
+		},
+		// irc.after(seconds, fn) calls fn once, so many seconds from now
+		"after": func(L *lua.LState) int {
+			s.timer(time.Duration(float64(L.CheckNumber(1))*float64(time.Second)), L.CheckFunction(2), false)
+			return 0
+		},
+		// irc.send(target, text) sends a chat to "#channel" or "@nick",
+		// without going through the send hooks
+		"send": func(L *lua.LState) int {
+			target, text := L.CheckString(1), L.CheckString(2)
+			queueScriptAction(s, func() { scriptSend(target, text) })
+			return 0
+		},
+		// irc.command(line) runs line as if the user had typed it
+		"command": func(L *lua.LState) int {
+			line := L.CheckString(1)
+			queueScriptAction(s, func() { checkCommands(line) })
+			return 0
+		},
+		// irc.print(text) shows text to the user
+		"print": func(L *lua.LState) int {
+			say(L.CheckString(1))
+			return 0
+		},
+		"nick": func(L *lua.LState) int {
+			L.Push(lua.LString(nickname))
+			return 1
+		},
+		"channel": func(L *lua.LState) int {
+			L.Push(lua.LString(channel))
+			return 1
+		},
+	}
+	s.L.SetGlobal("irc", s.L.SetFuncs(s.L.NewTable(), api))
+	return s
+}
+
+// queueScriptAction hands action to the main loop, dropping it rather than
+// waiting while the loop is busy, since we hold scriptMu
+func queueScriptAction(s *script, action func()) {
+	select {
+	case scriptActions <- action:
+	default:
+		logger.Warn("dropped script action, too many queued", "script", s.name)
+	}
+}
+
+// timer calls fn after d, and every d after that if repeat, until the
+// script is unloaded
+func (s *script) timer(d time.Duration, fn *lua.LFunction, repeat bool) {
+	if d < 100*time.Millisecond {
+		d = 100 * time.Millisecond
+	}
+	go func() {
+		ticker := time.NewTicker(d)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.stop:
+				return
+			case <-ticker.C:
+			}
+			scriptMu.Lock()
+			if !s.closed {
+				s.call(fn)
+			}
+			scriptMu.Unlock()
+			if !repeat {
+				return
+			}
+		}
+	}()
+}
+
+// call calls fn with args and returns what it returned; errors are reported
+// and return nil, and a call that runs past scriptTimeout unloads the
+// script. Must hold scriptMu
+func (s *script) call(fn *lua.LFunction, args ...lua.LValue) lua.LValue {
+	if s.closed {
+		return lua.LNil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), scriptTimeout)
+	defer cancel()
+	s.L.SetContext(ctx)
+	err := s.L.CallByParam(lua.P{Fn: fn, NRet: 1, Protect: true}, args...)
+	s.L.RemoveContext()
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		logger.Error("script timed out", "func", "call", "script", s.name, "timeout", scriptTimeout)
+		sayf("-!- Script %s ran longer than %s and was unloaded", s.name, scriptTimeout)
+		s.unload()
+		removeScript(s)
+		return lua.LNil
+	}
+	if err != nil {
+		logger.Error("running script", "func", "call", "script", s.name, "err", err)
+		say("-!- Script " + s.name + ": " + err.Error())
+		return lua.LNil
+	}
+	ret := s.L.Get(-1)
+	s.L.Pop(1)
+	return ret
+}
+
+// unload stops the script's timers and closes its state; must hold scriptMu
+func (s *script) unload() {
+	if !s.closed {
+		s.closed = true
+		close(s.stop)
+		s.L.Close()
+	}
+}
+
+// removeScript takes an unloaded script off the list; the list is copied, as
+// callers may be ranging over it. Must hold scriptMu
+func removeScript(s *script) {
+	var kept []*script
+	for _, other := range scripts {
+		if other != s {
+			kept = append(kept, other)
+		}
+	}
+	scripts = kept
+}
+
+// scriptFilter passes text through the hooks for event in turn; false if
+// one of them dropped it
+func scriptFilter(event string, text string, args ...string) (string, bool) {
+	scriptMu.Lock()
+	defer scriptMu.Unlock()
+	for _, s := range scripts {
+		for _, fn := range s.hooks[event] {
+			params := make([]lua.LValue, 0, len(args)+1)
+			for _, arg := range args {
+				params = append(params, lua.LString(arg))
+			}
+			switch ret := s.call(fn, append(params, lua.LString(text))...).(type) {
+			case lua.LBool:
+				if !ret {
+					return text, false
+				}
+			case lua.LString:
+				text = string(ret)
+			}
+		}
+	}
+	return text, true
+}
+
+// scriptIncoming runs the message hooks on a chat we received for target
+func scriptIncoming(target string, chat Chat) (Chat, bool) {
+	text, ok := scriptFilter("message", chat.Text, target, chat.Sender)
+	chat.Text = text
+	return chat, ok
+}
+
+// scriptOutgoing runs the send hooks on a chat we are about to send
+func scriptOutgoing(target string, text string) (string, bool) {
+	return scriptFilter("send", text, target)
+}
+
+// scriptEvent tells the hooks for event, join or part, about channelName
+func scriptEvent(event string, channelName string) {
+	scriptMu.Lock()
+	defer scriptMu.Unlock()
+	for _, s := range scripts {
+		for _, fn := range s.hooks[event] {
+			s.call(fn, lua.LString(channelName))
+		}
+	}
+}
+
+// scriptSend sends text to "#channel", or to "@nick" or plain "nick"
+func scriptSend(target string, text string) {
+	if strings.HasPrefix(target, "#") {
+		sendChannelChat(text, target[1:])
+	} else {
+		sendPrivateMessage(strings.TrimPrefix(target, "@"), text)
+	}
+}
+
+// scriptCommand handles /script: "list", the default, shows the loaded
+// scripts, and "reload" loads the scripts directory again
+func scriptCommand(tok []string) {
+	switch {
+	case len(tok) == 1 || (len(tok) == 2 && tok[1] == "list"):
+		scriptMu.Lock()
+		defer scriptMu.Unlock()
+		if len(scripts) == 0 {
+			say("No scripts loaded from " + scriptsDir())
+		}
+		for _, s := range scripts {
+			var hooks []string
+			for event, fns := range s.hooks {
+				hooks = append(hooks, fmt.Sprintf("%s:%d", event, len(fns)))
+			}
+			sort.Strings(hooks)
+			sayf("%-20s %s", s.name, strings.Join(hooks, " "))
+		}
+	case len(tok) == 2 && tok[1] == "reload":
+		sayf("Loaded %d scripts from %s", loadScripts(scriptsDir()), scriptsDir())
+	default:
+		say("error: checkCommands, failed /script call; check out /help for more info")
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// pollInterval is how long the receive loops wait between polls
+const pollInterval = 250 * time.Millisecond
+
+// maxRetries is how many times a rate limited request is retried
+const maxRetries = 5
+
+// maxRetryWait is the longest we wait before retrying a rate limited request;
+// if the server asks for longer we give up on it instead
+const maxRetryWait = 10 * time.Second
+
+// clientTransport wraps every request the client makes: it tells the server
+// who we are and backs off when the server answers 429 Too Many Requests
+type clientTransport struct {
+	base http.RoundTripper
+}
+
+func init() {
+	http.DefaultClient.Transport = clientTransport{base: http.DefaultTransport}
+}
+
+// clientTLSConfig builds the TLS settings for talking to the server: caFile
+// replaces the system roots, pin is the hex sha256 of the server certificate's
+// public key (which on its own also allows self-signed certificates), and
+// certFile and keyFile are our certificate for servers that ask for one
+func clientTLSConfig(caFile string, pin string, certFile string, keyFile string) (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("error: clientTLSConfig, reading %s: %s", caFile, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("error: clientTLSConfig, no certificates found in %s", caFile)
+		}
+		config.RootCAs = pool
+	}
+	if pin != "" {
+		pin = strings.ToLower(strings.Replace(pin, ":", "", -1))
+		// the pin is what we trust, unless a CA was given as well
+		config.InsecureSkipVerify = caFile == ""
+		config.VerifyConnection = func(cs tls.ConnectionState) error {
+			if len(cs.PeerCertificates) == 0 {
+				return fmt.Errorf("server sent no certificate")
+			}
+			sum := sha256.Sum256(cs.PeerCertificates[0].RawSubjectPublicKeyInfo)
+			if got := hex.EncodeToString(sum[:]); got != pin {
+				return fmt.Errorf("server certificate pin is %s, expected %s", got, pin)
+			}
+			return nil
+		}
+	}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("error: clientTLSConfig, loading %s and %s: %s", certFile, keyFile, err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// configureTLS makes every request use config
+func configureTLS(config *tls.Config) {
+	base := http.DefaultTransport.(*http.Transport).Clone()
+	base.TLSClientConfig = config
+	http.DefaultClient.Transport = clientTransport{base: base}
+}
+
+// retryAfter is how long the server asked us to wait, or an exponential
+// backoff if it did not say
+func retryAfter(response *http.Response, attempt int) time.Duration {
+	if secs, err := strconv.Atoi(response.Header.Get("Retry-After")); err == nil {
+		return time.Duration(secs) * time.Second
+	}
+	return time.Second << uint(attempt)
+}
+
+func (t clientTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	id := req.Header.Get("X-Request-ID")
+	if id == "" {
+		id = newRequestID()
+	}
+	for attempt := 0; ; attempt++ {
+		r := req.Clone(req.Context())
+		r.Header.Set("X-Request-ID", id)
+		if nickname != "" {
+			r.Header.Set("X-Irc-User", nickname)
+		}
+		if nickToken != "" {
+			r.Header.Set("X-Nick-Token", nickToken)
+		}
+		if attempt > 0 && req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			r.Body = body
+		}
+		response, err := t.base.RoundTrip(r)
+		if err != nil {
+			logger.Debug("request failed", "request_id", id, "method", req.Method, "url", req.URL.String(), "err", err)
+			return response, err
+		}
+		logger.Debug("request", "request_id", id, "method", req.Method, "url", req.URL.String(), "status", response.StatusCode)
+		if response.StatusCode >= 400 && response.StatusCode != http.StatusTooManyRequests {
+			logger.Warn("server refused request", "request_id", id, "method", req.Method, "url", req.URL.String(), "status", response.StatusCode)
+		}
+		if response.StatusCode != http.StatusTooManyRequests {
+			return response, nil
+		}
+		wait := retryAfter(response, attempt)
+		logger.Warn("rate limited", "request_id", id, "url", req.URL.String(), "retry_after", wait, "attempt", attempt)
+		if attempt >= maxRetries || wait > maxRetryWait || (req.Body != nil && req.GetBody == nil) {
+			sayf("Rate limited by server, try again in %s\n", wait)
+			return response, nil
+		}
+		response.Body.Close()
+		time.Sleep(wait)
+	}
+}
@@ -0,0 +1,585 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/gdamore/tcell/v2"
+)
+
+// maxScrollback is how many lines each window keeps
+const maxScrollback = 2000
+
+// maxInputHistory is how many sent lines Up and Down go back through
+const maxInputHistory = 200
+
+// sidebarWidth is the width of the window list and of the member list, which
+// are hidden on terminals narrower than minSidebarsWidth
+const sidebarWidth = 18
+const minSidebarsWidth = 70
+
+// memberRefresh is how often the member list of the active channel is fetched
+const memberRefresh = 3 * time.Second
+
+// tuiWindow struct is the scrollback of one channel, conversation or the status
+// window
+type tuiWindow struct {
+	target string
+	lines  []tuiLine
+	// scroll is how many lines the view is scrolled back from the newest
+	scroll int
+	unread int
+	// highlighted is set when a line mentioning us arrives while the window
+	// is not active
+	highlighted bool
+}
+
+// tuiLine struct is one line of a window, drawn standing out if it is a
+// highlight
+type tuiLine struct {
+	text      string
+	highlight bool
+}
+
+// tui struct is the full-screen UI: a window list on the left, the active
+// window's scrollback in the middle, the channel's members on the right, and
+// a status bar above the input line
+type tui struct {
+	mu      sync.Mutex
+	screen  tcell.Screen
+	windows []*tuiWindow
+	current int
+	members []string
+	input   []rune
+	cursor  int
+	history []string
+	// histPos is where Up and Down are in history; len(history) is the line
+	// being typed
+	histPos int
+	saved   []rune
+	// matches are what Tab cycles through, replacing the input from
+	// matchStart; nil when the last key was not Tab
+	matches    []string
+	match      int
+	matchStart int
+	// lines carries what the user entered to the main loop
+	lines chan string
+}
+
+func newTUI() (*tui, error) {
+	s, err := tcell.NewScreen()
+	if err != nil {
+		return nil, fmt.Errorf("error: newTUI, opening the terminal: %s", err)
+	}
+	if err = s.Init(); err != nil {
+		return nil, fmt.Errorf("error: newTUI, opening the terminal: %s", err)
+	}
+	t := &tui{
+		screen:  s,
+		windows: []*tuiWindow{{target: statusWindow}},
+		lines:   make(chan string, 16),
+	}
+	go t.pollEvents()
+	go t.refreshMembers()
+	go completion.refreshLoop()
+	t.draw()
+	return t, nil
+}
+
+// window returns the window for target, making it if needed; must hold mu
+func (t *tui) window(target string) (int, *tuiWindow) {
+	for i, w := range t.windows {
+		if w.target == target {
+			return i, w
+		}
+	}
+	w := &tuiWindow{target: target}
+	t.windows = append(t.windows, w)
+	return len(t.windows) - 1, w
+}
+
+func (t *tui) show(target string, line string) {
+	t.add(target, line, false)
+}
+
+func (t *tui) alert(target string, line string) {
+	t.add(target, line, true)
+}
+
+func (t *tui) beep() {
+	t.screen.Beep()
+}
+
+// notify does nothing: tcell has no way to put OSC 9 between its own writes
+// to the terminal, and writing it to stdout ourselves could land in the
+// middle of them
+func (t *tui) notify(text string) {
+	logger.Debug("skipped OSC 9 notification in the full-screen UI")
+}
+
+// add adds line to target's window, "" being the active one
+func (t *tui) add(target string, line string, highlight bool) {
+	t.mu.Lock()
+	w := t.windows[t.current]
+	if target != "" {
+		_, w = t.window(target)
+	}
+	for _, l := range strings.Split(line, "\n") {
+		w.lines = append(w.lines, tuiLine{text: time.Now().Format("15:04") + " " + l, highlight: highlight})
+		if w.scroll > 0 {
+			// keep the view still while the user reads back
+			w.scroll++
+		}
+	}
+	if len(w.lines) > maxScrollback {
+		w.lines = w.lines[len(w.lines)-maxScrollback:]
+	}
+	if w != t.windows[t.current] {
+		w.unread++
+		w.highlighted = w.highlighted || highlight
+	}
+	t.mu.Unlock()
+	t.draw()
+}
+
+func (t *tui) echo(target string, line string) {
+	t.show(target, line)
+}
+
+func (t *tui) open(target string) {
+	t.mu.Lock()
+	t.current, _ = t.window(target)
+	t.switched()
+	t.mu.Unlock()
+	t.draw()
+}
+
+func (t *tui) active() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if target := t.windows[t.current].target; target != statusWindow {
+		return target
+	}
+	return ""
+}
+
+func (t *tui) close() {
+	t.screen.Fini()
+}
+
+// switched resets what belongs to the previous window; must hold mu
+func (t *tui) switched() {
+	t.windows[t.current].unread = 0
+	t.windows[t.current].highlighted = false
+	t.members = nil
+	go t.fetchMembers()
+}
+
+// selectWindow switches to the window numbered n, counting from 1, or for the
+// target name
+func (t *tui) selectWindow(name string) error {
+	t.mu.Lock()
+	defer func() {
+		t.mu.Unlock()
+		t.draw()
+	}()
+	if n, err := strconv.Atoi(name); err == nil {
+		if n < 1 || n > len(t.windows) {
+			return fmt.Errorf("there is no window %d", n)
+		}
+		t.current = n - 1
+		t.switched()
+		return nil
+	}
+	for i, w := range t.windows {
+		if w.target == name || strings.TrimLeft(w.target, "#@") == name {
+			t.current = i
+			t.switched()
+			return nil
+		}
+	}
+	return fmt.Errorf("there is no window for %s", name)
+}
+
+// closeWindow closes the active window; the status window stays
+func (t *tui) closeWindow() {
+	t.mu.Lock()
+	if t.current > 0 {
+		t.windows = append(t.windows[:t.current], t.windows[t.current+1:]...)
+		t.current--
+		t.switched()
+	}
+	t.mu.Unlock()
+	t.draw()
+}
+
+// fetchMembers fills the member list from the active channel's Connected
+func (t *tui) fetchMembers() {
+	target := t.active()
+	if !strings.HasPrefix(target, "#") {
+		return
+	}
+	ch, err := fetchChannel(target[1:])
+	if err != nil {
+		logger.Debug("fetching members", "channel", target, "err", err)
+		return
+	}
+	members := make([]string, 0, len(ch.Connected))
+	for _, member := range ch.Connected {
+		members = append(members, memberPrefix(ch, member)+member)
+	}
+	sort.Slice(members, func(i, j int) bool {
+		return strings.ToLower(strings.TrimLeft(members[i], "@%+")) < strings.ToLower(strings.TrimLeft(members[j], "@%+"))
+	})
+	t.mu.Lock()
+	if t.windows[t.current].target == target {
+		t.members = members
+	}
+	t.mu.Unlock()
+	t.draw()
+}
+
+func (t *tui) refreshMembers() {
+	for range time.Tick(memberRefresh) {
+		t.fetchMembers()
+	}
+}
+
+// memberPrefix is the highest status the member holds in the channel
+func memberPrefix(ch Channel, member string) string {
+	for _, status := range []struct {
+		list   []string
+		prefix string
+	}{{ch.Operators, "@"}, {ch.HalfOps, "%"}, {ch.Voiced, "+"}} {
+		for _, name := range status.list {
+			if name == member {
+				return status.prefix
+			}
+		}
+	}
+	return ""
+}
+
+func (t *tui) pollEvents() {
+	for {
+		switch ev := t.screen.PollEvent().(type) {
+		case *tcell.EventResize:
+			t.screen.Sync()
+			t.draw()
+		case *tcell.EventKey:
+			t.key(ev)
+		case nil:
+			// the screen was finalized
+			return
+		}
+	}
+}
+
+// key handles a key press in the input line
+func (t *tui) key(ev *tcell.EventKey) {
+	t.mu.Lock()
+	var entered string
+	completing := false
+	switch ev.Key() {
+	case tcell.KeyCtrlC:
+		t.mu.Unlock()
+		exit(0)
+	case tcell.KeyEnter:
+		entered = string(t.input)
+		if entered != "" {
+			t.history = append(t.history, entered)
+			if len(t.history) > maxInputHistory {
+				t.history = t.history[1:]
+			}
+		}
+		t.input, t.cursor, t.histPos = nil, 0, len(t.history)
+	case tcell.KeyBackspace, tcell.KeyBackspace2:
+		if t.cursor > 0 {
+			t.input = append(t.input[:t.cursor-1], t.input[t.cursor:]...)
+			t.cursor--
+		}
+	case tcell.KeyDelete, tcell.KeyCtrlD:
+		if t.cursor < len(t.input) {
+			t.input = append(t.input[:t.cursor], t.input[t.cursor+1:]...)
+		}
+	case tcell.KeyLeft, tcell.KeyCtrlB:
+		if t.cursor > 0 {
+			t.cursor--
+		}
+	case tcell.KeyRight, tcell.KeyCtrlF:
+		if t.cursor < len(t.input) {
+			t.cursor++
+		}
+	case tcell.KeyHome, tcell.KeyCtrlA:
+		t.cursor = 0
+	case tcell.KeyEnd, tcell.KeyCtrlE:
+		t.cursor = len(t.input)
+	case tcell.KeyCtrlU:
+		t.input = append([]rune(nil), t.input[t.cursor:]...)
+		t.cursor = 0
+	case tcell.KeyCtrlK:
+		t.input = t.input[:t.cursor]
+	case tcell.KeyCtrlW:
+		start := t.cursor
+		for start > 0 && unicode.IsSpace(t.input[start-1]) {
+			start--
+		}
+		for start > 0 && !unicode.IsSpace(t.input[start-1]) {
+			start--
+		}
+		t.input = append(t.input[:start], t.input[t.cursor:]...)
+		t.cursor = start
+	case tcell.KeyUp:
+		t.recall(-1)
+	case tcell.KeyDown:
+		t.recall(1)
+	case tcell.KeyPgUp:
+		t.scroll(t.pageSize() / 2)
+	case tcell.KeyPgDn:
+		t.scroll(-t.pageSize() / 2)
+	case tcell.KeyCtrlN:
+		t.current = (t.current + 1) % len(t.windows)
+		t.switched()
+	case tcell.KeyCtrlP:
+		t.current = (t.current + len(t.windows) - 1) % len(t.windows)
+		t.switched()
+	case tcell.KeyCtrlL:
+		t.screen.Sync()
+	case tcell.KeyTab, tcell.KeyBacktab:
+		t.completeWord(ev.Key() == tcell.KeyBacktab)
+		completing = true
+	case tcell.KeyRune:
+		r := ev.Rune()
+		if ev.Modifiers()&tcell.ModAlt != 0 && r >= '1' && r <= '9' {
+			// Alt+number selects a window
+			if n := int(r - '1'); n < len(t.windows) {
+				t.current = n
+				t.switched()
+			}
+			break
+		}
+		t.input = append(t.input[:t.cursor], append([]rune{r}, t.input[t.cursor:]...)...)
+		t.cursor++
+	}
+	if !completing {
+		t.matches = nil
+	}
+	t.mu.Unlock()
+	t.draw()
+	if entered != "" {
+		t.lines <- entered
+	}
+}
+
+// completeWord completes the word before the cursor, or on another press
+// replaces the completion with the next match, or the previous one if back;
+// must hold mu
+func (t *tui) completeWord(back bool) {
+	if t.matches == nil {
+		start, matches := completion.complete(t.input, t.cursor)
+		if len(matches) == 0 {
+			return
+		}
+		t.matches, t.matchStart, t.match = matches, start, 0
+		if back {
+			t.match = len(matches) - 1
+		}
+	} else if back {
+		t.match = (t.match + len(t.matches) - 1) % len(t.matches)
+	} else {
+		t.match = (t.match + 1) % len(t.matches)
+	}
+	word := []rune(t.matches[t.match])
+	rest := append([]rune(nil), t.input[t.cursor:]...)
+	t.input = append(append(t.input[:t.matchStart], word...), rest...)
+	t.cursor = t.matchStart + len(word)
+}
+
+// recall moves through the input history by step; must hold mu
+func (t *tui) recall(step int) {
+	pos := t.histPos + step
+	if pos < 0 || pos > len(t.history) {
+		return
+	}
+	if t.histPos == len(t.history) {
+		// keep what was being typed for when we come back down
+		t.saved = append([]rune(nil), t.input...)
+	}
+	t.histPos = pos
+	if pos == len(t.history) {
+		t.input = t.saved
+	} else {
+		t.input = []rune(t.history[pos])
+	}
+	t.cursor = len(t.input)
+}
+
+// scroll moves the active window's view back by n lines, or forward if n is
+// negative; must hold mu
+func (t *tui) scroll(n int) {
+	w := t.windows[t.current]
+	w.scroll += n
+	if w.scroll > len(w.lines)-1 {
+		w.scroll = len(w.lines) - 1
+	}
+	if w.scroll < 0 {
+		w.scroll = 0
+	}
+}
+
+// pageSize is the height of the scrollback pane
+func (t *tui) pageSize() int {
+	_, h := t.screen.Size()
+	return h - 2
+}
+
+// wrap breaks line into pieces no wider than width, continuing lines with an
+// indent
+func wrap(line string, width int) []string {
+	if width < 10 {
+		return []string{line}
+	}
+	var pieces []string
+	runes := []rune(line)
+	for len(runes) > width {
+		cut := width
+		for i := width; i > width/2; i-- {
+			if runes[i] == ' ' {
+				cut = i
+				break
+			}
+		}
+		pieces = append(pieces, string(runes[:cut]))
+		runes = append([]rune("      "), []rune(strings.TrimLeft(string(runes[cut:]), " "))...)
+	}
+	return append(pieces, string(runes))
+}
+
+func (t *tui) draw() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s := t.screen
+	s.Clear()
+	width, height := s.Size()
+	if height < 3 {
+		s.Show()
+		return
+	}
+	w := t.windows[t.current]
+	left, right := 0, width
+	plain := tcell.StyleDefault
+	dim := plain.Foreground(tcell.ColorGray)
+	if width >= minSidebarsWidth {
+		left = sidebarWidth
+		for i, win := range t.windows {
+			style := plain
+			label := fmt.Sprintf("%d %s", i+1, win.target)
+			if i == t.current {
+				style = style.Reverse(true)
+			} else if win.highlighted {
+				style = style.Bold(true).Foreground(tcell.ColorYellow)
+				label += fmt.Sprintf(" (%d!)", win.unread)
+			} else if win.unread > 0 {
+				style = style.Bold(true)
+				label += fmt.Sprintf(" (%d)", win.unread)
+			}
+			if i < height-2 {
+				s.PutStrStyled(0, i, truncate(label, sidebarWidth-1), style)
+			}
+		}
+		if strings.HasPrefix(w.target, "#") {
+			right = width - sidebarWidth
+			for i, member := range t.members {
+				if i < height-2 {
+					s.PutStrStyled(right+1, i, truncate(member, sidebarWidth-1), plain)
+				}
+			}
+			for y := 0; y < height-2; y++ {
+				s.SetContent(right, y, tcell.RuneVLine, nil, dim)
+			}
+		}
+		for y := 0; y < height-2; y++ {
+			s.SetContent(left-1, y, tcell.RuneVLine, nil, dim)
+		}
+	}
+	// the newest lines that fit, above the lines scrolled past
+	var rows []tuiLine
+	end := len(w.lines) - w.scroll
+	for i := end - 1; i >= 0 && len(rows) < height-2; i-- {
+		pieces := wrap(w.lines[i].text, right-left)
+		for j := len(pieces) - 1; j >= 0 && len(rows) < height-2; j-- {
+			rows = append(rows, tuiLine{text: pieces[j], highlight: w.lines[i].highlight})
+		}
+	}
+	highlight := plain.Bold(true).Foreground(tcell.ColorYellow)
+	for i, row := range rows {
+		style := plain
+		if row.highlight {
+			style = highlight
+		}
+		s.PutStrStyled(left, height-3-i, row.text, style)
+	}
+	bar := fmt.Sprintf(" [%s] [%s]", nickname, w.target)
+	if channel != "" {
+		bar += " [in #" + channel + "]"
+	}
+	if operToken != "" {
+		bar += " [oper]"
+	}
+	if !serverLink.isUp() {
+		bar += " [reconnecting]"
+	}
+	if n := suppressedCount(w.target); n > 0 {
+		bar += fmt.Sprintf(" [ignored %d]", n)
+	}
+	if w.scroll > 0 {
+		bar += fmt.Sprintf(" [scrolled back %d]", w.scroll)
+	}
+	bar += " [" + strings.TrimSuffix(domain, "/") + "]"
+	s.PutStrStyled(0, height-2, bar+strings.Repeat(" ", width), plain.Reverse(true))
+	// scroll the input sideways so the cursor stays in view
+	prompt := "[" + w.target + "] "
+	room := width - len([]rune(prompt)) - 1
+	start := 0
+	if t.cursor > room {
+		start = t.cursor - room
+	}
+	end = len(t.input)
+	if end > start+room+1 {
+		end = start + room + 1
+	}
+	s.PutStrStyled(0, height-1, prompt+string(t.input[start:end]), plain)
+	s.ShowCursor(len([]rune(prompt))+t.cursor-start, height-1)
+	s.Show()
+}
+
+func truncate(s string, width int) string {
+	if r := []rune(s); len(r) > width {
+		return string(r[:width])
+	}
+	return s
+}
+
+// tuiCommand runs the window commands, which only the full-screen UI has
+func tuiCommand(tok []string) {
+	t, ok := display.(*tui)
+	if !ok {
+		say("error: checkCommands, " + tok[0] + " needs the full-screen UI")
+		return
+	}
+	switch tok[0] {
+	case "/win":
+		if len(tok) != 2 {
+			say("error: checkCommands, failed /win call; check out /help for more info")
+		} else if err := t.selectWindow(tok[1]); err != nil {
+			say(err)
+		}
+	case "/close":
+		t.closeWindow()
+	}
+}
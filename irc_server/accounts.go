@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Account struct is a registered identity that users log in to with a
+// password, or with a TLS client certificate issued for the account name
+type Account struct {
+	Name         string   `json:"name"`
+	PasswordHash string   `json:"passwordhash"`
+	Created      int64    `json:"created"`
+	Nicks        []string `json:"nicks,omitempty"`
+}
+
+// Accounts map of Account, where key is Account.Name
+var Accounts = make(map[string]Account)
+
+// saslChunkSize is the length of a full AUTHENTICATE chunk; a shorter one, or
+// "+", ends the message
+const saslChunkSize = 400
+
+func createAccount(actor string, name string, password string) error {
+	if !validName(name) {
+		return fmt.Errorf("invalid account name %q", name)
+	}
+	if _, ok := Accounts[name]; ok {
+		return fmt.Errorf("account %q already exists", name)
+	}
+	if password == "" {
+		return fmt.Errorf("account %q needs a password", name)
+	}
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	Accounts[name] = Account{Name: name, PasswordHash: hash, Created: time.Now().Unix()}
+	audit(actor, "create account", name, "")
+	return nil
+}
+
+func dropAccount(actor string, name string) error {
+	if _, ok := Accounts[name]; !ok {
+		return fmt.Errorf("no such account %q", name)
+	}
+	delete(Accounts, name)
+	deletedAccounts[name] = true
+	for _, c := range IRCClients {
+		if c.account == name {
+			c.account = ""
+			c.notifyAccount()
+		}
+	}
+	for k, account := range Identified {
+		if account == name {
+			delete(Identified, k)
+		}
+	}
+	dropChannelAccess(name)
+	audit(actor, "drop account", name, "")
+	return nil
+}
+
+func checkAccountPassword(name string, password string) bool {
+	account, ok := Accounts[name]
+	return ok && bcrypt.CompareHashAndPassword([]byte(account.PasswordHash), []byte(password)) == nil
+}
+
+// saslMechanisms are the mechanisms AUTHENTICATE accepts; EXTERNAL needs the
+// listener to ask for client certificates
+func saslMechanisms() []string {
+	if tlsConfig != nil && tlsConfig.ClientAuth != tls.NoClientCert {
+		return []string{"PLAIN", "EXTERNAL"}
+	}
+	return []string{"PLAIN"}
+}
+
+// AUTHENTICATE <mechanism>, then AUTHENTICATE <base64 chunk>... or * to abort
+func (c *ircClient) authenticate(arg string) {
+	if !c.caps["sasl"] {
+		c.numeric("904", "SASL authentication failed")
+		return
+	}
+	if c.account != "" {
+		c.numeric("907", "You have already authenticated using SASL")
+		return
+	}
+	if arg == "*" {
+		c.saslMech, c.saslData = "", ""
+		c.numeric("906", "SASL authentication aborted")
+		return
+	}
+	if c.saslMech == "" {
+		mech := strings.ToUpper(arg)
+		for _, m := range saslMechanisms() {
+			if m == mech {
+				c.saslMech = mech
+				c.write("AUTHENTICATE +")
+				return
+			}
+		}
+		c.numeric("908", strings.Join(saslMechanisms(), ","), "are available SASL mechanisms")
+		c.numeric("904", "SASL authentication failed")
+		return
+	}
+	if len(arg) > saslChunkSize || len(c.saslData)+len(arg) > 4*saslChunkSize {
+		c.saslMech, c.saslData = "", ""
+		c.numeric("905", "SASL message too long")
+		return
+	}
+	if arg != "+" {
+		c.saslData += arg
+	}
+	if len(arg) == saslChunkSize {
+		// wait for the rest of the message
+		return
+	}
+	mech, data := c.saslMech, c.saslData
+	c.saslMech, c.saslData = "", ""
+	payload, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		c.numeric("904", "SASL authentication failed")
+		return
+	}
+	account, err := c.saslAccount(mech, payload)
+	if err != nil {
+		audit(c.name(), "sasl failed", mech, err.Error())
+		c.numeric("904", "SASL authentication failed")
+		return
+	}
+	c.account = account
+	audit(c.name(), "sasl login", account, mech)
+	c.numeric("900", ircMask(c.name()), account, "You are now logged in as "+account)
+	c.numeric("903", "SASL authentication successful")
+	if c.registered {
+		c.notifyAccount()
+	}
+}
+
+// saslAccount checks the credentials in payload and returns the account they
+// are for
+func (c *ircClient) saslAccount(mech string, payload []byte) (string, error) {
+	switch mech {
+	case "PLAIN":
+		// authzid NUL authcid NUL password
+		parts := bytes.Split(payload, []byte{0})
+		if len(parts) != 3 {
+			return "", fmt.Errorf("malformed PLAIN message")
+		}
+		authzid, authcid := string(parts[0]), string(parts[1])
+		if authzid != "" && authzid != authcid {
+			return "", fmt.Errorf("%s may not log in as %s", authcid, authzid)
+		}
+		if !checkAccountPassword(authcid, string(parts[2])) {
+			return "", fmt.Errorf("wrong password for %s", authcid)
+		}
+		return authcid, nil
+	case "EXTERNAL":
+		// the certificate was verified against -tls-client-ca during the
+		// handshake, and is issued for the account name
+		conn, ok := c.conn.(*tls.Conn)
+		if !ok {
+			return "", fmt.Errorf("not a TLS connection")
+		}
+		state := conn.ConnectionState()
+		if len(state.VerifiedChains) == 0 {
+			return "", fmt.Errorf("no verified client certificate")
+		}
+		name := state.VerifiedChains[0][0].Subject.CommonName
+		if len(payload) > 0 && string(payload) != name {
+			return "", fmt.Errorf("certificate for %s may not log in as %s", name, payload)
+		}
+		if _, ok := Accounts[name]; !ok {
+			return "", fmt.Errorf("no such account %q", name)
+		}
+		return name, nil
+	}
+	return "", fmt.Errorf("unknown mechanism %s", mech)
+}
+
+// mustIdentify reports whether the client is on a nickname registered to an
+// account it has not logged in to, and so may not join channels
+func (c *ircClient) mustIdentify() bool {
+	owner := nickOwner(c.nick)
+	return owner != "" && c.account != owner
+}
+
+func (c *ircClient) whois(nick string) {
+	user, ok := Users[nick]
+	if !ok {
+		c.numeric("401", nick, "No such nick/channel")
+		c.numeric("318", nick, "End of /WHOIS list")
+		return
+	}
+	c.numeric("311", nick, nick, serverDisplayName, "*", nick)
+	if user.Connection != "" {
+		prefix := statusPrefixes(user.Connection, nick)
+		if prefix != "" && !c.caps["multi-prefix"] {
+			prefix = prefix[:1]
+		}
+		c.numeric("319", nick, prefix+"#"+user.Connection)
+	}
+	c.numeric("312", nick, serverDisplayName, serverDisplayName+" "+version)
+	peer, online := IRCClients[nick]
+	if online && peer.away != "" {
+		c.numeric("301", nick, peer.away)
+	}
+	// HTTP users identify through NickServ rather than a connection
+	if account := identifiedAs(nick); account != "" {
+		c.numeric("330", nick, account, "is logged in as")
+	}
+	if online {
+		if _, secure := peer.conn.(*tls.Conn); secure {
+			c.numeric("671", nick, "is using a secure connection")
+		}
+	}
+	c.numeric("318", nick, "End of /WHOIS list")
+}
+
+func accountNames() []string {
+	names := make([]string, 0, len(Accounts))
+	for k := range Accounts {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func adminCreateAccountHandler(w http.ResponseWriter, r *http.Request) {
+	req := readAdminRequest(r)
+	writeAdminResult(w, map[string]string{"account": req.Name}, createAccount(apiActor, req.Name, req.Password))
+}
+
+func adminDropAccountHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	writeAdminResult(w, map[string]string{"account": name}, dropAccount(apiActor, name))
+}
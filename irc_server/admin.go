@@ -0,0 +1,572 @@
+package main
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// serverName is the sender of chats that come from the server itself
+const serverName = "*server*"
+
+// onlineTimeout is how long after their last poll a user still counts as online
+const onlineTimeout = 10 * time.Second
+
+// dbLock serializes every access to Users, ChatChannels and PrivateMessages;
+// the router takes it around each request, so functions called from handlers
+// must not take it again
+var dbLock sync.Mutex
+
+// LastSeen map of user identifier to the unix time they last polled for
+// private messages, which is how we tell who is online
+var LastSeen = make(map[string]int64)
+
+// Killed map of user identifier to the reason they were killed; their next
+// poll is refused with that reason, which ends the client's session
+var Killed = make(map[string]string)
+
+// logLevel is the minimum level logged, changeable at runtime
+var logLevel slog.LevelVar
+
+// actors recorded in the audit log for the console and the /admin endpoints
+const (
+	consoleActor = "console"
+	apiActor     = "admin-api"
+)
+
+// adminToken must be sent as a bearer token to use the /admin endpoints; they
+// are disabled while it is empty
+var adminToken string
+
+func lockDB(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		dbLock.Lock()
+		defer dbLock.Unlock()
+		next.ServeHTTP(w, r)
+	})
+}
+
+func onlineUsers() []string {
+	online := make(map[string]bool)
+	now := time.Now().Unix()
+	for k, seen := range LastSeen {
+		if now-seen <= int64(onlineTimeout/time.Second) {
+			online[k] = true
+		}
+	}
+	// IRC users are online for as long as they stay connected
+	for k := range IRCClients {
+		online[k] = true
+	}
+	var names []string
+	for k := range online {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// removeFromChannel takes the user out of the Connected list of the channel
+// they are in, if any, and clears their connection
+func removeFromChannel(key string) {
+	user, ok := Users[key]
+	if !ok || user.Connection == "" {
+		return
+	}
+	if cc, ok := ChatChannels[user.Connection]; ok {
+		ircParted(key, user.Connection)
+		oldChannel := cc.Chan
+		for i, val := range oldChannel.Connected {
+			if val == user.toString() {
+				// https://github.com/golang/go/wiki/SliceTricks#delete-without-preserving-order
+				// deleting user from array without preserving order
+				userCount := len(oldChannel.Connected)
+				oldChannel.Connected[i] = oldChannel.Connected[userCount-1]
+				oldChannel.Connected = oldChannel.Connected[:userCount-1]
+				break
+			}
+		}
+		cc.Chan = oldChannel
+	}
+	user.Connection = ""
+	Users[key] = user
+}
+
+// deliverNotice drops a notice from the server into the user's private
+// messages, so it reaches them the same way chats do
+func deliverNotice(to string, text string) {
+	storeChat(Chat{
+		Timestamp: time.Now().Unix(),
+		Sender:    serverName,
+		Receiver:  "@" + to,
+		Text:      text,
+		Kind:      chatKindNotice,
+	})
+}
+
+func adminKick(actor string, key string, reason string) error {
+	user, ok := Users[key]
+	if !ok {
+		return fmt.Errorf("no such user %q", key)
+	}
+	if user.Connection == "" {
+		return fmt.Errorf("%s is not in a channel", key)
+	}
+	removeFromChannel(key)
+	deliverNotice(key, "You were kicked from "+user.Connection+": "+reason)
+	audit(actor, "kick", key, user.Connection+": "+reason)
+	return nil
+}
+
+func adminKill(actor string, key string, reason string) error {
+	if _, ok := Users[key]; !ok {
+		return fmt.Errorf("no such user %q", key)
+	}
+	removeFromChannel(key)
+	delete(LastSeen, key)
+	Killed[key] = reason
+	if disconnectIRC(key, "Killed: "+reason) {
+		// the kill has been delivered, just like a refused poll
+		delete(Killed, key)
+	}
+	for token, session := range OperSessions {
+		if session.User == key {
+			delete(OperSessions, token)
+		}
+	}
+	audit(actor, "kill", key, reason)
+	return nil
+}
+
+func adminDeleteChannel(actor string, key string) error {
+	cc, ok := ChatChannels[key]
+	if !ok {
+		return fmt.Errorf("no such channel %q", key)
+	}
+	for _, member := range append([]string(nil), cc.Chan.Connected...) {
+		removeFromChannel(member)
+		deliverNotice(member, "Channel "+key+" was deleted")
+	}
+	delete(ChatChannels, key)
+	deletedChannels[key] = true
+	// users whose membership was lost from Connected would point nowhere
+	for k, user := range Users {
+		if user.Connection == key {
+			user.Connection = ""
+			Users[k] = user
+		}
+	}
+	audit(actor, "delete channel", key, "")
+	return nil
+}
+
+func adminRenameChannel(actor string, key string, name string) error {
+	cc, ok := ChatChannels[key]
+	if !ok {
+		return fmt.Errorf("no such channel %q", key)
+	}
+	if _, ok := ChatChannels[name]; ok {
+		return fmt.Errorf("channel %q already exists", name)
+	}
+	if !validName(name) {
+		return fmt.Errorf("invalid channel name %q", name)
+	}
+	// IRC clients see their members leave the old channel and join the new
+	// one
+	for _, member := range cc.Chan.Connected {
+		ircParted(member, key)
+	}
+	cc.Chan.ChannelName = name
+	cc.Chan.ID = 0
+	delete(ChatChannels, key)
+	deletedChannels[key] = true
+	ChatChannels[name] = cc
+	for i := range cc.Chats {
+		cc.Chats[i].Receiver = "#" + name
+	}
+	for k, user := range Users {
+		if user.Connection == key {
+			user.Connection = name
+			Users[k] = user
+		}
+	}
+	for _, member := range cc.Chan.Connected {
+		ircJoined(member, name)
+		deliverNotice(member, "Channel "+key+" was renamed to "+name)
+	}
+	audit(actor, "rename channel", key, name)
+	return nil
+}
+
+// adminArchiveChannel makes the channel read-only, or writable again; its
+// members stay, and its history can still be read and searched
+func adminArchiveChannel(actor string, key string, archived bool) error {
+	cc, ok := ChatChannels[key]
+	if !ok {
+		return fmt.Errorf("no such channel %q", key)
+	}
+	if cc.Chan.Archived == archived {
+		return fmt.Errorf("channel %q is already %s", key, archiveState(archived))
+	}
+	cc.Chan.Archived = archived
+	for _, member := range cc.Chan.Connected {
+		deliverNotice(member, "Channel "+key+" is now "+archiveState(archived))
+	}
+	if archived {
+		audit(actor, "archive channel", key, "")
+	} else {
+		audit(actor, "unarchive channel", key, "")
+	}
+	return nil
+}
+
+func archiveState(archived bool) string {
+	if archived {
+		return "archived"
+	}
+	return "open"
+}
+
+// adminWallops sends text to everyone online and returns how many got it
+func adminWallops(actor string, text string) int {
+	n := broadcastNotice("WALLOPS: " + text)
+	audit(actor, "wallops", fmt.Sprintf("%d users", n), text)
+	return n
+}
+
+func adminSnapshot(actor string, merge bool) error {
+	_, err := exportData(merge)
+	if err == nil {
+		audit(actor, "snapshot", snapshotFile, fmt.Sprintf("merge=%t", merge))
+	}
+	return err
+}
+
+func setLogLevel(name string) error {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(name)); err != nil {
+		return fmt.Errorf("unknown log level %q, use debug, info, warn or error", name)
+	}
+	logLevel.Set(level)
+	return nil
+}
+
+// adminStatus describes a single user for the users listing
+type adminStatus struct {
+	User     string `json:"user"`
+	Channel  string `json:"channel"`
+	LastSeen int64  `json:"lastseen"`
+}
+
+func adminUsers() []adminStatus {
+	statuses := []adminStatus{}
+	for _, k := range onlineUsers() {
+		statuses = append(statuses, adminStatus{
+			User:     k,
+			Channel:  Users[k].Connection,
+			LastSeen: LastSeen[k],
+		})
+	}
+	return statuses
+}
+
+const adminHelp = `users                       lists online users and their channels
+channels                    lists all channels and their member counts
+kick [User] [Reason...]     removes a user from their channel
+kill [User] [Reason...]     ends a user's session
+delchan [Channel]           deletes a channel, evicting its members
+renamechan [Channel] [Name] renames a channel, keeping its history and members
+archive [Channel] [off]     makes a channel read-only, or writable again with off
+wallops [Text...]           sends a WALLOPS to every online user
+notice [Text...]            sends a server notice, such as planned maintenance, to every online user
+motd [reload]               shows the message of the day, or reloads it from its file
+snapshot [merge]            exports a snapshot now, merging if asked
+loglevel [Level]            sets the log level to debug, info, warn or error
+audit [Count] [Actor]       shows the newest audit log entries, optionally only by one actor
+accounts                    lists the registered accounts
+account add [Name] [Pass]   registers an account that IRC users can log in to with SASL
+account del [Name]          drops an account
+mkpasswd [Password]         prints a password hash for the operators file
+q                           stops the server`
+
+// runAdminCommand runs a single console command and returns its output; quit
+// is true once the operator asks to stop the server
+func runAdminCommand(line string) (out string, quit bool) {
+	tok := strings.Fields(line)
+	if len(tok) == 0 {
+		return "", false
+	}
+	arg := func(i int) string {
+		if i < len(tok) {
+			return tok[i]
+		}
+		return ""
+	}
+	rest := func(i int) string {
+		if i < len(tok) {
+			return strings.Join(tok[i:], " ")
+		}
+		return ""
+	}
+	var err error
+	switch tok[0] {
+	case "help":
+		return adminHelp, false
+	case "q", "quit":
+		return "", true
+	case "loglevel":
+		if err = setLogLevel(arg(1)); err == nil {
+			out = "log level is now " + logLevel.Level().String()
+		}
+		return result(out, err), false
+	case "mkpasswd":
+		// for filling in the operators file
+		out, err = hashPassword(rest(1))
+		return result(out, err), false
+	}
+	// everything else touches the db
+	dbLock.Lock()
+	defer dbLock.Unlock()
+	switch tok[0] {
+	case "users":
+		for _, s := range adminUsers() {
+			out += fmt.Sprintf("%-20s %-20s seen %s\n", s.User, s.Channel, time.Unix(s.LastSeen, 0).Format(time.Kitchen))
+		}
+		out += fmt.Sprintf("%d online, %d registered", len(onlineUsers()), len(Users))
+	case "channels":
+		keys := make([]string, 0, len(ChatChannels))
+		for k := range ChatChannels {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			out += fmt.Sprintf("%-20s %d connected, %d chats", k, len(ChatChannels[k].Chan.Connected), len(ChatChannels[k].Chats))
+			if founder := ChatChannels[k].Chan.Founder; founder != "" {
+				out += ", founder " + founder
+			}
+			if ChatChannels[k].Chan.Archived {
+				out += ", archived"
+			}
+			out += "\n"
+		}
+		out += fmt.Sprintf("%d channels", len(keys))
+	case "kick":
+		if err = adminKick(consoleActor, arg(1), rest(2)); err == nil {
+			out = "kicked " + arg(1)
+		}
+	case "kill":
+		if err = adminKill(consoleActor, arg(1), rest(2)); err == nil {
+			out = "killed " + arg(1)
+		}
+	case "delchan":
+		if err = adminDeleteChannel(consoleActor, arg(1)); err == nil {
+			out = "deleted " + arg(1)
+		}
+	case "renamechan":
+		if err = adminRenameChannel(consoleActor, arg(1), arg(2)); err == nil {
+			out = "renamed " + arg(1) + " to " + arg(2)
+		}
+	case "archive":
+		archived := arg(2) != "off"
+		if err = adminArchiveChannel(consoleActor, arg(1), archived); err == nil {
+			out = arg(1) + " is now " + archiveState(archived)
+		}
+	case "wallops":
+		out = fmt.Sprintf("sent to %d users", adminWallops(consoleActor, rest(1)))
+	case "audit":
+		q := auditQuery{Actor: arg(2), Limit: 20}
+		if n, err := strconv.Atoi(arg(1)); err == nil {
+			q.Limit = n
+		}
+		var entries []AuditEntry
+		if entries, err = queryAudit(q); err == nil {
+			for _, e := range entries {
+				out += fmt.Sprintf("%s %s: %s %s %s\n", time.Unix(e.Timestamp, 0).Format(time.Stamp), e.Actor, e.Action, e.Target, e.Detail)
+			}
+			out += fmt.Sprintf("%d entries", len(entries))
+		}
+	case "notice":
+		out = fmt.Sprintf("sent to %d users", adminNotice(consoleActor, rest(1)))
+	case "accounts":
+		names := accountNames()
+		out = strings.Join(append(names, fmt.Sprintf("%d accounts", len(names))), "\n")
+	case "account":
+		switch arg(1) {
+		case "add":
+			if err = createAccount(consoleActor, arg(2), rest(3)); err == nil {
+				out = "registered " + arg(2)
+			}
+		case "del":
+			if err = dropAccount(consoleActor, arg(2)); err == nil {
+				out = "dropped " + arg(2)
+			}
+		default:
+			out = "use account add [Name] [Password] or account del [Name]"
+		}
+	case "motd":
+		if arg(1) == "reload" {
+			err = loadMOTD(motdFile)
+		}
+		out = motd
+	case "snapshot":
+		if err = adminSnapshot(consoleActor, arg(1) == "merge"); err == nil {
+			out = "wrote " + snapshotFile
+		}
+	default:
+		out = "unknown command " + tok[0] + ", enter help for a list"
+	}
+	return result(out, err), false
+}
+
+func result(out string, err error) string {
+	if err != nil {
+		return "error: " + err.Error()
+	}
+	return out
+}
+
+// adminShell reads console commands from in until q or end of input
+func adminShell(in *bufio.Scanner, out io.Writer) {
+	fmt.Fprintln(out, "Starting server, enter help for commands or q to quit")
+	for {
+		fmt.Fprint(out, "admin> ")
+		if !in.Scan() {
+			return
+		}
+		res, quit := runAdminCommand(in.Text())
+		if quit {
+			return
+		}
+		if res != "" {
+			fmt.Fprintln(out, res)
+		}
+	}
+}
+
+func requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if adminToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+			http.Error(w, "admin token required", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// adminRequest is the body accepted by the /admin endpoints
+type adminRequest struct {
+	User     string `json:"user"`
+	Reason   string `json:"reason"`
+	Name     string `json:"name"`
+	Text     string `json:"text"`
+	Merge    bool   `json:"merge"`
+	Level    string `json:"level"`
+	Password string `json:"password"`
+	Archived bool   `json:"archived"`
+}
+
+func readAdminRequest(r *http.Request) adminRequest {
+	var req adminRequest
+	reqBody, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		reqLogger(r).Error("reading request body", "func", "readAdminRequest", "err", err)
+	}
+	json.Unmarshal(reqBody, &req)
+	return req
+}
+
+func writeAdminResult(w http.ResponseWriter, res interface{}, err error) {
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	json.NewEncoder(w).Encode(res)
+}
+
+func adminUsersHandler(w http.ResponseWriter, r *http.Request) {
+	writeAdminResult(w, adminUsers(), nil)
+}
+
+func adminKickHandler(w http.ResponseWriter, r *http.Request) {
+	req := readAdminRequest(r)
+	writeAdminResult(w, req, adminKick(apiActor, req.User, req.Reason))
+}
+
+func adminKillHandler(w http.ResponseWriter, r *http.Request) {
+	req := readAdminRequest(r)
+	writeAdminResult(w, req, adminKill(apiActor, req.User, req.Reason))
+}
+
+func adminDeleteChannelHandler(w http.ResponseWriter, r *http.Request) {
+	key := mux.Vars(r)["identifier"]
+	writeAdminResult(w, key, adminDeleteChannel(apiActor, key))
+}
+
+func adminRenameChannelHandler(w http.ResponseWriter, r *http.Request) {
+	req := readAdminRequest(r)
+	err := adminRenameChannel(apiActor, mux.Vars(r)["identifier"], req.Name)
+	if err != nil {
+		writeAdminResult(w, nil, err)
+		return
+	}
+	writeAdminResult(w, ChatChannels[req.Name].Chan, nil)
+}
+
+func adminArchiveChannelHandler(w http.ResponseWriter, r *http.Request) {
+	req := readAdminRequest(r)
+	key := mux.Vars(r)["identifier"]
+	err := adminArchiveChannel(apiActor, key, req.Archived)
+	if err != nil {
+		writeAdminResult(w, nil, err)
+		return
+	}
+	writeAdminResult(w, ChatChannels[key].Chan, nil)
+}
+
+func adminWallopsHandler(w http.ResponseWriter, r *http.Request) {
+	req := readAdminRequest(r)
+	writeAdminResult(w, map[string]int{"recipients": adminWallops(apiActor, req.Text)}, nil)
+}
+
+func adminSnapshotHandler(w http.ResponseWriter, r *http.Request) {
+	req := readAdminRequest(r)
+	writeAdminResult(w, map[string]string{"file": snapshotFile}, adminSnapshot(apiActor, req.Merge))
+}
+
+func adminLogLevelHandler(w http.ResponseWriter, r *http.Request) {
+	req := readAdminRequest(r)
+	err := setLogLevel(req.Level)
+	writeAdminResult(w, map[string]string{"level": logLevel.Level().String()}, err)
+}
+
+// adds the /admin endpoints, all of which need the admin token
+func handleAdminRequests(router *mux.Router) {
+	router.HandleFunc("/admin/users", requireAdmin(adminUsersHandler)).Methods("GET")
+	router.HandleFunc("/admin/kick", requireAdmin(adminKickHandler)).Methods("POST")
+	router.HandleFunc("/admin/kill", requireAdmin(adminKillHandler)).Methods("POST")
+	// identifier is the channel.toString()
+	router.HandleFunc("/admin/channel/{identifier}", requireAdmin(adminDeleteChannelHandler)).Methods("DELETE")
+	router.HandleFunc("/admin/channel/{identifier}/rename", requireAdmin(adminRenameChannelHandler)).Methods("POST")
+	router.HandleFunc("/admin/channel/{identifier}/archive", requireAdmin(adminArchiveChannelHandler)).Methods("POST")
+	router.HandleFunc("/admin/wallops", requireAdmin(adminWallopsHandler)).Methods("POST")
+	router.HandleFunc("/admin/notice", requireAdmin(adminNoticeHandler)).Methods("POST")
+	router.HandleFunc("/admin/account", requireAdmin(adminCreateAccountHandler)).Methods("POST")
+	router.HandleFunc("/admin/account/{name}", requireAdmin(adminDropAccountHandler)).Methods("DELETE")
+	router.HandleFunc("/admin/motd", requireAdmin(adminMOTDHandler)).Methods("POST")
+	router.HandleFunc("/admin/snapshot", requireAdmin(adminSnapshotHandler)).Methods("POST")
+	router.HandleFunc("/admin/loglevel", requireAdmin(adminLogLevelHandler)).Methods("POST")
+	router.HandleFunc("/admin/audit", requireAdmin(adminAuditHandler)).Methods("GET")
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// maxAuditEntries is how many audit entries are kept in memory
+const maxAuditEntries = 1000
+
+// AuditEntry struct records a single moderation or administrative action
+type AuditEntry struct {
+	Timestamp int64  `json:"timestamp"`
+	Actor     string `json:"actor"`
+	Action    string `json:"action"`
+	Target    string `json:"target"`
+	Detail    string `json:"detail,omitempty"`
+}
+
+// AuditLog slice of the most recent AuditEntry, oldest first
+var AuditLog []AuditEntry
+
+// auditSink struct appends audit entries to a JSON Lines file, rotating it to
+// name.1, name.2 and so on once it grows past maxSize
+type auditSink struct {
+	mu      sync.Mutex
+	name    string
+	maxSize int64
+	keep    int
+	f       *os.File
+	size    int64
+}
+
+// auditFile is where audit entries are written, if anywhere
+var auditFile *auditSink
+
+func openAuditSink(name string, maxSize int64, keep int) (*auditSink, error) {
+	s := &auditSink{name: name, maxSize: maxSize, keep: keep}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *auditSink) open() error {
+	f, err := os.OpenFile(s.name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0660)
+	if err != nil {
+		return fmt.Errorf("error: auditSink, opening %s: %s", s.name, err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("error: auditSink, reading size of %s: %s", s.name, err)
+	}
+	s.f = f
+	s.size = info.Size()
+	return nil
+}
+
+func (s *auditSink) rotate() error {
+	s.f.Close()
+	for i := s.keep - 1; i >= 1; i-- {
+		os.Rename(s.name+"."+strconv.Itoa(i), s.name+"."+strconv.Itoa(i+1))
+	}
+	if s.keep > 0 {
+		if err := os.Rename(s.name, s.name+".1"); err != nil {
+			return fmt.Errorf("error: auditSink, rotating %s: %s", s.name, err)
+		}
+	} else {
+		os.Remove(s.name)
+	}
+	return s.open()
+}
+
+func (s *auditSink) write(entry AuditEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	dat, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("error: auditSink, marshaling entry: %s", err)
+	}
+	dat = append(dat, '\n')
+	if s.maxSize > 0 && s.size > 0 && s.size+int64(len(dat)) > s.maxSize {
+		if err = s.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := s.f.Write(dat)
+	s.size += int64(n)
+	if err != nil {
+		return fmt.Errorf("error: auditSink, writing to %s: %s", s.name, err)
+	}
+	return nil
+}
+
+// read returns every entry in the rotated files and the current one, oldest
+// first
+func (s *auditSink) read() ([]AuditEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var entries []AuditEntry
+	names := []string{}
+	for i := s.keep; i >= 1; i-- {
+		names = append(names, s.name+"."+strconv.Itoa(i))
+	}
+	names = append(names, s.name)
+	for _, name := range names {
+		f, err := os.Open(name)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("error: auditSink, opening %s: %s", name, err)
+		}
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			var entry AuditEntry
+			if json.Unmarshal(scanner.Bytes(), &entry) == nil {
+				entries = append(entries, entry)
+			}
+		}
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("error: auditSink, reading %s: %s", name, err)
+		}
+	}
+	return entries, nil
+}
+
+// audit records that actor did action to target
+func audit(actor string, action string, target string, detail string) {
+	entry := AuditEntry{
+		Timestamp: time.Now().Unix(),
+		Actor:     actor,
+		Action:    action,
+		Target:    target,
+		Detail:    detail,
+	}
+	AuditLog = append(AuditLog, entry)
+	if len(AuditLog) > maxAuditEntries {
+		AuditLog = AuditLog[len(AuditLog)-maxAuditEntries:]
+	}
+	if auditFile != nil {
+		if err := auditFile.write(entry); err != nil {
+			slog.Error("writing audit log", "err", err)
+		}
+	}
+	slog.Debug("audit", "actor", actor, "action", action, "target", target, "detail", detail)
+}
+
+// auditQuery struct filters audit entries; empty fields match everything
+type auditQuery struct {
+	Actor  string
+	Action string
+	Target string
+	Since  int64
+	Until  int64
+	Limit  int
+}
+
+func (q auditQuery) matches(e AuditEntry) bool {
+	return (q.Actor == "" || q.Actor == e.Actor) &&
+		(q.Action == "" || q.Action == e.Action) &&
+		(q.Target == "" || q.Target == e.Target) &&
+		(q.Since == 0 || e.Timestamp >= q.Since) &&
+		(q.Until == 0 || e.Timestamp <= q.Until)
+}
+
+// queryAudit returns the newest entries matching q, oldest first, searching
+// the audit files when there are any and the in-memory log otherwise
+func queryAudit(q auditQuery) ([]AuditEntry, error) {
+	entries := AuditLog
+	if auditFile != nil {
+		var err error
+		if entries, err = auditFile.read(); err != nil {
+			return nil, err
+		}
+	}
+	result := []AuditEntry{}
+	for _, e := range entries {
+		if q.matches(e) {
+			result = append(result, e)
+		}
+	}
+	if q.Limit > 0 && len(result) > q.Limit {
+		result = result[len(result)-q.Limit:]
+	}
+	return result, nil
+}
+
+// GET /admin/audit?actor=&action=&target=&since=&until=&limit=
+// since and until are unix timestamps, limit defaults to 100
+func adminAuditHandler(w http.ResponseWriter, r *http.Request) {
+	v := r.URL.Query()
+	q := auditQuery{
+		Actor:  v.Get("actor"),
+		Action: v.Get("action"),
+		Target: v.Get("target"),
+		Limit:  100,
+	}
+	q.Since, _ = strconv.ParseInt(v.Get("since"), 10, 64)
+	q.Until, _ = strconv.ParseInt(v.Get("until"), 10, 64)
+	if limit, err := strconv.Atoi(v.Get("limit")); err == nil {
+		q.Limit = limit
+	}
+	entries, err := queryAudit(q)
+	writeAdminResult(w, entries, err)
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// canManageChannel reports whether key may delete, rename or archive the
+// channel: its founder once registered, any of its operators before that
+func canManageChannel(channelKey string, key string) bool {
+	cc, ok := ChatChannels[channelKey]
+	if !ok {
+		return false
+	}
+	if cc.Chan.Founder != "" {
+		return accessLevel(cc.Chan, identifiedAs(key)) == levelOwner
+	}
+	return isChannelOperator(channelKey, key)
+}
+
+// channelRequest is the body accepted by the /channel/{identifier} endpoints
+type channelRequest struct {
+	User     string `json:"user"`
+	Name     string `json:"name"`
+	Archived bool   `json:"archived"`
+}
+
+// channelManager reads the request and returns who it acts for, for the audit
+// log, if the user manages the channel or sent an operator token
+func channelManager(w http.ResponseWriter, r *http.Request) (channelRequest, string, bool) {
+	var req channelRequest
+	reqBody, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		reqLogger(r).Error("reading request body", "func", "channelManager", "err", err)
+	}
+	json.Unmarshal(reqBody, &req)
+	key := mux.Vars(r)["identifier"]
+	if _, ok := ChatChannels[key]; !ok {
+		http.Error(w, "no such channel", http.StatusNotFound)
+		return req, "", false
+	}
+	if !checkNick(w, r, req.User, false) {
+		return req, "", false
+	}
+	// ownership that comes from an account needs this request to prove it
+	identified := nickOwner(req.User) == "" || httpIdentified(r, req.User)
+	if identified && canManageChannel(key, req.User) {
+		return req, req.User, true
+	}
+	if session, ok := operSessionFor(r); ok {
+		return req, session.actor() + " override", true
+	}
+	http.Error(w, "only the channel's owner may do that", http.StatusForbidden)
+	return req, "", false
+}
+
+// POST /channel/{identifier}/delete
+func deleteChannel(w http.ResponseWriter, r *http.Request) {
+	key := mux.Vars(r)["identifier"]
+	if _, actor, ok := channelManager(w, r); ok {
+		writeAdminResult(w, key, adminDeleteChannel(actor, key))
+	}
+}
+
+// POST /channel/{identifier}/rename
+func renameChannel(w http.ResponseWriter, r *http.Request) {
+	req, actor, ok := channelManager(w, r)
+	if !ok {
+		return
+	}
+	if err := adminRenameChannel(actor, mux.Vars(r)["identifier"], req.Name); err != nil {
+		writeAdminResult(w, nil, err)
+		return
+	}
+	writeAdminResult(w, ChatChannels[req.Name].Chan, nil)
+}
+
+// POST /channel/{identifier}/archive
+func archiveChannel(w http.ResponseWriter, r *http.Request) {
+	req, actor, ok := channelManager(w, r)
+	if !ok {
+		return
+	}
+	key := mux.Vars(r)["identifier"]
+	if err := adminArchiveChannel(actor, key, req.Archived); err != nil {
+		writeAdminResult(w, nil, err)
+		return
+	}
+	writeAdminResult(w, ChatChannels[key].Chan, nil)
+}
+
+// GET /chatchannel/{identifier}/search?q=text returns the channel's chats that
+// contain text, ignoring case
+func searchChannel(w http.ResponseWriter, r *http.Request) {
+	cc, ok := ChatChannels[mux.Vars(r)["identifier"]]
+	if !ok {
+		http.Error(w, "no such channel", http.StatusNotFound)
+		return
+	}
+	q := strings.ToLower(r.URL.Query().Get("q"))
+	if q == "" {
+		http.Error(w, "search needs a q parameter", http.StatusBadRequest)
+		return
+	}
+	found := []Chat{}
+	for _, chat := range cc.Chats {
+		if strings.Contains(strings.ToLower(chat.Text), q) {
+			found = append(found, chat)
+		}
+	}
+	json.NewEncoder(w).Encode(found)
+}
+
+// GET /chatchannel/{identifier}/history?before=<id>&limit=<n> returns the
+// channel's last n chats, at most maxHistory, from before chat ID before if
+// given, oldest first, so clients can page back through the backlog
+func channelHistory(w http.ResponseWriter, r *http.Request) {
+	cc, ok := ChatChannels[mux.Vars(r)["identifier"]]
+	if !ok {
+		http.Error(w, "no such channel", http.StatusNotFound)
+		return
+	}
+	limit := defaultHistory
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			http.Error(w, "limit must be a positive number", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	if limit > maxHistory {
+		limit = maxHistory
+	}
+	end := len(cc.Chats)
+	if v := r.URL.Query().Get("before"); v != "" {
+		before, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			http.Error(w, "before must be a chat ID", http.StatusBadRequest)
+			return
+		}
+		// chats are kept in the order they were sent, so IDs only grow
+		end = sort.Search(len(cc.Chats), func(i int) bool { return cc.Chats[i].ID >= before })
+	}
+	start := end - limit
+	if start < 0 {
+		start = 0
+	}
+	json.NewEncoder(w).Encode(append([]Chat{}, cc.Chats[start:end]...))
+}
+
+// adds the channel owner endpoints and history search
+func handleChannelRequests(router *mux.Router) {
+	router.HandleFunc("/channel/{identifier}/delete", deleteChannel).Methods("POST")
+	router.HandleFunc("/channel/{identifier}/rename", renameChannel).Methods("POST")
+	router.HandleFunc("/channel/{identifier}/archive", archiveChannel).Methods("POST")
+	router.HandleFunc("/chatchannel/{identifier}/search", searchChannel).Methods("GET")
+	router.HandleFunc("/chatchannel/{identifier}/history", channelHistory).Methods("GET")
+}
@@ -0,0 +1,419 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// chanServ is the services pseudo-user that owns channel registration
+const chanServ = "ChanServ"
+
+// channel access levels, lowest first; each may do whatever the ones below it
+// may
+const (
+	levelNone = iota
+	levelVoice
+	levelHalfOp
+	levelOp
+	levelOwner
+)
+
+// accessLevels map of the level names used in access lists to their levels
+var accessLevels = map[string]int{"voice": levelVoice, "halfop": levelHalfOp, "op": levelOp, "owner": levelOwner}
+
+// ChannelSettings struct holds the options of a registered channel, changed
+// with ChanServ SET
+type ChannelSettings struct {
+	AutoOp     bool   `json:"autoop"`
+	Restricted bool   `json:"restricted"`
+	Moderated  bool   `json:"moderated"`
+	Topic      string `json:"topic,omitempty"`
+}
+
+// servicesMask is the IRC prefix of a services pseudo-user
+func servicesMask(name string) string {
+	return name + "!services@" + serverDisplayName
+}
+
+// accessLevel is the level the channel's access list gives account; the
+// founder is always its owner
+func accessLevel(ch Channel, account string) int {
+	if account == "" {
+		return levelNone
+	}
+	if account == ch.Founder {
+		return levelOwner
+	}
+	return accessLevels[ch.Access[account]]
+}
+
+// hasStatus reports whether one of the entries in a channel's status list is
+// key; entries that are account names must be logged in to that account,
+// whatever their nickname
+func hasStatus(list []string, key string) bool {
+	account := identifiedAs(key)
+	for _, entry := range list {
+		if _, registered := Accounts[entry]; registered {
+			if entry == account {
+				return true
+			}
+		} else if entry == key {
+			return true
+		}
+	}
+	return false
+}
+
+// channelLevel is the higher of what key's account is given by the channel's
+// access list and the statuses key holds in it
+func channelLevel(channelKey string, key string) int {
+	cc, ok := ChatChannels[channelKey]
+	if !ok {
+		return levelNone
+	}
+	level := accessLevel(cc.Chan, identifiedAs(key))
+	if level < levelOp && hasStatus(cc.Chan.Operators, key) {
+		level = levelOp
+	}
+	if level < levelHalfOp && hasStatus(cc.Chan.HalfOps, key) {
+		level = levelHalfOp
+	}
+	if level < levelVoice && hasStatus(cc.Chan.Voiced, key) {
+		level = levelVoice
+	}
+	return level
+}
+
+// statusPrefixes are the IRC prefixes of the statuses key holds in the
+// channel, highest first; ~ marks the founder
+func statusPrefixes(channelKey string, key string) string {
+	cc, ok := ChatChannels[channelKey]
+	if !ok {
+		return ""
+	}
+	prefixes := ""
+	if cc.Chan.Founder != "" && identifiedAs(key) == cc.Chan.Founder {
+		prefixes += "~"
+	}
+	if hasStatus(cc.Chan.Operators, key) {
+		prefixes += "@"
+	}
+	if hasStatus(cc.Chan.HalfOps, key) {
+		prefixes += "%"
+	}
+	if hasStatus(cc.Chan.Voiced, key) {
+		prefixes += "+"
+	}
+	return prefixes
+}
+
+// canSetMode reports whether key may apply mode to target: voice needs a
+// halfop and everything else an op, and nobody may take a status from, or
+// ban, someone above them
+func canSetMode(channelKey string, key string, mode string, target string) bool {
+	level := channelLevel(channelKey, key)
+	need := levelOp
+	if strings.HasSuffix(mode, "v") {
+		need = levelHalfOp
+	}
+	if level < need {
+		return false
+	}
+	if (strings.HasPrefix(mode, "-") || mode == "+b") && target != key && channelLevel(channelKey, target) > level {
+		return false
+	}
+	return true
+}
+
+// restricted reports whether the channel only lets in users on its access
+// list or holding a status, and key is not one of them
+func restricted(channelKey string, key string) bool {
+	s := ChatChannels[channelKey].Chan.Settings
+	return s != nil && s.Restricted && channelLevel(channelKey, key) == levelNone
+}
+
+// moderated reports whether the channel only lets voiced users and up talk,
+// and key is not one of them
+func moderated(channelKey string, key string) bool {
+	s := ChatChannels[channelKey].Chan.Settings
+	return s != nil && s.Moderated && channelLevel(channelKey, key) < levelVoice
+}
+
+// autoStatus gives key the status their account's access entitles them to,
+// when the channel has AUTOOP set; called once key has joined
+func autoStatus(key string, channelKey string) {
+	cc := ChatChannels[channelKey]
+	if cc.Chan.Settings == nil || !cc.Chan.Settings.AutoOp {
+		return
+	}
+	account := identifiedAs(key)
+	var mode string
+	var list []string
+	switch accessLevel(cc.Chan, account) {
+	case levelOwner, levelOp:
+		mode, list = "+o", cc.Chan.Operators
+	case levelHalfOp:
+		mode, list = "+h", cc.Chan.HalfOps
+	case levelVoice:
+		mode, list = "+v", cc.Chan.Voiced
+	default:
+		return
+	}
+	if !hasStatus(list, key) {
+		setChannelMode(chanServ, channelKey, mode, account)
+	}
+	ircModeChanged(servicesMask(chanServ), channelKey, mode, key, cc.Chan.Connected)
+}
+
+// clearStatus takes the statuses given to account off the channel, so its
+// next join gets what its access says
+func clearStatus(ch *Channel, account string) {
+	ch.Operators = without(ch.Operators, account)
+	ch.HalfOps = without(ch.HalfOps, account)
+	ch.Voiced = without(ch.Voiced, account)
+}
+
+// dropChannelAccess takes a dropped account off every access list, and
+// unregisters the channels it founded
+func dropChannelAccess(account string) {
+	for k, cc := range ChatChannels {
+		if cc.Chan.Founder == account {
+			unregisterChannel(cc)
+			audit(chanServ, "drop channel", k, account)
+		}
+		delete(cc.Chan.Access, account)
+		clearStatus(&cc.Chan, account)
+	}
+}
+
+func unregisterChannel(cc *ChatChannel) {
+	cc.Chan.Founder = ""
+	cc.Chan.Access = nil
+	cc.Chan.Settings = nil
+}
+
+const chanServHelp = `REGISTER <#channel>                      registers a channel you are an operator of, with you as founder
+INFO <#channel>                          shows a channel's founder and settings
+ACCESS <#channel> LIST                   shows a channel's access list
+ACCESS <#channel> ADD <account> <level>  gives an account voice, halfop or op whenever it joins
+ACCESS <#channel> DEL <account>          takes an account off the access list
+SET <#channel> <setting> <on|off>        turns AUTOOP, RESTRICTED or MODERATED on or off
+SET <#channel> TOPIC [text]              sets the topic shown on join
+TRANSFER <#channel> <account>            hands the channel to another account
+DROP <#channel>                          unregisters the channel`
+
+// chanServCommand runs a ChanServ command for key, who is logged in to
+// account, if any, and returns the reply
+func chanServCommand(key string, account string, text string) (string, error) {
+	tok := strings.Fields(text)
+	arg := func(i int) string {
+		if i < len(tok) {
+			return tok[i]
+		}
+		return ""
+	}
+	command := strings.ToUpper(arg(0))
+	if command == "" || command == "HELP" {
+		return chanServHelp, nil
+	}
+	channelKey := strings.TrimPrefix(arg(1), "#")
+	cc, ok := ChatChannels[channelKey]
+	if !ok {
+		return "", fmt.Errorf("no such channel #%s", channelKey)
+	}
+	if command != "REGISTER" && cc.Chan.Founder == "" {
+		return "", fmt.Errorf("#%s is not registered", channelKey)
+	}
+	if cc.Chan.Access == nil {
+		cc.Chan.Access = make(map[string]string)
+	}
+	if cc.Chan.Founder != "" && cc.Chan.Settings == nil {
+		// the defaults REGISTER gives, as validate fills in for snapshots
+		cc.Chan.Settings = &ChannelSettings{AutoOp: true}
+	}
+	level := accessLevel(cc.Chan, account)
+	switch command {
+	case "REGISTER":
+		if account == "" {
+			return "", fmt.Errorf("identify to an account first")
+		}
+		if cc.Chan.Founder != "" {
+			return "", fmt.Errorf("#%s is already registered to %s", channelKey, cc.Chan.Founder)
+		}
+		if !isChannelOperator(channelKey, key) {
+			return "", fmt.Errorf("you must be an operator of #%s to register it", channelKey)
+		}
+		cc.Chan.Founder = account
+		cc.Chan.Access = make(map[string]string)
+		cc.Chan.Settings = &ChannelSettings{AutoOp: true}
+		audit(key, "register channel", channelKey, account)
+		return fmt.Sprintf("#%s is now registered to %s", channelKey, account), nil
+	case "INFO":
+		s := cc.Chan.Settings
+		return fmt.Sprintf("#%s is registered to %s\nautoop %t, restricted %t, moderated %t\ntopic: %s",
+			channelKey, cc.Chan.Founder, s.AutoOp, s.Restricted, s.Moderated, s.Topic), nil
+	case "ACCESS":
+		return channelAccess(key, channelKey, level, strings.ToUpper(arg(2)), arg(3), arg(4))
+	case "SET":
+		setting := strings.ToUpper(arg(2))
+		if setting == "TOPIC" {
+			if level < levelOp {
+				return "", fmt.Errorf("you need op access to #%s to set its topic", channelKey)
+			}
+			cc.Chan.Settings.Topic = strings.Join(tok[3:], " ")
+			audit(key, "topic", channelKey, cc.Chan.Settings.Topic)
+			ircTopic(channelKey)
+			return fmt.Sprintf("topic of #%s set", channelKey), nil
+		}
+		if level < levelOwner {
+			return "", fmt.Errorf("only the founder of #%s may change its settings", channelKey)
+		}
+		var on bool
+		switch strings.ToLower(arg(3)) {
+		case "on":
+			on = true
+		case "off":
+		default:
+			return "", fmt.Errorf("SET %s takes on or off", setting)
+		}
+		switch setting {
+		case "AUTOOP":
+			cc.Chan.Settings.AutoOp = on
+		case "RESTRICTED":
+			cc.Chan.Settings.Restricted = on
+		case "MODERATED":
+			cc.Chan.Settings.Moderated = on
+		default:
+			return "", fmt.Errorf("unknown setting %s, see HELP", setting)
+		}
+		audit(key, "set "+strings.ToLower(setting), channelKey, strings.ToLower(arg(3)))
+		return fmt.Sprintf("%s of #%s is now %s", setting, channelKey, strings.ToLower(arg(3))), nil
+	case "TRANSFER":
+		target := arg(2)
+		if level < levelOwner {
+			return "", fmt.Errorf("only the founder of #%s may transfer it", channelKey)
+		}
+		if _, ok := Accounts[target]; !ok {
+			return "", fmt.Errorf("no such account %q", target)
+		}
+		if target == account {
+			return "", fmt.Errorf("you already own #%s", channelKey)
+		}
+		// the old founder stays on as an op
+		delete(cc.Chan.Access, target)
+		cc.Chan.Access[account] = "op"
+		cc.Chan.Founder = target
+		audit(key, "transfer channel", channelKey, target)
+		return fmt.Sprintf("#%s is now registered to %s", channelKey, target), nil
+	case "DROP":
+		if level < levelOwner {
+			return "", fmt.Errorf("only the founder of #%s may drop it", channelKey)
+		}
+		unregisterChannel(cc)
+		audit(key, "drop channel", channelKey, account)
+		return fmt.Sprintf("#%s is no longer registered", channelKey), nil
+	}
+	return "", fmt.Errorf("unknown command %s, see HELP", command)
+}
+
+// channelAccess runs ACCESS LIST, ADD and DEL; ops may hand out and take away
+// the levels below their own
+func channelAccess(key string, channelKey string, level int, action string, target string, name string) (string, error) {
+	ch := &ChatChannels[channelKey].Chan
+	switch action {
+	case "LIST":
+		lines := []string{ch.Founder + " owner"}
+		var accounts []string
+		for a := range ch.Access {
+			accounts = append(accounts, a)
+		}
+		sort.Strings(accounts)
+		for _, a := range accounts {
+			lines = append(lines, a+" "+ch.Access[a])
+		}
+		return strings.Join(lines, "\n"), nil
+	case "ADD":
+		want, ok := accessLevels[strings.ToLower(name)]
+		if !ok || want == levelOwner {
+			return "", fmt.Errorf("level must be voice, halfop or op")
+		}
+		if _, ok := Accounts[target]; !ok {
+			return "", fmt.Errorf("no such account %q", target)
+		}
+		if level < levelOp || want >= level || accessLevel(*ch, target) >= level {
+			return "", fmt.Errorf("you may not give %s %s on #%s", target, name, channelKey)
+		}
+		ch.Access[target] = strings.ToLower(name)
+		clearStatus(ch, target)
+		audit(key, "access add", channelKey, target+" "+ch.Access[target])
+		return fmt.Sprintf("%s now has %s on #%s", target, ch.Access[target], channelKey), nil
+	case "DEL":
+		if _, ok := ch.Access[target]; !ok {
+			return "", fmt.Errorf("%s is not on the access list of #%s", target, channelKey)
+		}
+		if target != identifiedAs(key) && (level < levelOp || accessLevel(*ch, target) >= level) {
+			return "", fmt.Errorf("you may not remove %s from #%s", target, channelKey)
+		}
+		delete(ch.Access, target)
+		clearStatus(ch, target)
+		audit(key, "access del", channelKey, target)
+		return fmt.Sprintf("%s removed from the access list of #%s", target, channelKey), nil
+	}
+	return "", fmt.Errorf("ACCESS takes LIST, ADD or DEL")
+}
+
+// chanServRequest is the body accepted by /chanserv
+type chanServRequest struct {
+	User    string `json:"user"`
+	Command string `json:"command"`
+}
+
+// POST /chanserv runs a ChanServ command; the user's account comes from their
+// X-Nick-Token
+func chanServHandler(w http.ResponseWriter, r *http.Request) {
+	var req chanServRequest
+	reqBody, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		reqLogger(r).Error("reading request body", "func", "chanServHandler", "err", err)
+	}
+	json.Unmarshal(reqBody, &req)
+	if _, ok := Users[req.User]; !ok {
+		http.Error(w, "no such user", http.StatusNotFound)
+		return
+	}
+	if !checkNick(w, r, req.User, false) {
+		return
+	}
+	account := ""
+	if httpIdentified(r, req.User) {
+		account = Identified[req.User]
+	}
+	reply, err := chanServCommand(req.User, account, req.Command)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{"reply": reply})
+}
+
+// adds the /chanserv endpoint
+func handleChanServRequests(router *mux.Router) {
+	router.HandleFunc("/chanserv", chanServHandler).Methods("POST")
+}
+
+// chanserv runs a command sent to ChanServ from IRC
+func (c *ircClient) chanserv(text string) {
+	reply, err := chanServCommand(c.nick, c.account, text)
+	if err != nil {
+		reply = err.Error()
+	}
+	for _, line := range strings.Split(reply, "\n") {
+		c.write(formatIRC("", servicesMask(chanServ), "NOTICE", c.nick, line))
+	}
+}
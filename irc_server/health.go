@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+// version of the server, overridden at build time with
+// -ldflags "-X main.version=..."
+var version = "dev"
+
+// serverDisplayName is what /info calls this server
+var serverDisplayName = "go-irc"
+
+// startTime is when the server started, for uptime
+var startTime = time.Now()
+
+// limits enforced on every user and chat, and advertised by /info
+const (
+	maxNickLength    = 30
+	maxMessageLength = 512
+	// defaultHistory and maxHistory are how many chats a history request
+	// gets when it does not say, and at most
+	defaultHistory = 50
+	maxHistory     = 200
+)
+
+// shuttingDown is set once the operator quits, so /readyz can tell load
+// balancers to stop sending us users while we export
+var shuttingDown atomic.Bool
+
+// ServerInfo struct is what /info returns
+type ServerInfo struct {
+	Name     string         `json:"name"`
+	Version  string         `json:"version"`
+	Started  int64          `json:"started"`
+	Uptime   int64          `json:"uptime"`
+	Features []string       `json:"features"`
+	Limits   map[string]int `json:"limits"`
+	MOTD     string         `json:"motd"`
+}
+
+func enabledFeatures() []string {
+	features := []string{"metrics", "rate-limit", "snapshots"}
+	if tlsConfig != nil {
+		features = append(features, "tls")
+	}
+	if adminToken != "" {
+		features = append(features, "admin-api")
+	}
+	if len(OperAccounts) > 0 {
+		features = append(features, "oper")
+	}
+	if auditFile != nil {
+		features = append(features, "audit-log")
+	}
+	if ircAddr != "" {
+		features = append(features, "irc")
+	}
+	return features
+}
+
+func serverInfo(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(ServerInfo{
+		Name:     serverDisplayName,
+		Version:  version,
+		Started:  startTime.Unix(),
+		Uptime:   int64(time.Since(startTime).Seconds()),
+		Features: enabledFeatures(),
+		Limits: map[string]int{
+			"max_nick_length":    maxNickLength,
+			"max_message_length": maxMessageLength,
+			"max_history":        maxHistory,
+		},
+		MOTD: motd,
+	})
+}
+
+// GET /healthz answers as long as the server can handle requests at all
+func healthz(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+}
+
+// storageCheck makes sure a snapshot could be written right now
+func storageCheck() string {
+	tmp, err := ioutil.TempFile(filepath.Dir(snapshotFile), ".readyz-*")
+	if err != nil {
+		return err.Error()
+	}
+	tmp.Close()
+	os.Remove(tmp.Name())
+	if auditFile != nil {
+		if _, err := os.Stat(auditFile.name); err != nil {
+			return err.Error()
+		}
+	}
+	return "ok"
+}
+
+// GET /readyz is 503 while shutting down or when storage is unavailable
+func readyz(w http.ResponseWriter, r *http.Request) {
+	checks := map[string]string{
+		"storage":  storageCheck(),
+		"shutdown": "ok",
+	}
+	if shuttingDown.Load() {
+		checks["shutdown"] = "shutting down"
+	}
+	status := "ready"
+	for _, v := range checks {
+		if v != "ok" {
+			status = "unavailable"
+			w.WriteHeader(http.StatusServiceUnavailable)
+			break
+		}
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"status": status, "checks": checks})
+}
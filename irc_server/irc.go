@@ -0,0 +1,983 @@
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"crypto/tls"
+	"io"
+	"log/slog"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ircAddr is the address of the IRC listener, which is off when empty
+var ircAddr = ":6667"
+
+// ircPingInterval is how often IRC connections are pinged; one that stays
+// silent for two intervals is dropped
+const ircPingInterval = 30 * time.Second
+
+// ircHistoryLimit is the most chats a single CHATHISTORY request returns
+const ircHistoryLimit = 100
+
+// ircTimeFormat is the format of server-time tags
+const ircTimeFormat = "2006-01-02T15:04:05.000Z"
+
+// ircCapabilities are the IRCv3 capabilities the listener supports, in the
+// order CAP LS lists them
+var ircCapabilities = []string{
+	"account-notify",
+	"away-notify",
+	"batch",
+	"draft/chathistory",
+	"echo-message",
+	"message-tags",
+	"multi-prefix",
+	"sasl",
+	"server-time",
+}
+
+// ircMessage struct is one line of the IRC protocol
+type ircMessage struct {
+	Tags    map[string]string
+	Prefix  string
+	Command string
+	Params  []string
+}
+
+func (m ircMessage) param(i int) string {
+	if i < len(m.Params) {
+		return m.Params[i]
+	}
+	return ""
+}
+
+// ircClient struct is a single connection to the IRC listener
+type ircClient struct {
+	conn      net.Conn
+	send      chan string
+	done      chan struct{}
+	closeOnce sync.Once
+	// nick is the user identifier once registered
+	nick       string
+	user       string
+	registered bool
+	// negotiating is set by CAP LS or CAP REQ before registration, which then
+	// waits for CAP END
+	negotiating bool
+	// capVersion is the version given to CAP LS, 302 and up get values
+	capVersion int
+	caps       map[string]bool
+	away       string
+	// account is the Account logged in to with SASL, if any
+	account  string
+	saslMech string
+	saslData string
+	// nickDeadline is when the client is renamed unless it identifies, see
+	// warnNick
+	nickDeadline time.Time
+}
+
+// IRCClients map of user identifier to their IRC connection; like Users it is
+// guarded by dbLock
+var IRCClients = make(map[string]*ircClient)
+
+// ircParamReplacer keeps chat text from starting a new IRC line
+var ircParamReplacer = strings.NewReplacer("\r", " ", "\n", " ", "\x00", "")
+
+func parseIRCLine(line string) ircMessage {
+	var msg ircMessage
+	if strings.HasPrefix(line, "@") {
+		var tags string
+		tags, line, _ = strings.Cut(line[1:], " ")
+		msg.Tags = make(map[string]string)
+		for _, tag := range strings.Split(tags, ";") {
+			k, v, _ := strings.Cut(tag, "=")
+			msg.Tags[k] = v
+		}
+		line = strings.TrimLeft(line, " ")
+	}
+	if strings.HasPrefix(line, ":") {
+		msg.Prefix, line, _ = strings.Cut(line[1:], " ")
+		line = strings.TrimLeft(line, " ")
+	}
+	line, trailing, hasTrailing := strings.Cut(line, " :")
+	fields := strings.Fields(line)
+	if len(fields) > 0 {
+		msg.Command = strings.ToUpper(fields[0])
+		msg.Params = fields[1:]
+	}
+	if hasTrailing {
+		msg.Params = append(msg.Params, trailing)
+	}
+	return msg
+}
+
+// formatIRC builds a line of the IRC protocol; tags and prefix may be empty
+func formatIRC(tags string, prefix string, command string, params ...string) string {
+	var b strings.Builder
+	if tags != "" {
+		b.WriteString("@" + tags + " ")
+	}
+	if prefix != "" {
+		b.WriteString(":" + prefix + " ")
+	}
+	b.WriteString(command)
+	for i, p := range params {
+		p = ircParamReplacer.Replace(p)
+		b.WriteString(" ")
+		if i == len(params)-1 && (p == "" || strings.Contains(p, " ") || p[0] == ':') {
+			b.WriteString(":")
+		}
+		b.WriteString(p)
+	}
+	return b.String()
+}
+
+// ircMask is the nick!user@host prefix of chats from key
+func ircMask(key string) string {
+	return key + "!" + key + "@" + serverDisplayName
+}
+
+// serveIRC accepts IRC connections on ircAddr, with TLS when it is configured
+func serveIRC() {
+	var ln net.Listener
+	var err error
+	if tlsConfig != nil {
+		ln, err = tls.Listen("tcp", ircAddr, tlsConfig)
+	} else {
+		ln, err = net.Listen("tcp", ircAddr)
+	}
+	if err != nil {
+		fatal("listening for IRC", err)
+	}
+	slog.Info("listening for IRC", "addr", ircAddr, "tls", tlsConfig != nil)
+	go enforceNicks()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			slog.Error("accepting IRC connection", "err", err)
+			time.Sleep(time.Second)
+			continue
+		}
+		go handleIRCConn(conn)
+	}
+}
+
+func handleIRCConn(conn net.Conn) {
+	c := &ircClient{
+		conn: conn,
+		send: make(chan string, 512),
+		done: make(chan struct{}),
+		caps: make(map[string]bool),
+	}
+	go c.writeLoop()
+	slog.Debug("IRC connection opened", "remote", conn.RemoteAddr().String())
+	scanner := bufio.NewScanner(conn)
+	// room for the 8191 bytes of tags IRCv3 allows on top of the 512 byte line
+	scanner.Buffer(make([]byte, 1024), 8191+512)
+	reason := "Connection closed"
+	for !c.closed() {
+		conn.SetReadDeadline(time.Now().Add(2 * ircPingInterval))
+		if !scanner.Scan() {
+			if err := scanner.Err(); err != nil {
+				reason = err.Error()
+			}
+			break
+		}
+		msg := parseIRCLine(strings.TrimRight(scanner.Text(), "\r"))
+		if msg.Command == "" {
+			continue
+		}
+		dbLock.Lock()
+		c.handle(msg)
+		dbLock.Unlock()
+	}
+	dbLock.Lock()
+	c.quit(reason)
+	dbLock.Unlock()
+	c.close()
+	slog.Debug("IRC connection closed", "remote", conn.RemoteAddr().String(), "reason", reason)
+}
+
+// writeLoop sends queued lines and pings until the client is closed
+func (c *ircClient) writeLoop() {
+	defer c.conn.Close()
+	ping := time.NewTicker(ircPingInterval)
+	defer ping.Stop()
+	for {
+		select {
+		case line := <-c.send:
+			if !c.writeLine(line) {
+				c.close()
+				return
+			}
+		case <-ping.C:
+			if !c.writeLine("PING :" + serverDisplayName) {
+				c.close()
+				return
+			}
+		case <-c.done:
+			// flush what was queued, such as the ERROR saying why
+			for {
+				select {
+				case line := <-c.send:
+					if !c.writeLine(line) {
+						return
+					}
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (c *ircClient) writeLine(line string) bool {
+	c.conn.SetWriteDeadline(time.Now().Add(ircPingInterval))
+	_, err := io.WriteString(c.conn, line+"\r\n")
+	return err == nil
+}
+
+// write queues line for the client, dropping the connection when the client
+// has fallen too far behind to catch up
+func (c *ircClient) write(line string) {
+	select {
+	case c.send <- line:
+	default:
+		c.close()
+	}
+}
+
+func (c *ircClient) close() {
+	c.closeOnce.Do(func() { close(c.done) })
+}
+
+func (c *ircClient) closed() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// name is how numerics address the client, * until it picks a nickname
+func (c *ircClient) name() string {
+	if c.nick == "" {
+		return "*"
+	}
+	return c.nick
+}
+
+func (c *ircClient) numeric(code string, params ...string) {
+	c.write(formatIRC("", serverDisplayName, code, append([]string{c.name()}, params...)...))
+}
+
+// peers are the other IRC clients in the client's channel
+func (c *ircClient) peers() []*ircClient {
+	var peers []*ircClient
+	cc, ok := ChatChannels[Users[c.nick].Connection]
+	if !ok {
+		return peers
+	}
+	for _, member := range cc.Chan.Connected {
+		if peer, ok := IRCClients[member]; ok && peer != c {
+			peers = append(peers, peer)
+		}
+	}
+	return peers
+}
+
+// handle runs a single command from the client; must hold dbLock
+func (c *ircClient) handle(msg ircMessage) {
+	switch msg.Command {
+	case "CAP":
+		c.handleCAP(msg)
+		return
+	case "PING":
+		c.write(formatIRC("", serverDisplayName, "PONG", serverDisplayName, msg.param(0)))
+		return
+	case "PONG":
+		return
+	case "QUIT":
+		c.write(formatIRC("", "", "ERROR", "Closing link: Quit"))
+		c.quit("Quit: " + msg.param(0))
+		c.close()
+		return
+	case "NICK":
+		c.handleNick(msg.param(0))
+		return
+	case "AUTHENTICATE":
+		c.authenticate(msg.param(0))
+		return
+	case "USER":
+		if c.registered {
+			c.numeric("462", "You may not reregister")
+		} else if len(msg.Params) < 4 {
+			c.numeric("461", "USER", "Not enough parameters")
+		} else {
+			c.user = msg.param(0)
+			c.register()
+		}
+		return
+	}
+	if !c.registered {
+		c.numeric("451", "You have not registered")
+		return
+	}
+	switch msg.Command {
+	case "JOIN":
+		for _, name := range strings.Split(msg.param(0), ",") {
+			c.join(name)
+		}
+	case "PART":
+		if ch := Users[c.nick].Connection; ch != "" && (msg.param(0) == "" || msg.param(0) == "#"+ch) {
+			audit(c.nick, "part", ch, "")
+			removeFromChannel(c.nick)
+		} else {
+			c.numeric("442", msg.param(0), "You're not on that channel")
+		}
+	case "PRIVMSG", "NOTICE":
+		c.privmsg(msg)
+	case "NAMES":
+		ch := strings.TrimPrefix(msg.param(0), "#")
+		if ch == "" {
+			ch = Users[c.nick].Connection
+		}
+		c.names(ch)
+	case "AWAY":
+		c.setAway(msg.param(0))
+	case "WHOIS":
+		// WHOIS [server] nick
+		c.whois(msg.param(len(msg.Params) - 1))
+	case "MODE":
+		c.mode(msg)
+	case "MOTD":
+		c.sendMOTD()
+	case "TOPIC":
+		// topics belong to registered channels, and are set through ChanServ
+		ch := strings.TrimPrefix(msg.param(0), "#")
+		if len(msg.Params) < 2 {
+			c.topic(ch, true)
+		} else if _, err := chanServCommand(c.nick, c.account, "SET #"+ch+" TOPIC "+msg.param(1)); err != nil {
+			c.numeric("482", "#"+ch, err.Error())
+		}
+	case "CHATHISTORY":
+		c.chathistory(msg)
+	default:
+		c.numeric("421", msg.Command, "Unknown command")
+	}
+}
+
+func (c *ircClient) handleCAP(msg ircMessage) {
+	switch strings.ToUpper(msg.param(0)) {
+	case "LS":
+		if !c.registered {
+			c.negotiating = true
+		}
+		c.capVersion, _ = strconv.Atoi(msg.param(1))
+		caps := make([]string, len(ircCapabilities))
+		for i, name := range ircCapabilities {
+			caps[i] = name
+			if name == "sasl" && c.capVersion >= 302 {
+				caps[i] += "=" + strings.Join(saslMechanisms(), ",")
+			}
+		}
+		c.write(formatIRC("", serverDisplayName, "CAP", c.name(), "LS", strings.Join(caps, " ")))
+	case "LIST":
+		var enabled []string
+		for name, on := range c.caps {
+			if on {
+				enabled = append(enabled, name)
+			}
+		}
+		sort.Strings(enabled)
+		c.write(formatIRC("", serverDisplayName, "CAP", c.name(), "LIST", strings.Join(enabled, " ")))
+	case "REQ":
+		if !c.registered {
+			c.negotiating = true
+		}
+		requested := strings.Fields(msg.param(1))
+		// a request is granted in full or not at all
+		for _, name := range requested {
+			if !supportedCapability(strings.TrimPrefix(name, "-")) {
+				c.write(formatIRC("", serverDisplayName, "CAP", c.name(), "NAK", msg.param(1)))
+				return
+			}
+		}
+		for _, name := range requested {
+			c.caps[strings.TrimPrefix(name, "-")] = !strings.HasPrefix(name, "-")
+		}
+		c.write(formatIRC("", serverDisplayName, "CAP", c.name(), "ACK", msg.param(1)))
+	case "END":
+		c.negotiating = false
+		c.register()
+	default:
+		c.numeric("410", msg.param(0), "Invalid CAP command")
+	}
+}
+
+func supportedCapability(name string) bool {
+	for _, c := range ircCapabilities {
+		if c == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *ircClient) handleNick(nick string) {
+	if nick == "" {
+		c.numeric("431", "No nickname given")
+	} else if !validName(nick) || reservedNick(nick) {
+		c.numeric("432", nick, "Erroneous nickname")
+	} else if _, ok := IRCClients[nick]; ok {
+		c.numeric("433", nick, "Nickname is already in use")
+	} else if c.registered {
+		c.rename(nick)
+		c.warnNick()
+	} else {
+		c.nick = nick
+		c.register()
+	}
+}
+
+// rename moves a registered client to nick, which must not be in use on IRC,
+// keeping its place in its channel
+func (c *ircClient) rename(nick string) {
+	old := c.nick
+	if _, ok := Users[nick]; !ok {
+		Users[nick] = User{Nickname: nick}
+		addPrivateMessages(nick)
+	}
+	line := formatIRC("", ircMask(old), "NICK", nick)
+	c.write(line)
+	for _, peer := range c.peers() {
+		peer.write(line)
+	}
+	moveMember(old, nick)
+	delete(IRCClients, old)
+	IRCClients[nick] = c
+	c.nick = nick
+	c.nickDeadline = time.Time{}
+	audit(old, "nick", nick, "")
+}
+
+// register welcomes the client once it has sent NICK and USER and finished
+// CAP negotiation; nicknames that are not users yet become users, the same
+// as the first login of the HTTP client
+func (c *ircClient) register() {
+	if c.registered || c.negotiating || c.nick == "" || c.user == "" {
+		return
+	}
+	if _, ok := IRCClients[c.nick]; ok {
+		c.numeric("433", c.nick, "Nickname is already in use")
+		c.nick = ""
+		return
+	}
+	if _, ok := Users[c.nick]; !ok {
+		Users[c.nick] = User{Nickname: c.nick}
+		addPrivateMessages(c.nick)
+	}
+	c.registered = true
+	IRCClients[c.nick] = c
+	c.numeric("001", "Welcome to the "+serverDisplayName+" IRC network "+ircMask(c.nick))
+	c.numeric("002", "Your host is "+serverDisplayName+", running version "+version)
+	c.numeric("003", "This server was created "+startTime.UTC().Format(time.RFC1123))
+	c.numeric("004", serverDisplayName, version, "o", "bohv")
+	c.numeric("005",
+		"CHANTYPES=#",
+		"PREFIX=(qohv)~@%+",
+		"CHANMODES=b,,,",
+		"NICKLEN="+strconv.Itoa(maxNickLength),
+		"CHANNELLEN="+strconv.Itoa(maxNickLength),
+		"CHATHISTORY="+strconv.Itoa(ircHistoryLimit),
+		"MSGREFTYPES=msgid,timestamp",
+		"NETWORK="+serverDisplayName,
+		"are supported by this server")
+	c.sendMOTD()
+	// users keep their channel between sessions, so put them back in it
+	if ch := Users[c.nick].Connection; ch != "" {
+		if _, ok := ChatChannels[ch]; ok {
+			ircJoined(c.nick, ch)
+		}
+	}
+	if c.account != "" {
+		c.notifyAccount()
+	}
+	c.warnNick()
+	slog.Info("IRC user registered", "user", c.nick, "account", c.account, "remote", c.conn.RemoteAddr().String())
+}
+
+// quit tells the client's peers it is gone; the user stays in their channel,
+// just as HTTP users do when they stop polling
+func (c *ircClient) quit(reason string) {
+	if !c.registered || IRCClients[c.nick] != c {
+		return
+	}
+	line := formatIRC("", ircMask(c.nick), "QUIT", reason)
+	for _, peer := range c.peers() {
+		peer.write(line)
+	}
+	delete(IRCClients, c.nick)
+	c.registered = false
+}
+
+// disconnectIRC closes key's IRC connection, if they have one, telling them
+// why; must hold dbLock
+func disconnectIRC(key string, reason string) bool {
+	c, ok := IRCClients[key]
+	if !ok {
+		return false
+	}
+	c.write(formatIRC("", "", "ERROR", "Closing link: "+reason))
+	c.quit(reason)
+	c.close()
+	return true
+}
+
+func (c *ircClient) sendMOTD() {
+	if motd == "" {
+		c.numeric("422", "MOTD File is missing")
+		return
+	}
+	c.numeric("375", "- "+serverDisplayName+" Message of the day -")
+	for _, line := range strings.Split(motd, "\n") {
+		c.numeric("372", "- "+line)
+	}
+	c.numeric("376", "End of /MOTD command")
+}
+
+func (c *ircClient) join(name string) {
+	if name == "0" {
+		if ch := Users[c.nick].Connection; ch != "" {
+			audit(c.nick, "part", ch, "")
+			removeFromChannel(c.nick)
+		}
+		return
+	}
+	if !strings.HasPrefix(name, "#") || !validName(name[1:]) {
+		c.numeric("403", name, "No such channel")
+		return
+	}
+	if c.mustIdentify() {
+		c.numeric("477", name, "You need to log in to the account for your nickname to join channels")
+		return
+	}
+	key := name[1:]
+	if _, ok := ChatChannels[key]; !ok {
+		// joining a channel that does not exist creates it, with the creator
+		// as its operator
+		ChatChannels[key] = &ChatChannel{
+			Chan: Channel{
+				ChannelName: key,
+				Operators:   []string{c.nick},
+				Connected:   []string{},
+				Creator:     c.nick,
+			},
+			Chats: []Chat{},
+		}
+		audit(c.nick, "create channel", key, c.nick)
+	}
+	if isBanned(key, c.nick) {
+		c.numeric("474", name, "Cannot join channel (+b)")
+		return
+	}
+	if restricted(key, c.nick) {
+		c.numeric("473", name, "Cannot join channel (restricted to its access list)")
+		return
+	}
+	if old := Users[c.nick].Connection; old != key {
+		if old != "" {
+			audit(c.nick, "part", old, "")
+		}
+		audit(c.nick, "join", key, "")
+	}
+	joinUser(c.nick, key)
+}
+
+// ircJoined tells the channel's IRC members that key joined it, and sends key
+// the channel's names if they are on IRC; must hold dbLock
+func ircJoined(key string, channelKey string) {
+	joiner := IRCClients[key]
+	line := formatIRC("", ircMask(key), "JOIN", "#"+channelKey)
+	for _, member := range ChatChannels[channelKey].Chan.Connected {
+		c, ok := IRCClients[member]
+		if !ok {
+			continue
+		}
+		c.write(line)
+		if c != joiner && joiner != nil && joiner.away != "" && c.caps["away-notify"] {
+			c.write(formatIRC("", ircMask(key), "AWAY", joiner.away))
+		}
+	}
+	if joiner != nil {
+		joiner.topic(channelKey, false)
+		joiner.names(channelKey)
+	}
+}
+
+// ircParted tells the channel's IRC members that key is leaving it; must hold
+// dbLock
+func ircParted(key string, channelKey string) {
+	line := formatIRC("", ircMask(key), "PART", "#"+channelKey)
+	for _, member := range ChatChannels[channelKey].Chan.Connected {
+		if c, ok := IRCClients[member]; ok {
+			c.write(line)
+		}
+	}
+}
+
+// MODE #channel [+o|-o|+h|-h|+v|-v|+b|-b target]; changes follow the same
+// rules as the /mode endpoint, and are announced to the channel's IRC members
+func (c *ircClient) mode(msg ircMessage) {
+	target, change := msg.param(0), msg.param(1)
+	if !strings.HasPrefix(target, "#") {
+		if target != c.nick {
+			c.numeric("502", "Can't change mode for other users")
+			return
+		}
+		c.numeric("221", "+")
+		return
+	}
+	key := target[1:]
+	cc, ok := ChatChannels[key]
+	if !ok {
+		c.numeric("403", target, "No such channel")
+		return
+	}
+	if change == "" {
+		c.numeric("324", target, "+")
+		return
+	}
+	if (change == "+b" || change == "b") && msg.param(2) == "" {
+		for _, banned := range cc.Chan.Banned {
+			c.numeric("367", target, banned)
+		}
+		c.numeric("368", target, "End of channel ban list")
+		return
+	}
+	if !canSetMode(key, c.nick, change, msg.param(2)) {
+		c.numeric("482", target, "You're not channel operator")
+		return
+	}
+	members := append([]string(nil), cc.Chan.Connected...)
+	if err := setChannelMode(c.nick, key, change, msg.param(2)); err != nil {
+		c.numeric("472", change, err.Error())
+		return
+	}
+	ircModeChanged(ircMask(c.nick), key, change, msg.param(2), members)
+}
+
+// ircModeChanged tells the members on IRC that the user with the prefix
+// applied mode to target; members is taken before the change, so a banned
+// member still hears it; must hold dbLock
+func ircModeChanged(prefix string, channelKey string, mode string, target string, members []string) {
+	line := formatIRC("", prefix, "MODE", "#"+channelKey, mode, target)
+	for _, member := range members {
+		if peer, ok := IRCClients[member]; ok {
+			peer.write(line)
+		}
+	}
+}
+
+// topic sends the topic ChanServ keeps for the channel; with always unset,
+// channels without one send nothing
+func (c *ircClient) topic(channelKey string, always bool) {
+	cc, ok := ChatChannels[channelKey]
+	if ok && cc.Chan.Settings != nil && cc.Chan.Settings.Topic != "" {
+		c.numeric("332", "#"+channelKey, cc.Chan.Settings.Topic)
+	} else if always {
+		c.numeric("331", "#"+channelKey, "No topic is set")
+	}
+}
+
+// ircTopic tells the channel's IRC members its topic changed; must hold dbLock
+func ircTopic(channelKey string) {
+	line := formatIRC("", servicesMask(chanServ), "TOPIC", "#"+channelKey, ChatChannels[channelKey].Chan.Settings.Topic)
+	for _, member := range ChatChannels[channelKey].Chan.Connected {
+		if c, ok := IRCClients[member]; ok {
+			c.write(line)
+		}
+	}
+}
+
+// names lists the channel's members with their status prefixes; clients
+// without multi-prefix only get the highest
+func (c *ircClient) names(channelKey string) {
+	if cc, ok := ChatChannels[channelKey]; ok {
+		var names []string
+		for _, member := range cc.Chan.Connected {
+			prefix := statusPrefixes(channelKey, member)
+			if prefix != "" && !c.caps["multi-prefix"] {
+				prefix = prefix[:1]
+			}
+			names = append(names, prefix+member)
+		}
+		c.numeric("353", "=", "#"+channelKey, strings.Join(names, " "))
+	}
+	c.numeric("366", "#"+channelKey, "End of /NAMES list")
+}
+
+// privmsg stores a PRIVMSG or NOTICE as a Chat; the chat model has no user
+// notices, so both are delivered as chats
+func (c *ircClient) privmsg(msg ircMessage) {
+	target, text := msg.param(0), msg.param(1)
+	if target == "" {
+		c.numeric("411", "No recipient given ("+msg.Command+")")
+		return
+	}
+	if text == "" {
+		c.numeric("412", "No text to send")
+		return
+	}
+	if strings.EqualFold(target, nickServ) {
+		// commands hold passwords, so they are never stored as chats
+		c.nickserv(text)
+		return
+	}
+	if strings.EqualFold(target, chanServ) {
+		c.chanserv(text)
+		return
+	}
+	if len(text) > maxMessageLength {
+		c.numeric("417", "Input line was too long")
+		return
+	}
+	if wait := ircFlood(c.nick); wait > 0 {
+		c.numeric("404", target, "Cannot send to "+target+", rate limited for "+wait.Round(time.Second).String())
+		return
+	}
+	chat := Chat{Timestamp: time.Now().Unix(), Sender: c.nick, Text: text}
+	if strings.HasPrefix(target, "#") {
+		key := target[1:]
+		if _, ok := ChatChannels[key]; !ok {
+			c.numeric("403", target, "No such channel")
+			return
+		}
+		if Users[c.nick].Connection != key {
+			c.numeric("404", target, "Cannot send to channel")
+			return
+		}
+		if ChatChannels[key].Chan.Archived {
+			c.numeric("404", target, "Cannot send to channel (archived)")
+			return
+		}
+		if moderated(key, c.nick) {
+			c.numeric("404", target, "Cannot send to channel (+m)")
+			return
+		}
+		chat.Receiver = target
+		metrics.messages.inc(key)
+	} else {
+		if _, ok := Users[target]; !ok {
+			c.numeric("401", target, "No such nick/channel")
+			return
+		}
+		if peer, ok := IRCClients[target]; ok && peer.away != "" && msg.Command == "PRIVMSG" {
+			c.numeric("301", target, peer.away)
+		}
+		chat.Receiver = "@" + target
+		metrics.messages.inc("@pm")
+	}
+	storeChat(chat)
+}
+
+// ircFlood applies the /chat/send rate limit to a message from key, muting
+// and killing flooders just like rateLimitRequests; must hold dbLock
+func ircFlood(key string) time.Duration {
+	if wait := mutedFor(key); wait > 0 {
+		return wait
+	}
+	now := time.Now()
+	limiter.Lock()
+	wait := take("user "+key+" /chat/send", RateLimits["/chat/send"], now)
+	kill := wait > 0 && strike(key, now)
+	limiter.Unlock()
+	if kill {
+		adminKill("flood protection", key, "Excess flood")
+	}
+	return wait
+}
+
+// formatChat turns chat into a PRIVMSG, or a NOTICE for server notices,
+// tagged with whatever the client negotiated; batch is the batch it is part
+// of, if any
+func (c *ircClient) formatChat(chat Chat, batch string) string {
+	var tags []string
+	if batch != "" {
+		tags = append(tags, "batch="+batch)
+	}
+	if c.caps["server-time"] {
+		tags = append(tags, "time="+time.Unix(chat.Timestamp, 0).UTC().Format(ircTimeFormat))
+	}
+	if c.caps["message-tags"] && chat.ID > 0 {
+		tags = append(tags, "msgid="+strconv.FormatInt(chat.ID, 10))
+	}
+	prefix, command := ircMask(chat.Sender), "PRIVMSG"
+	if chat.Sender == serverName {
+		prefix = serverDisplayName
+	}
+	if chat.Kind == chatKindNotice {
+		command = "NOTICE"
+	}
+	return formatIRC(strings.Join(tags, ";"), prefix, command, strings.TrimPrefix(chat.Receiver, "@"), chat.Text)
+}
+
+// deliverIRC hands a chat that was just stored to the IRC clients it is for:
+// the members of its channel or its receiver, and its sender if they asked
+// for echo-message; must hold dbLock
+func deliverIRC(chat Chat) {
+	var to []string
+	if string(chat.Receiver[0]) == "#" {
+		to = ChatChannels[chat.Receiver[1:]].Chan.Connected
+	} else {
+		to = []string{chat.Receiver[1:]}
+		if chat.Sender != chat.Receiver[1:] {
+			to = append(to, chat.Sender)
+		}
+	}
+	for _, key := range to {
+		c, ok := IRCClients[key]
+		if !ok || (key == chat.Sender && !c.caps["echo-message"]) {
+			continue
+		}
+		c.write(c.formatChat(chat, ""))
+	}
+}
+
+func (c *ircClient) setAway(text string) {
+	c.away = text
+	line := formatIRC("", ircMask(c.nick), "AWAY")
+	if text == "" {
+		c.numeric("305", "You are no longer marked as being away")
+	} else {
+		line = formatIRC("", ircMask(c.nick), "AWAY", text)
+		c.numeric("306", "You have been marked as being away")
+	}
+	for _, peer := range c.peers() {
+		if peer.caps["away-notify"] {
+			peer.write(line)
+		}
+	}
+}
+
+// notifyAccount tells peers that asked for account-notify which account the
+// client is logged in to
+func (c *ircClient) notifyAccount() {
+	account := c.account
+	if account == "" {
+		account = "*"
+	}
+	line := formatIRC("", ircMask(c.nick), "ACCOUNT", account)
+	for _, peer := range c.peers() {
+		if peer.caps["account-notify"] {
+			peer.write(line)
+		}
+	}
+}
+
+// history is every chat between the client and target, a channel or a user,
+// oldest first
+func (c *ircClient) history(target string) ([]Chat, bool) {
+	if strings.HasPrefix(target, "#") {
+		cc, ok := ChatChannels[target[1:]]
+		if !ok {
+			return nil, false
+		}
+		return cc.Chats, true
+	}
+	if _, ok := Users[target]; !ok {
+		return nil, false
+	}
+	chats := append([]Chat(nil), PrivateMessages[c.nick][target]...)
+	if target != c.nick {
+		chats = append(chats, PrivateMessages[target][c.nick]...)
+	}
+	sort.SliceStable(chats, func(i, j int) bool {
+		if chats[i].Timestamp != chats[j].Timestamp {
+			return chats[i].Timestamp < chats[j].Timestamp
+		}
+		return chats[i].ID < chats[j].ID
+	})
+	return chats, true
+}
+
+// compareChat compares chat with ref, a msgid=ID or timestamp=T reference,
+// returning -1, 0 or 1; chats from before IDs existed compare as older than
+// every msgid
+func compareChat(chat Chat, ref string) (int, bool) {
+	kind, val, _ := strings.Cut(ref, "=")
+	switch kind {
+	case "msgid":
+		id, err := strconv.ParseInt(val, 10, 64)
+		return cmp.Compare(chat.ID, id), err == nil
+	case "timestamp":
+		t, err := time.Parse(time.RFC3339, val)
+		return cmp.Compare(chat.Timestamp, t.Unix()), err == nil
+	}
+	return 0, false
+}
+
+// CHATHISTORY LATEST|BEFORE|AFTER <target> <*|msgid=ID|timestamp=T> <limit>
+func (c *ircClient) chathistory(msg ircMessage) {
+	fail := func(code string, text string) {
+		c.write(formatIRC("", serverDisplayName, "FAIL", "CHATHISTORY", code, msg.param(0), msg.param(1), text))
+	}
+	sub, target, ref := strings.ToUpper(msg.param(0)), msg.param(1), msg.param(2)
+	if sub != "LATEST" && sub != "BEFORE" && sub != "AFTER" {
+		fail("INVALID_PARAMS", "Unknown subcommand")
+		return
+	}
+	if _, ok := compareChat(Chat{}, ref); !ok && !(sub == "LATEST" && ref == "*") {
+		fail("INVALID_PARAMS", "Unknown message reference "+ref)
+		return
+	}
+	limit, err := strconv.Atoi(msg.param(3))
+	if err != nil || limit <= 0 {
+		fail("INVALID_PARAMS", "Limit must be a positive number")
+		return
+	}
+	if limit > ircHistoryLimit {
+		limit = ircHistoryLimit
+	}
+	chats, ok := c.history(target)
+	if !ok {
+		fail("INVALID_TARGET", "No such channel or nick")
+		return
+	}
+	var selected []Chat
+	for _, chat := range chats {
+		order, _ := compareChat(chat, ref)
+		if (sub == "BEFORE" && order < 0) || (sub != "BEFORE" && (order > 0 || ref == "*")) {
+			selected = append(selected, chat)
+		}
+	}
+	// AFTER pages forwards from the reference, the others back from the end
+	if sub == "AFTER" && len(selected) > limit {
+		selected = selected[:limit]
+	} else if len(selected) > limit {
+		selected = selected[len(selected)-limit:]
+	}
+	c.sendBatch("chathistory", target, selected)
+}
+
+// sendBatch sends chats, wrapped in a batch if the client supports them
+func (c *ircClient) sendBatch(kind string, target string, chats []Chat) {
+	ref := ""
+	if c.caps["batch"] {
+		ref = newToken()[:8]
+		c.write(formatIRC("", serverDisplayName, "BATCH", "+"+ref, kind, target))
+	}
+	for _, chat := range chats {
+		c.write(c.formatChat(chat, ref))
+	}
+	if ref != "" {
+		c.write(formatIRC("", serverDisplayName, "BATCH", "-"+ref))
+	}
+}
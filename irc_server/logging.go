@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// requestIDHeader carries the request ID to and from clients; one the client
+// sends is kept, so its logs and ours can be matched up
+const requestIDHeader = "X-Request-ID"
+
+type loggerKey struct{}
+
+// newLogger builds the server's logger: format is json, or text for logfmt
+func newLogger(w io.Writer, format string) (*slog.Logger, error) {
+	opts := &slog.HandlerOptions{Level: &logLevel}
+	switch format {
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	case "text", "logfmt":
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	}
+	return nil, fmt.Errorf("error: newLogger, unknown log format %q, use text or json", format)
+}
+
+// openLogOutput opens name for appending, where "" and "-" mean stderr
+func openLogOutput(name string) (io.Writer, error) {
+	if name == "" || name == "-" {
+		return os.Stderr, nil
+	}
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0660)
+	if err != nil {
+		return nil, fmt.Errorf("error: openLogOutput, opening %s: %s", name, err)
+	}
+	return f, nil
+}
+
+// reqLogger is the logger for r, which tags every line with its request ID
+func reqLogger(r *http.Request) *slog.Logger {
+	if logger, ok := r.Context().Value(loggerKey{}).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
+
+// fatal logs err and stops the server
+func fatal(msg string, err error) {
+	slog.Error(msg, "err", err)
+	os.Exit(1)
+}
+
+// logRequests gives every request an ID, echoes it in the response headers,
+// hands handlers a logger tagged with it and logs the request once it is done
+func logRequests(next http.Handler) http.Handler {
+	return logRequestsAs(next, requestUser)
+}
+
+// logHealthRequests is logRequests for the health checks, which must answer
+// while dbLock is held, so it only names users by their certificate
+func logHealthRequests(next http.Handler) http.Handler {
+	return logRequestsAs(next, certUser)
+}
+
+// logRequestsAs logs requests with user naming who they come from
+func logRequestsAs(next http.Handler, user func(*http.Request) string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if id == "" || len(id) > 64 {
+			id = newToken()
+		}
+		w.Header().Set(requestIDHeader, id)
+		logger := slog.Default().With("request_id", id)
+		r = r.WithContext(context.WithValue(r.Context(), loggerKey{}, logger))
+		route := r.URL.Path
+		if cur := mux.CurrentRoute(r); cur != nil {
+			if tmpl, err := cur.GetPathTemplate(); err == nil {
+				route = tmpl
+			}
+		}
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, code: http.StatusOK}
+		next.ServeHTTP(rec, r)
+		level := slog.LevelDebug
+		if rec.code >= 500 {
+			level = slog.LevelError
+		} else if rec.code >= 400 {
+			level = slog.LevelInfo
+		}
+		logger.Log(r.Context(), level, "request",
+			"method", r.Method,
+			"route", route,
+			"status", rec.code,
+			"duration_ms", time.Since(start).Milliseconds(),
+			"remote", r.RemoteAddr,
+			"user", user(r))
+	})
+}
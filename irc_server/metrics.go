@@ -0,0 +1,219 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// latencyBuckets are the upper bounds, in seconds, of the request latency
+// histogram buckets
+var latencyBuckets = []float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5}
+
+// counterVec struct is a counter with labels, keyed by the label values
+type counterVec struct {
+	name   string
+	help   string
+	labels []string
+	values map[string]float64
+}
+
+// histogramVec struct is a histogram with labels, keyed by the label values
+type histogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets map[string][]uint64
+	sums    map[string]float64
+	counts  map[string]uint64
+}
+
+// metrics holds every counter and histogram; gauges are read from the db when
+// /metrics is scraped
+var metrics = struct {
+	sync.Mutex
+	requests *counterVec
+	messages *counterVec
+	polls    *counterVec
+	latency  *histogramVec
+}{
+	requests: &counterVec{
+		name:   "irc_http_requests_total",
+		help:   "HTTP requests handled, by route, method and status code.",
+		labels: []string{"route", "method", "code"},
+		values: make(map[string]float64),
+	},
+	messages: &counterVec{
+		name:   "irc_messages_sent_total",
+		help:   "Chats sent, by channel, with private messages under channel \"@pm\".",
+		labels: []string{"channel"},
+		values: make(map[string]float64),
+	},
+	polls: &counterVec{
+		name:   "irc_recv_polls_total",
+		help:   "Polls of /chat/recv, by kind (channel or pm).",
+		labels: []string{"kind"},
+		values: make(map[string]float64),
+	},
+	latency: &histogramVec{
+		name:    "irc_http_request_duration_seconds",
+		help:    "HTTP request latency, by route.",
+		labels:  []string{"route"},
+		buckets: make(map[string][]uint64),
+		sums:    make(map[string]float64),
+		counts:  make(map[string]uint64),
+	},
+}
+
+// label values are joined with a byte that cannot appear in them
+const labelSep = "\xff"
+
+func (c *counterVec) inc(values ...string) {
+	metrics.Lock()
+	c.values[strings.Join(values, labelSep)]++
+	metrics.Unlock()
+}
+
+func (h *histogramVec) observe(v float64, values ...string) {
+	metrics.Lock()
+	key := strings.Join(values, labelSep)
+	if _, ok := h.buckets[key]; !ok {
+		h.buckets[key] = make([]uint64, len(latencyBuckets))
+	}
+	for i, bound := range latencyBuckets {
+		if v <= bound {
+			h.buckets[key][i]++
+		}
+	}
+	h.sums[key] += v
+	h.counts[key]++
+	metrics.Unlock()
+}
+
+func formatLabels(names []string, key string, extra ...string) string {
+	var pairs []string
+	if len(names) > 0 {
+		for i, v := range strings.Split(key, labelSep) {
+			pairs = append(pairs, names[i]+"="+strconv.Quote(v))
+		}
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+"="+strconv.Quote(extra[i+1]))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (c *counterVec) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	for _, k := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %g\n", c.name, formatLabels(c.labels, k), c.values[k])
+	}
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	for _, k := range sortedKeys(h.sums) {
+		for i, bound := range latencyBuckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, k, "le", strconv.FormatFloat(bound, 'g', -1, 64)), h.buckets[k][i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, k, "le", "+Inf"), h.counts[k])
+		fmt.Fprintf(w, "%s_sum%s %g\n", h.name, formatLabels(h.labels, k), h.sums[k])
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, k), h.counts[k])
+	}
+}
+
+func writeGauge(w io.Writer, name string, help string, values map[string]float64, label string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", name, help, name)
+	for _, k := range sortedKeys(values) {
+		if label == "" {
+			fmt.Fprintf(w, "%s %g\n", name, values[k])
+		} else {
+			fmt.Fprintf(w, "%s%s %g\n", name, formatLabels([]string{label}, k), values[k])
+		}
+	}
+}
+
+// statusRecorder struct remembers the status code a handler wrote
+type statusRecorder struct {
+	http.ResponseWriter
+	code int
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	r.code = code
+	r.ResponseWriter.WriteHeader(code)
+}
+
+// instrumentRequests counts every request and times it by route template, so
+// /user/{identifier} is one series however many users there are
+func instrumentRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := "unknown"
+		if cur := mux.CurrentRoute(r); cur != nil {
+			if tmpl, err := cur.GetPathTemplate(); err == nil {
+				route = tmpl
+			}
+		}
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, code: http.StatusOK}
+		next.ServeHTTP(rec, r)
+		metrics.latency.observe(time.Since(start).Seconds(), route)
+		metrics.requests.inc(route, r.Method, strconv.Itoa(rec.code))
+	})
+}
+
+// GET /metrics in the Prometheus text format; runs under dbLock like every
+// other handler, so the gauges are consistent with each other
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	metrics.Lock()
+	metrics.requests.write(w)
+	metrics.messages.write(w)
+	metrics.polls.write(w)
+	metrics.latency.write(w)
+	metrics.Unlock()
+
+	writeGauge(w, "irc_users_registered", "Users in the db.", map[string]float64{"": float64(len(Users))}, "")
+	writeGauge(w, "irc_users_online", "Users who polled within the online timeout.", map[string]float64{"": float64(len(onlineUsers()))}, "")
+	writeGauge(w, "irc_channels", "Channels in the db.", map[string]float64{"": float64(len(ChatChannels))}, "")
+	stored := map[string]float64{"channel": 0, "pm": 0}
+	for _, cc := range ChatChannels {
+		stored["channel"] += float64(len(cc.Chats))
+	}
+	for _, inbox := range PrivateMessages {
+		for _, chats := range inbox {
+			stored["pm"] += float64(len(chats))
+		}
+	}
+	writeGauge(w, "irc_stored_chats", "Chats held in memory, by kind (channel or pm).", stored, "kind")
+	files := map[string]float64{}
+	if info, err := os.Stat(snapshotFile); err == nil {
+		files["snapshot"] = float64(info.Size())
+	}
+	if auditFile != nil {
+		if info, err := os.Stat(auditFile.name); err == nil {
+			files["audit"] = float64(info.Size())
+		}
+	}
+	writeGauge(w, "irc_storage_bytes", "Size of the files the server persists to, by file.", files, "file")
+}
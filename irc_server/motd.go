@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// kinds of Chat; a Chat without a Kind was sent by a user
+const (
+	chatKindNotice = "notice"
+)
+
+// motdFile is where the message of the day is read from
+var motdFile = "motd.txt"
+
+// motd is the message of the day shown to users after they log in
+var motd = "Welcome to our IRC!"
+
+// loadMOTD reads the message of the day from name, keeping the default if
+// there is no such file
+func loadMOTD(name string) error {
+	dat, err := ioutil.ReadFile(name)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("error: loadMOTD, reading %s: %s", name, err)
+	}
+	motd = strings.TrimRight(string(dat), "\n")
+	slog.Info("loaded message of the day", "file", name)
+	return nil
+}
+
+// GET /motd
+func readMOTD(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(map[string]string{"motd": motd})
+}
+
+// broadcastNotice sends a server notice to everyone online and returns how
+// many got it
+func broadcastNotice(text string) int {
+	online := onlineUsers()
+	for _, k := range online {
+		deliverNotice(k, text)
+	}
+	return len(online)
+}
+
+// adminNotice announces something like planned maintenance to everyone online
+func adminNotice(actor string, text string) int {
+	n := broadcastNotice(text)
+	audit(actor, "notice", fmt.Sprintf("%d users", n), text)
+	return n
+}
+
+func adminNoticeHandler(w http.ResponseWriter, r *http.Request) {
+	req := readAdminRequest(r)
+	writeAdminResult(w, map[string]int{"recipients": adminNotice(apiActor, req.Text)}, nil)
+}
+
+// POST /admin/motd reloads the message of the day from its file, or replaces
+// it with the text in the body until the next reload
+func adminMOTDHandler(w http.ResponseWriter, r *http.Request) {
+	req := readAdminRequest(r)
+	var err error
+	if req.Text != "" {
+		motd = req.Text
+		audit(apiActor, "motd", "", req.Text)
+	} else {
+		err = loadMOTD(motdFile)
+	}
+	writeAdminResult(w, map[string]string{"motd": motd}, err)
+}
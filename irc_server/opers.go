@@ -0,0 +1,291 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"os"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// OperAccounts map of server operator name to the bcrypt hash of their
+// password, loaded from the operators file
+var OperAccounts = make(map[string]string)
+
+// operSession struct ties a successful OPER to the user who sent it
+type operSession struct {
+	User string
+	Name string
+}
+
+func (s operSession) actor() string {
+	return "oper " + s.Name + " (" + s.User + ")"
+}
+
+// OperSessions map of the token handed out by /oper to its operSession
+var OperSessions = make(map[string]operSession)
+
+// loadOperators reads the operators file, a JSON object mapping operator names
+// to password hashes made with the console's mkpasswd command
+func loadOperators(name string) error {
+	dat, err := ioutil.ReadFile(name)
+	if os.IsNotExist(err) {
+		slog.Info("no operators file, OPER is disabled", "file", name)
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("error: loadOperators, reading %s: %s", name, err)
+	}
+	accounts := make(map[string]string)
+	if err = json.Unmarshal(dat, &accounts); err != nil {
+		return fmt.Errorf("error: loadOperators, unmarshaling %s: %s", name, err)
+	}
+	OperAccounts = accounts
+	slog.Info("loaded server operators", "count", len(accounts), "file", name)
+	return nil
+}
+
+func hashPassword(password string) (string, error) {
+	if password == "" {
+		return "", fmt.Errorf("empty password")
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(hash), err
+}
+
+func newToken() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// operSessionFor returns the session for the request's X-Oper-Token header
+func operSessionFor(r *http.Request) (operSession, bool) {
+	session, ok := OperSessions[r.Header.Get("X-Oper-Token")]
+	return session, ok
+}
+
+// isChannelOperator reports whether the user is one of the channel's
+// Operators; operators that are account names must be logged in to that
+// account, whatever their nickname
+func isChannelOperator(channelKey string, key string) bool {
+	cc, ok := ChatChannels[channelKey]
+	return ok && hasStatus(cc.Chan.Operators, key)
+}
+
+func isBanned(channelKey string, key string) bool {
+	cc, ok := ChatChannels[channelKey]
+	if !ok {
+		return false
+	}
+	for _, banned := range cc.Chan.Banned {
+		if banned == key {
+			return true
+		}
+	}
+	return false
+}
+
+func addUnique(list []string, val string) []string {
+	for _, v := range list {
+		if v == val {
+			return list
+		}
+	}
+	return append(list, val)
+}
+
+func without(list []string, val string) []string {
+	result := []string{}
+	for _, v := range list {
+		if v != val {
+			result = append(result, v)
+		}
+	}
+	return result
+}
+
+// setChannelMode applies +o, -o, +h, -h, +v, -v, +b or -b for target to the
+// channel
+func setChannelMode(actor string, channelKey string, mode string, target string) error {
+	cc, ok := ChatChannels[channelKey]
+	if !ok {
+		return fmt.Errorf("no such channel %q", channelKey)
+	}
+	if target == "" {
+		return fmt.Errorf("mode %s needs a target", mode)
+	}
+	switch mode {
+	case "+o":
+		cc.Chan.Operators = addUnique(cc.Chan.Operators, target)
+	case "-o":
+		cc.Chan.Operators = without(cc.Chan.Operators, target)
+	case "+h":
+		cc.Chan.HalfOps = addUnique(cc.Chan.HalfOps, target)
+	case "-h":
+		cc.Chan.HalfOps = without(cc.Chan.HalfOps, target)
+	case "+v":
+		cc.Chan.Voiced = addUnique(cc.Chan.Voiced, target)
+	case "-v":
+		cc.Chan.Voiced = without(cc.Chan.Voiced, target)
+	case "+b":
+		cc.Chan.Banned = addUnique(cc.Chan.Banned, target)
+		if Users[target].Connection == channelKey {
+			removeFromChannel(target)
+			deliverNotice(target, "You were banned from "+channelKey)
+		}
+	case "-b":
+		cc.Chan.Banned = without(cc.Chan.Banned, target)
+	default:
+		return fmt.Errorf("unknown mode %q, use +o, -o, +h, -h, +v, -v, +b or -b", mode)
+	}
+	audit(actor, "mode "+mode, channelKey, target)
+	return nil
+}
+
+// operRequest is the body accepted by /oper, /mode and the /oper endpoints
+type operRequest struct {
+	User     string `json:"user"`
+	Name     string `json:"name"`
+	Password string `json:"password"`
+	Channel  string `json:"channel"`
+	Mode     string `json:"mode"`
+	Target   string `json:"target"`
+	Reason   string `json:"reason"`
+	Text     string `json:"text"`
+}
+
+func readOperRequest(r *http.Request) operRequest {
+	var req operRequest
+	reqBody, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		reqLogger(r).Error("reading request body", "func", "readOperRequest", "err", err)
+	}
+	json.Unmarshal(reqBody, &req)
+	return req
+}
+
+// OPER: logs the user in as a server operator and hands back a token that
+// must be sent as X-Oper-Token with privileged requests. The session is bound
+// to, and audited as, the user the request proves it comes from, never just
+// the user named in the body
+func operLogin(w http.ResponseWriter, r *http.Request) {
+	req := readOperRequest(r)
+	hash, ok := OperAccounts[req.Name]
+	user := provenUser(r)
+	if user == "" || (req.User != "" && req.User != user) {
+		audit(r.RemoteAddr, "oper failed", req.Name, "unidentified "+req.User)
+		http.Error(w, "identify with /identify before /oper", http.StatusForbidden)
+		return
+	}
+	if _, exists := Users[user]; !exists {
+		http.Error(w, "no such user", http.StatusNotFound)
+		return
+	}
+	if !ok || bcrypt.CompareHashAndPassword([]byte(hash), []byte(req.Password)) != nil {
+		audit(user, "oper failed", req.Name, "")
+		http.Error(w, "invalid operator credentials", http.StatusUnauthorized)
+		return
+	}
+	token := newToken()
+	OperSessions[token] = operSession{User: user, Name: req.Name}
+	audit(user, "oper", req.Name, "")
+	json.NewEncoder(w).Encode(map[string]string{"token": token})
+}
+
+// MODE: channel operators may change modes on their own channel, halfops may
+// voice, and server operators may override that on any channel
+func channelMode(w http.ResponseWriter, r *http.Request) {
+	req := readOperRequest(r)
+	actor := req.User
+	if !checkNick(w, r, req.User, false) {
+		return
+	}
+	// operator rights that come from an account need this request to prove it
+	identified := nickOwner(req.User) == "" || httpIdentified(r, req.User)
+	if !identified || !canSetMode(req.Channel, req.User, req.Mode, req.Target) {
+		session, ok := operSessionFor(r)
+		if !ok {
+			http.Error(w, "not a channel operator", http.StatusForbidden)
+			return
+		}
+		actor = session.actor() + " override"
+	}
+	var members []string
+	if cc, ok := ChatChannels[req.Channel]; ok {
+		members = append(members, cc.Chan.Connected...)
+	}
+	if err := setChannelMode(actor, req.Channel, req.Mode, req.Target); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ircModeChanged(ircMask(req.User), req.Channel, req.Mode, req.Target, members)
+	json.NewEncoder(w).Encode(ChatChannels[req.Channel].Chan)
+}
+
+func requireOper(next func(http.ResponseWriter, *http.Request, operSession)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		session, ok := operSessionFor(r)
+		if !ok {
+			http.Error(w, "server operator required", http.StatusForbidden)
+			return
+		}
+		next(w, r, session)
+	}
+}
+
+func operKill(w http.ResponseWriter, r *http.Request, s operSession) {
+	req := readOperRequest(r)
+	writeAdminResult(w, req, adminKill(s.actor(), req.Target, req.Reason))
+}
+
+func operWallops(w http.ResponseWriter, r *http.Request, s operSession) {
+	req := readOperRequest(r)
+	writeAdminResult(w, map[string]int{"recipients": adminWallops(s.actor(), req.Text)}, nil)
+}
+
+// forces the target into the channel, ignoring bans
+func operJoin(w http.ResponseWriter, r *http.Request, s operSession) {
+	req := readOperRequest(r)
+	if _, ok := Users[req.Target]; !ok {
+		writeAdminResult(w, nil, fmt.Errorf("no such user %q", req.Target))
+		return
+	}
+	if _, ok := ChatChannels[req.Channel]; !ok {
+		writeAdminResult(w, nil, fmt.Errorf("no such channel %q", req.Channel))
+		return
+	}
+	joinUser(req.Target, req.Channel)
+	deliverNotice(req.Target, "You were moved to "+req.Channel+" by a server operator")
+	audit(s.actor(), "force join", req.Target, req.Channel)
+	writeAdminResult(w, ChatChannels[req.Channel].Chan, nil)
+}
+
+// forces the target out of whatever channel they are in
+func operPart(w http.ResponseWriter, r *http.Request, s operSession) {
+	req := readOperRequest(r)
+	user, ok := Users[req.Target]
+	if !ok || user.Connection == "" {
+		writeAdminResult(w, nil, fmt.Errorf("%q is not in a channel", req.Target))
+		return
+	}
+	removeFromChannel(req.Target)
+	deliverNotice(req.Target, "You were removed from "+user.Connection+" by a server operator")
+	audit(s.actor(), "force part", req.Target, user.Connection)
+	writeAdminResult(w, req, nil)
+}
+
+// adds /oper, /mode and the privileged /oper endpoints
+func handleOperRequests(router *mux.Router) {
+	router.HandleFunc("/oper", operLogin).Methods("POST")
+	router.HandleFunc("/mode", channelMode).Methods("POST")
+	router.HandleFunc("/oper/kill", requireOper(operKill)).Methods("POST")
+	router.HandleFunc("/oper/wallops", requireOper(operWallops)).Methods("POST")
+	router.HandleFunc("/oper/join", requireOper(operJoin)).Methods("POST")
+	router.HandleFunc("/oper/part", requireOper(operPart)).Methods("POST")
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// rateLimit struct is a token bucket setting: Rate tokens are added per second
+// up to Burst, and every request takes one
+type rateLimit struct {
+	Rate  float64 `json:"rate"`
+	Burst float64 `json:"burst"`
+}
+
+// RateLimits map of route path template to the limit applied to it, both per
+// remote IP and per user; routes not listed get the "default" entry
+var RateLimits = map[string]rateLimit{
+	"default":                            {Rate: 20, Burst: 40},
+	"/chat/send":                         {Rate: 2, Burst: 10},
+	"/chat/recv/{identifier}/{lastrecv}": {Rate: 20, Burst: 40},
+	"/user":                              {Rate: 0.2, Burst: 3},
+	"/channel":                           {Rate: 0.2, Burst: 3},
+	"/oper":                              {Rate: 0.1, Burst: 3},
+	"/nickserv/register":                 {Rate: 0.1, Burst: 3},
+	"/nickserv/identify":                 {Rate: 0.1, Burst: 5},
+	"/nickserv/ghost":                    {Rate: 0.1, Burst: 3},
+	"/nickserv/recover":                  {Rate: 0.1, Burst: 3},
+	"/chanserv":                          {Rate: 0.5, Burst: 5},
+	"/channel/{identifier}/delete":       {Rate: 0.1, Burst: 3},
+	"/channel/{identifier}/rename":       {Rate: 0.1, Burst: 3},
+}
+
+// floodPolicy struct is how the server punishes users who keep hitting their
+// rate limits: MuteAfter strikes within Window mutes them for MuteFor, and KillAfter
+// strikes within Window ends their session
+type floodPolicy struct {
+	Window    time.Duration
+	MuteAfter int
+	MuteFor   time.Duration
+	KillAfter int
+}
+
+var flood = floodPolicy{
+	Window:    time.Minute,
+	MuteAfter: 10,
+	MuteFor:   time.Minute,
+	KillAfter: 50,
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// floodState struct tracks a single user's recent strikes and mute
+type floodState struct {
+	strikes    []time.Time
+	mutedUntil time.Time
+}
+
+// limiter holds every bucket and flood state; it has its own lock so IP
+// limits are checked outside of dbLock, which is only taken to check the
+// NickServ token of a request that sends one
+var limiter = struct {
+	sync.Mutex
+	buckets map[string]*bucket
+	flood   map[string]*floodState
+}{
+	buckets: make(map[string]*bucket),
+	flood:   make(map[string]*floodState),
+}
+
+// loadRateLimits merges the JSON object in name, in the same shape as
+// RateLimits, over the built in limits
+func loadRateLimits(name string) error {
+	dat, err := ioutil.ReadFile(name)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("error: loadRateLimits, reading %s: %s", name, err)
+	}
+	limits := make(map[string]rateLimit)
+	if err = json.Unmarshal(dat, &limits); err != nil {
+		return fmt.Errorf("error: loadRateLimits, unmarshaling %s: %s", name, err)
+	}
+	for k, v := range limits {
+		RateLimits[k] = v
+	}
+	slog.Info("loaded rate limits", "count", len(limits), "file", name)
+	return nil
+}
+
+// take removes a token from the bucket for key, returning how long until one
+// is available if there is none now; must hold limiter
+func take(key string, limit rateLimit, now time.Time) time.Duration {
+	b, ok := limiter.buckets[key]
+	if !ok {
+		b = &bucket{tokens: limit.Burst, last: now}
+		limiter.buckets[key] = b
+	}
+	b.tokens = math.Min(limit.Burst, b.tokens+now.Sub(b.last).Seconds()*limit.Rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0
+	}
+	if limit.Rate <= 0 {
+		return time.Hour
+	}
+	return time.Duration((1 - b.tokens) / limit.Rate * float64(time.Second))
+}
+
+// strike records that user was rate limited and returns whether they should
+// now be killed; must hold limiter
+func strike(user string, now time.Time) bool {
+	f, ok := limiter.flood[user]
+	if !ok {
+		f = &floodState{}
+		limiter.flood[user] = f
+	}
+	recent := f.strikes[:0]
+	for _, t := range f.strikes {
+		if now.Sub(t) < flood.Window {
+			recent = append(recent, t)
+		}
+	}
+	f.strikes = append(recent, now)
+	if len(f.strikes) >= flood.KillAfter {
+		delete(limiter.flood, user)
+		return true
+	}
+	if len(f.strikes) >= flood.MuteAfter && now.After(f.mutedUntil) {
+		f.mutedUntil = now.Add(flood.MuteFor)
+		slog.Warn("muting user for flooding", "user", user, "for", flood.MuteFor)
+	}
+	return false
+}
+
+// mutedFor returns how much longer user is muted for flooding, if at all
+func mutedFor(user string) time.Duration {
+	limiter.Lock()
+	defer limiter.Unlock()
+	if f, ok := limiter.flood[user]; ok {
+		if d := time.Until(f.mutedUntil); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
+
+// requestUser is who the request proves it comes from: the client's verified
+// certificate, or an X-Irc-User backed by that user's NickServ token. Anyone
+// can send the header alone, so it must not earn its user strikes, mutes or
+// kills; such requests only count against their IP
+func requestUser(r *http.Request) string {
+	if user := certUser(r); user != "" {
+		return user
+	}
+	user := r.Header.Get("X-Irc-User")
+	if user == "" || r.Header.Get(nickTokenHeader) == "" {
+		return ""
+	}
+	// we run outside lockDB, and only the token needs the db to check
+	dbLock.Lock()
+	defer dbLock.Unlock()
+	if httpIdentified(r, user) {
+		return user
+	}
+	return ""
+}
+
+// certUser is the common name of the client's verified certificate, if any
+func certUser(r *http.Request) string {
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		return r.TLS.VerifiedChains[0][0].Subject.CommonName
+	}
+	return ""
+}
+
+// provenUser is requestUser for handlers, which already hold dbLock
+func provenUser(r *http.Request) string {
+	if user := certUser(r); user != "" {
+		return user
+	}
+	if user := r.Header.Get("X-Irc-User"); user != "" && httpIdentified(r, user) {
+		return user
+	}
+	return ""
+}
+
+func tooManyRequests(w http.ResponseWriter, wait time.Duration, msg string) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	http.Error(w, msg, http.StatusTooManyRequests)
+}
+
+// rateLimitRequests refuses requests over the limit for their route with 429
+// and a Retry-After header, and punishes users who keep doing it
+func rateLimitRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := "default"
+		if cur := mux.CurrentRoute(r); cur != nil {
+			if tmpl, err := cur.GetPathTemplate(); err == nil {
+				route = tmpl
+			}
+		}
+		limit, ok := RateLimits[route]
+		if !ok {
+			limit = RateLimits["default"]
+		}
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			host = r.RemoteAddr
+		}
+		now := time.Now()
+		limiter.Lock()
+		wait := take("ip "+host+" "+route, limit, now)
+		limiter.Unlock()
+		if wait > 0 && certUser(r) == "" && r.Header.Get(nickTokenHeader) == "" {
+			// no one to strike, so the flood is refused without the db
+			tooManyRequests(w, wait, "rate limit exceeded")
+			return
+		}
+		// checking a NickServ token takes dbLock
+		user := requestUser(r)
+		limiter.Lock()
+		if user != "" {
+			if userWait := take("user "+user+" "+route, limit, now); userWait > wait {
+				wait = userWait
+			}
+		}
+		kill := false
+		if wait > 0 && user != "" {
+			kill = strike(user, now)
+		}
+		limiter.Unlock()
+		if kill {
+			dbLock.Lock()
+			adminKill("flood protection", user, "Excess flood")
+			dbLock.Unlock()
+		}
+		if wait > 0 {
+			tooManyRequests(w, wait, "rate limit exceeded")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// pruneRateLimits forgets full buckets and expired flood state every minute,
+// so the maps only hold clients that were active recently
+func pruneRateLimits() {
+	for range time.Tick(time.Minute) {
+		now := time.Now()
+		limiter.Lock()
+		for k, b := range limiter.buckets {
+			if now.Sub(b.last) > 10*time.Minute {
+				delete(limiter.buckets, k)
+			}
+		}
+		for k, f := range limiter.flood {
+			if now.After(f.mutedUntil) && (len(f.strikes) == 0 || now.Sub(f.strikes[len(f.strikes)-1]) > flood.Window) {
+				delete(limiter.flood, k)
+			}
+		}
+		limiter.Unlock()
+	}
+}
@@ -1,13 +1,20 @@
 package main
 
 import (
+	"bufio"
+	"crypto/tls"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"log/slog"
 	"net/http"
 	"os"
+	"sort"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 )
@@ -25,14 +32,27 @@ type Channel struct {
 	ID          int      `json:"id"`
 	Operators   []string `json:"operators"`
 	Connected   []string `json:"connected"`
+	Banned      []string `json:"banned,omitempty"`
+	Creator     string   `json:"creator,omitempty"`
+	HalfOps     []string `json:"halfops,omitempty"`
+	Voiced      []string `json:"voiced,omitempty"`
+	// Founder is the account that registered the channel with ChanServ, and
+	// Access maps other accounts to their access level on it
+	Founder  string            `json:"founder,omitempty"`
+	Access   map[string]string `json:"access,omitempty"`
+	Settings *ChannelSettings  `json:"settings,omitempty"`
+	// Archived channels are read-only
+	Archived bool `json:"archived,omitempty"`
 }
 
 // Chat struct that contains the text, timestamp, and other information about chat
 type Chat struct {
+	ID        int64  `json:"id,omitempty"`
 	Timestamp int64  `json:"timestamp"`
 	Sender    string `json:"sender"`
 	Receiver  string `json:"receiver"`
 	Text      string `json:"text"`
+	Kind      string `json:"kind,omitempty"`
 }
 
 // ChatChannel struct, wrapping a single Channel with many Chats together
@@ -76,14 +96,20 @@ func (c Channel) toString() string {
 	return c.ChannelName + strconv.Itoa(c.ID)
 }
 
+// validName reports whether name can be used as a nickname or channel name;
+// names end up in URL paths, and the first character of a receiver or
+// recv identifier says what kind it is
+func validName(name string) bool {
+	return name != "" && len(name) <= maxNickLength &&
+		!strings.ContainsAny(name, " /") && !strings.ContainsAny(name[:1], "#@+-")
+}
+
 func homePage(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "Welcome to our IRC!")
-	fmt.Println("Endpoint: /")
 }
 
 func readAllChatChannels(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(ChatChannels)
-	fmt.Println("Endpoint: /chatchannels")
 }
 
 func readChatChannel(w http.ResponseWriter, r *http.Request) {
@@ -94,7 +120,6 @@ func readChatChannel(w http.ResponseWriter, r *http.Request) {
 
 func readAllPrivateMessages(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(PrivateMessages)
-	fmt.Println("Endpoint: /privatemessages")
 }
 
 func readPrivateMessages(w http.ResponseWriter, r *http.Request) {
@@ -102,17 +127,26 @@ func readPrivateMessages(w http.ResponseWriter, r *http.Request) {
 	from := vars["from"]
 	to := vars["to"]
 	json.NewEncoder(w).Encode(PrivateMessages[from][to])
-	fmt.Println("Endpoint: /privatemessages/{from}/{to}")
 }
 
 func createChatChannel(w http.ResponseWriter, r *http.Request) {
 	var name string
 	reqBody, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		log.Printf("error: createChatChannel, reading from request body: %s\n", err)
+		reqLogger(r).Error("reading request body", "func", "createChatChannel", "err", err)
+	}
+	var req Channel
+	json.Unmarshal(reqBody, &req)
+	// only the name, operators and creator come from the client; founders,
+	// access lists and settings are ChanServ's to give out
+	channel := Channel{ChannelName: req.ChannelName, Operators: req.Operators, Connected: []string{}, Creator: req.Creator}
+	if channel.Operators == nil {
+		channel.Operators = []string{}
+	}
+	if !validName(channel.ChannelName) {
+		http.Error(w, fmt.Sprintf("channel name must be 1 to %d characters, without spaces or slashes, not starting with #@+-", maxNickLength), http.StatusBadRequest)
+		return
 	}
-	var channel Channel
-	json.Unmarshal(reqBody, &channel)
 	// check createUser for explanation
 	name = channel.ChannelName
 	if _, ok := ChatChannels[name]; !ok {
@@ -133,8 +167,18 @@ func createChatChannel(w http.ResponseWriter, r *http.Request) {
 			Chats: []Chat{},
 		}
 	}
+	// Creator is whatever the client claims, so the log names who the
+	// request proves it comes from, or where it came from
+	actor := provenUser(r)
+	if actor == "" {
+		actor = r.RemoteAddr
+	}
+	detail := strings.Join(channel.Operators, " ")
+	if channel.Creator != "" && channel.Creator != actor {
+		detail = strings.TrimSpace(detail + " (claimed creator " + channel.Creator + ", unverified)")
+	}
+	audit(actor, "create channel", name, detail)
 	json.NewEncoder(w).Encode(ChatChannels[name].Chan)
-	fmt.Println("Endpoint: /channel")
 }
 
 func readAllChannels(w http.ResponseWriter, r *http.Request) {
@@ -145,24 +189,26 @@ func readAllChannels(w http.ResponseWriter, r *http.Request) {
 		i++
 	}
 	json.NewEncoder(w).Encode(channels)
-	fmt.Println("Endpoint: /channels")
 }
 
 func readChannel(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	key := vars["identifier"]
 	json.NewEncoder(w).Encode(ChatChannels[key].Chan)
-	fmt.Println("Endpoint: /channel/{identifier}")
 }
 
 func createUser(w http.ResponseWriter, r *http.Request) {
 	var name string
 	reqBody, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		log.Printf("error: createUser, reading from request body: %s\n", err)
+		reqLogger(r).Error("reading request body", "func", "createUser", "err", err)
 	}
 	var user User
 	json.Unmarshal(reqBody, &user)
+	if !validName(user.Nickname) || reservedNick(user.Nickname) {
+		http.Error(w, fmt.Sprintf("nickname must be 1 to %d characters, without spaces or slashes, not starting with #@+-", maxNickLength), http.StatusBadRequest)
+		return
+	}
 	name = user.Nickname
 	if _, ok := Users[name]; !ok {
 		/* check if the user exists in the map
@@ -185,89 +231,168 @@ func createUser(w http.ResponseWriter, r *http.Request) {
 		name += strconv.Itoa(i)
 		Users[name] = user
 	}
+	addPrivateMessages(name)
+	json.NewEncoder(w).Encode(Users[name])
+}
+
+// addPrivateMessages gives a new user their row and column of PrivateMessages
+func addPrivateMessages(name string) {
 	PrivateMessages[name] = make(map[string][]Chat)
 	for k := range PrivateMessages {
 		PrivateMessages[name][k] = []Chat{}
 		PrivateMessages[k][name] = []Chat{}
 	}
-	json.NewEncoder(w).Encode(Users[name])
-	fmt.Println("Endpoint: /user")
 }
 
 func readAllUsers(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(Users)
-	fmt.Println("Endpoint: /users")
 }
 
 func readUser(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	key := vars["identifier"]
 	json.NewEncoder(w).Encode(Users[key])
-	fmt.Println("Endpoint: /user/{identifier}")
 }
 
 func joinChannel(w http.ResponseWriter, r *http.Request) {
 	reqBody, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		log.Printf("error: joinChannel, reading from request body: %s\n", err)
+		reqLogger(r).Error("reading request body", "func", "joinChannel", "err", err)
 	}
 	// get JSON data
 	dat := make(map[string]string)
 	json.Unmarshal(reqBody, &dat)
-	user := Users[dat["user"]]
-	newChannel := ChatChannels[dat["channel"]].Chan
-	if user.Connection == dat["channel"] {
-		// check if user is trying to join the same channel as they in already
-		json.NewEncoder(w).Encode(ChatChannels[dat["channel"]].Chan)
+	if _, ok := Users[dat["user"]]; !ok {
+		http.Error(w, "no such user", http.StatusNotFound)
 		return
-	} else if user.Connection != "" {
-		// if the user was connected to a channel before this one
-		// remove user from list of users connected to old channel,
-		// and assign copy back to db
-		oldChannel := ChatChannels[user.Connection].Chan
-		// TODO: may be beneficial to move this into its own function
-		for i, val := range oldChannel.Connected {
-			if val == user.toString() {
-				// https://github.com/golang/go/wiki/SliceTricks#delete-without-preserving-order
-				// deleting user from array without preserving order
-				userCount := len(oldChannel.Connected)
-				oldChannel.Connected[i] = oldChannel.Connected[userCount-1]
-				oldChannel.Connected = oldChannel.Connected[:userCount-1]
-				break
-			}
+	}
+	if _, ok := ChatChannels[dat["channel"]]; !ok {
+		http.Error(w, "no such channel", http.StatusNotFound)
+		return
+	}
+	if !checkNick(w, r, dat["user"], false) {
+		return
+	}
+	if isBanned(dat["channel"], dat["user"]) {
+		http.Error(w, "banned from channel", http.StatusForbidden)
+		return
+	}
+	if restricted(dat["channel"], dat["user"]) {
+		http.Error(w, "channel is restricted to its access list", http.StatusForbidden)
+		return
+	}
+	if old := Users[dat["user"]].Connection; old != dat["channel"] {
+		if old != "" {
+			audit(dat["user"], "part", old, "")
 		}
-		ChatChannels[user.Connection].Chan = oldChannel
+		audit(dat["user"], "join", dat["channel"], "")
+	}
+	joinUser(dat["user"], dat["channel"])
+	json.NewEncoder(w).Encode(ChatChannels[dat["channel"]].Chan)
+}
+
+// joinUser moves the user into the channel, leaving whichever channel they
+// were in before; both must exist
+func joinUser(key string, channelKey string) {
+	if Users[key].Connection == channelKey {
+		// check if user is trying to join the same channel as they in already
+		return
 	}
+	// if the user was connected to a channel before this one, remove user from
+	// list of users connected to old channel
+	removeFromChannel(key)
+	user := Users[key]
+	newChannel := ChatChannels[channelKey].Chan
 	// change user's channel connection, and assign the copy back to db
 	user.Connection = newChannel.toString()
-	Users[dat["user"]] = user
+	Users[key] = user
 	// add user to list of users connected to new channel,
 	// and assign copy back to db
 	newChannel.Connected = append(newChannel.Connected, user.toString())
-	ChatChannels[dat["channel"]].Chan = newChannel
-	json.NewEncoder(w).Encode(ChatChannels[dat["channel"]].Chan)
-	fmt.Println("Endpoint: /join")
+	ChatChannels[channelKey].Chan = newChannel
+	ircJoined(key, channelKey)
+	autoStatus(key, channelKey)
+}
+
+// chatSeq is the ID of the newest Chat; unlike timestamps, IDs tell apart
+// chats sent in the same second
+var chatSeq int64
+
+// storeChat gives chat the next ID, files it under its receiver, which must
+// exist, and hands it to the IRC listener
+func storeChat(chat Chat) Chat {
+	chatSeq++
+	chat.ID = chatSeq
+	if string(chat.Receiver[0]) == "#" {
+		ChatChannels[chat.Receiver[1:]].Chats = append(
+			ChatChannels[chat.Receiver[1:]].Chats, chat)
+	} else {
+		if _, ok := PrivateMessages[chat.Sender]; !ok {
+			PrivateMessages[chat.Sender] = make(map[string][]Chat)
+		}
+		// PM[FROM][TO] = append(PM[FROM][TO], chat)
+		PrivateMessages[chat.Sender][chat.Receiver[1:]] = append(
+			PrivateMessages[chat.Sender][chat.Receiver[1:]], chat)
+	}
+	deliverIRC(chat)
+	return chat
 }
 
 func sendChat(w http.ResponseWriter, r *http.Request) {
 	reqBody, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		log.Printf("error: sendChannelChat, reading from request body: %s\n", err)
+		reqLogger(r).Error("reading request body", "func", "sendChannelChat", "err", err)
 	}
 	var chat Chat
 	json.Unmarshal(reqBody, &chat)
+	if reason, ok := Killed[chat.Sender]; ok {
+		http.Error(w, "killed: "+reason, http.StatusForbidden)
+		return
+	}
+	if wait := mutedFor(chat.Sender); wait > 0 {
+		tooManyRequests(w, wait, "muted for flooding")
+		return
+	}
+	if !checkNick(w, r, chat.Sender, false) {
+		return
+	}
+	if len(chat.Receiver) < 2 {
+		http.Error(w, "no receiver", http.StatusBadRequest)
+		return
+	}
+	if len(chat.Text) > maxMessageLength {
+		http.Error(w, fmt.Sprintf("message longer than %d bytes", maxMessageLength), http.StatusBadRequest)
+		return
+	}
+	if _, ok := ChatChannels[chat.Receiver[1:]]; string(chat.Receiver[0]) == "#" && !ok {
+		http.Error(w, "no such channel", http.StatusNotFound)
+		return
+	}
+	if chat.Receiver == "@"+nickServ || chat.Receiver == "@"+chanServ {
+		http.Error(w, "services commands are sent to the /nickserv and /chanserv endpoints", http.StatusBadRequest)
+		return
+	}
+	if string(chat.Receiver[0]) == "#" && ChatChannels[chat.Receiver[1:]].Chan.Archived {
+		http.Error(w, "channel is archived", http.StatusForbidden)
+		return
+	}
+	if string(chat.Receiver[0]) == "#" && moderated(chat.Receiver[1:], chat.Sender) {
+		http.Error(w, "channel is moderated", http.StatusForbidden)
+		return
+	}
+	if _, ok := Users[chat.Receiver[1:]]; string(chat.Receiver[0]) == "@" && !ok {
+		http.Error(w, "no such user", http.StatusNotFound)
+		return
+	}
 	if string(chat.Receiver[0]) == "#" {
-		ChatChannels[chat.Receiver[1:]].Chats = append(
-			ChatChannels[chat.Receiver[1:]].Chats, chat)
+		chat = storeChat(chat)
+		metrics.messages.inc(chat.Receiver[1:])
 	} else if string(chat.Receiver[0]) == "@" {
-		// PM[FROM][TO] = append(PM[FROM][TO], chat)
-		// TODO: may be more efficient to copy over array rather than accessing map this many times
-		PrivateMessages[chat.Sender][chat.Receiver[1:]] = append(
-			PrivateMessages[chat.Sender][chat.Receiver[1:]], chat)
+		metrics.messages.inc("@pm")
+		chat = storeChat(chat)
 	}
 	// TODO: maybe automatically return all the chats that have occurred since then?
 	json.NewEncoder(w).Encode(chat)
-	fmt.Println("Endpoint: /chat/send/")
 }
 
 // programmer will send the timestamp of the lastrecv'd message
@@ -278,203 +403,97 @@ func recvChat(w http.ResponseWriter, r *http.Request) {
 	key := vars["identifier"]
 	last, err := strconv.ParseInt(vars["lastrecv"], 10, 64)
 	if err != nil {
-		log.Printf("error: recvChannelChat, parsing last recv'd time as int64: %s\n", err)
+		reqLogger(r).Warn("parsing last recv'd time as int64", "func", "recvChat", "err", err)
 	}
 	var chats []Chat
+	if len(key) < 2 {
+		http.Error(w, "no identifier", http.StatusBadRequest)
+		return
+	}
+	if _, ok := ChatChannels[key[1:]]; string(key[0]) == "+" && !ok {
+		http.Error(w, "no such channel", http.StatusNotFound)
+		return
+	}
+	if string(key[0]) == "-" {
+		// private message polls double as the client's keepalive
+		if reason, ok := Killed[key[1:]]; ok {
+			delete(Killed, key[1:])
+			http.Error(w, "killed: "+reason, http.StatusForbidden)
+			return
+		}
+		if _, ok := Users[key[1:]]; ok {
+			if !checkNick(w, r, key[1:], true) {
+				return
+			}
+			LastSeen[key[1:]] = time.Now().Unix()
+		}
+	}
+	// clients that know chat IDs poll with ?after=<id>, which unlike
+	// timestamps tells apart chats sent in the same second; IDs from before a
+	// restart that lost the history fall back to the timestamp
+	after, _ := strconv.ParseInt(r.URL.Query().Get("after"), 10, 64)
+	if after > chatSeq {
+		after = 0
+	}
+	newer := func(chat Chat) bool {
+		if after > 0 {
+			return chat.ID > after
+		}
+		return chat.Timestamp > last
+	}
 	if string(key[0]) == "+" {
+		metrics.polls.inc("channel")
 		for _, val := range ChatChannels[key[1:]].Chats {
-			if val.Timestamp > last {
+			if newer(val) {
 				chats = append(chats, val)
 			}
 		}
 	} else if string(key[0]) == "-" {
+		metrics.polls.inc("pm")
 		for k := range PrivateMessages {
 			for _, val := range PrivateMessages[k][key[1:]] {
-				if val.Timestamp > last {
+				if newer(val) {
 					chats = append(chats, val)
 				}
 			}
 		}
+		// oldest first across senders, so the client's last ID is the newest
+		sort.Slice(chats, func(i, j int) bool { return chats[i].ID < chats[j].ID })
 	}
 	json.NewEncoder(w).Encode(chats)
-	fmt.Println("Endpoint: /chat/recv/{identifier}/{lastrecv}")
 }
 
-func exportData() (bool, error) {
-	var inp string
-	var err error
-	var dat []byte
-	fmt.Print("Append or truncate? (a/t) ")
-	fmt.Scan(&inp)
-	if inp == "a" {
-		log.Println("Appending to export files")
-		userF, err := os.OpenFile("users.json", os.O_RDWR|os.O_CREATE, 0770)
-		if err != nil {
-			return false, fmt.Errorf("error: exportData, opening users.json in O_RDWR|O_CREATE: %s", err)
-		}
-		defer userF.Close()
-		dat, err = ioutil.ReadAll(userF)
-		if err != nil {
-			return false, fmt.Errorf("error: exportData, reading all from users.json: %s", err)
-		}
-		// create new scope for tmpUsers to automatically garbage collect
-		// tmpUsers after finished with compiling data to marshaled bytes
-		{
-			var tmpUsers = make(map[string]User)
-			json.Unmarshal(dat, &tmpUsers)
-			for k, v := range Users {
-				if _, ok := tmpUsers[k]; !ok {
-					tmpUsers[k] = v
-				}
-			}
-			dat, err = json.Marshal(tmpUsers)
-			if err != nil {
-				return false, fmt.Errorf("error: exportData, marshaling data from users.json and Users: %s", err)
-			}
-		}
-		_, err = userF.Write(dat)
-		if err != nil {
-			return false, fmt.Errorf("error: exportData, writing data to users.json: %s", err)
-		}
-		chanF, err := os.OpenFile("channels.json", os.O_RDWR|os.O_CREATE, 0770)
-		if err != nil {
-			return false, fmt.Errorf("error: exportData, opening channels.json in O_RDWR|O_CREATE: %s", err)
-		}
-		defer chanF.Close()
-		dat, err = ioutil.ReadAll(chanF)
-		if err != nil {
-			return false, fmt.Errorf("error: exportData, reading all from channels.json: %s", err)
-		}
-		{
-			var tmpChannels = make(map[string]*ChatChannel)
-			json.Unmarshal(dat, &tmpChannels)
-			for k, v := range ChatChannels {
-				if _, ok := tmpChannels[k]; !ok {
-					tmpChannels[k] = v
-				}
-			}
-			dat, err = json.Marshal(tmpChannels)
-			if err != nil {
-				return false, fmt.Errorf("error: exportData, marshaling data from channels.json and ChatChannels: %s", err)
-			}
-		}
-		_, err = chanF.Write(dat)
-		if err != nil {
-			return false, fmt.Errorf("error: exportData, writing data to channels.json: %s", err)
-		}
-		msgF, err := os.OpenFile("messages.json", os.O_RDWR|os.O_CREATE, 0770)
-		if err != nil {
-			return false, fmt.Errorf("error: exportData, opening messages.json in O_RDWR|O_CREATE: %s", err)
-		}
-		dat, err = ioutil.ReadAll(chanF)
-		if err != nil {
-			return false, fmt.Errorf("error: exportData, reading all from messages.json: %s", err)
-		}
-		{
-			var tmpMessages = make(map[string]map[string][]Chat)
-			json.Unmarshal(dat, &tmpMessages)
-			for k0, v0 := range PrivateMessages {
-				tmpMessages[k0] = v0
-				for k1, v1 := range PrivateMessages[k0] {
-					if _, ok := tmpMessages[k0][k1]; !ok {
-						tmpMessages[k0][k1] = v1
-					}
-				}
-			}
-			dat, err = json.Marshal(tmpMessages)
-			if err != nil {
-				return false, fmt.Errorf("error: exportData, marshaling data from messages.json and PrivateMessages: %s", err)
-			}
-		}
-		_, err = msgF.Write(dat)
-		if err != nil {
-			return false, fmt.Errorf("error: exportData, writing data to messages.json: %s", err)
-		}
-		return true, nil
-	}
-	log.Println("Truncating export files")
-	userF, err := os.OpenFile("users.json", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0770)
-	if err != nil {
-		return false, fmt.Errorf("error: exportData, opening users.json in O_RDWR|O_CREATE|O_TRUNC: %s", err)
-	}
-	defer userF.Close()
-	dat, err = json.Marshal(Users)
-	if err != nil {
-		return false, fmt.Errorf("error: exportData, marshaling data from Users: %s", err)
-	}
-	_, err = userF.Write(dat)
-	if err != nil {
-		return false, fmt.Errorf("error: exportData, writing data to users.json: %s", err)
-	}
-	chanF, err := os.OpenFile("channels.json", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0770)
-	if err != nil {
-		return false, fmt.Errorf("error: exportData, opening channels.json in O_RDWR|O_CREATE|O_TRUNC: %s", err)
-	}
-	defer chanF.Close()
-	dat, err = json.Marshal(ChatChannels)
-	if err != nil {
-		return false, fmt.Errorf("error: exportData, marshaling data from ChatChannels: %s", err)
-	}
-	_, err = chanF.Write(dat)
-	if err != nil {
-		return false, fmt.Errorf("error: exportData, writing data to channels.json: %s", err)
-	}
-	msgF, err := os.OpenFile("messages.json", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0770)
-	if err != nil {
-		return false, fmt.Errorf("error: exportData, opening messages.json in O_RDWR|O_CREATE|O_TRUNC: %s", err)
-	}
-	defer msgF.Close()
-	dat, err = json.Marshal(PrivateMessages)
-	if err != nil {
-		return false, fmt.Errorf("error: exportData, marshaling data from PrivateMessages: %s", err)
-	}
-	_, err = msgF.Write(dat)
-	if err != nil {
-		return false, fmt.Errorf("error: exportData, writing data to messages.json: %s", err)
-	}
-	return true, nil
-}
-
-func importData() (bool, error) {
-	var err error
-	var dat []byte
-	userF, err := os.OpenFile("users.json", os.O_RDONLY, 0770)
-	if err != nil {
-		return false, fmt.Errorf("error: importData, opening users.json in O_RDONLY: %s", err)
-	}
-	defer userF.Close()
-	dat, err = ioutil.ReadAll(userF)
-	if err != nil {
-		return false, fmt.Errorf("error: importData, reading from existing users.json: %s", err)
-	}
-	json.Unmarshal(dat, &Users)
-	chanF, err := os.OpenFile("channels.json", os.O_RDONLY, 0770)
-	if err != nil {
-		return false, fmt.Errorf("error: importData, opening channels.json in O_RDONLY: %s", err)
-	}
-	defer chanF.Close()
-	dat, err = ioutil.ReadAll(chanF)
-	if err != nil {
-		return false, fmt.Errorf("error: importData, reading from existing channels.json: %s", err)
-	}
-	json.Unmarshal(dat, &ChatChannels)
-	msgF, err := os.OpenFile("messages.json", os.O_RDONLY, 0770)
-	if err != nil {
-		return false, fmt.Errorf("error: importData, opening messages.json in O_RDONLY: %s", err)
-	}
-	defer msgF.Close()
-	dat, err = ioutil.ReadAll(msgF)
-	if err != nil {
-		return false, fmt.Errorf("error: importData, reading from existing messages.json: %s", err)
-	}
-	json.Unmarshal(dat, &PrivateMessages)
-	return true, nil
+// listenAddr is the address the HTTP server listens on
+var listenAddr = ":7777"
+
+// tlsConfig is used by every listener when TLS is configured
+var tlsConfig *tls.Config
+
+// healthRouter serves the health checks, which must answer while a flood is
+// limited or dbLock is held, so nothing on it rate limits or touches the db
+func healthRouter() *mux.Router {
+	health := mux.NewRouter()
+	health.Use(logHealthRequests)
+	health.Use(instrumentRequests)
+	health.HandleFunc("/healthz", healthz)
+	health.HandleFunc("/readyz", readyz)
+	return health
 }
 
 // handles different requests using Gorilla mux router
 func handleRequests() {
+	health := healthRouter()
 	router := mux.NewRouter().StrictSlash(true)
+	router.Use(logRequests)
+	router.Use(instrumentRequests)
+	// rate limiting runs before locking, so a flood over its IP's limit is
+	// refused without waiting on dbLock; only requests with a NickServ token
+	// take it, to check the token
+	router.Use(rateLimitRequests)
+	router.Use(lockDB)
 	router.HandleFunc("/", homePage)
+	router.HandleFunc("/info", serverInfo)
+	router.HandleFunc("/motd", readMOTD)
 
 	// the four routes below are mainly for debugging purposes, as they are
 	// too inefficient to be used as the main recving methods
@@ -498,11 +517,35 @@ func handleRequests() {
 	// identifier is the channel.toString()
 	// lastrecv is the unix timestamp of the lastrecv'd message
 	router.HandleFunc("/chat/recv/{identifier}/{lastrecv}", recvChat)
-	log.Fatalln(http.ListenAndServe(":7777", router))
+	handleAdminRequests(router)
+	router.HandleFunc("/metrics", metricsHandler).Methods("GET")
+	handleOperRequests(router)
+	handleNickServRequests(router)
+	handleChanServRequests(router)
+	handleChannelRequests(router)
+	go pruneRateLimits()
+	root := http.NewServeMux()
+	root.Handle("/healthz", health)
+	root.Handle("/readyz", health)
+	root.Handle("/", router)
+	server := &http.Server{
+		Addr:      listenAddr,
+		Handler:   root,
+		TLSConfig: tlsConfig,
+	}
+	slog.Info("listening", "addr", listenAddr, "tls", tlsConfig != nil)
+	if tlsConfig != nil {
+		// the certificate comes from TLSConfig.GetCertificate
+		fatal("serving HTTPS", server.ListenAndServeTLS("", ""))
+	}
+	fatal("serving HTTP", server.ListenAndServe())
 }
 
 func wrapHandler() {
 	go handleRequests()
+	if ircAddr != "" {
+		go serveIRC()
+	}
 }
 
 func main() {
@@ -565,34 +608,95 @@ func main() {
 			"Jasmine": []Chat{},
 		},
 	}
-	var inp string
-	fmt.Print("Import data? (y/n) ")
-	fmt.Scan(&inp)
-	if inp == "y" {
-		log.Println("Importing data")
-		_, err := importData()
+	flag.StringVar(&listenAddr, "addr", listenAddr, "address to listen on")
+	flag.StringVar(&ircAddr, "irc-addr", ircAddr, "address of the IRC listener, disabled when empty")
+	flag.DurationVar(&nickGrace, "nick-grace", nickGrace, "how long users on a registered nickname have to identify before they are renamed")
+	flag.StringVar(&motdFile, "motd", motdFile, "file holding the message of the day")
+	flag.StringVar(&serverDisplayName, "name", serverDisplayName, "server name shown to clients")
+	flag.StringVar(&tlsFlags.CertFile, "tls-cert", "", "PEM certificate to serve TLS with, reloaded when it changes")
+	flag.StringVar(&tlsFlags.KeyFile, "tls-key", "", "PEM private key for -tls-cert")
+	flag.StringVar(&tlsFlags.ClientCA, "tls-client-ca", "", "PEM bundle of CAs that client certificates must chain to")
+	flag.StringVar(&tlsFlags.ClientAuth, "tls-client-auth", "none", "client certificates: none, request or require")
+	flag.StringVar(&adminToken, "admin-token", os.Getenv("IRC_ADMIN_TOKEN"), "bearer token for the /admin endpoints, which are disabled when empty")
+	opersFile := flag.String("opers", "opers.json", "file mapping server operator names to password hashes")
+	auditLog := flag.String("audit-log", "audit.jsonl", "JSON Lines file the audit log is appended to, disabled when empty")
+	auditMaxSize := flag.Int64("audit-max-size", 10<<20, "size in bytes at which the audit log is rotated")
+	auditKeep := flag.Int("audit-keep", 5, "number of rotated audit logs to keep")
+	rateLimitsFile := flag.String("rate-limits", "ratelimits.json", "file overriding the built in rate limits per route")
+	flag.DurationVar(&flood.MuteFor, "flood-mute", flood.MuteFor, "how long users who keep hitting rate limits are muted")
+	flag.IntVar(&flood.MuteAfter, "flood-mute-after", flood.MuteAfter, "rate limited requests per minute before a user is muted")
+	flag.IntVar(&flood.KillAfter, "flood-kill-after", flood.KillAfter, "rate limited requests per minute before a user is disconnected")
+	logLevelName := flag.String("log-level", "info", "minimum log level: debug, info, warn or error")
+	logFormat := flag.String("log-format", "text", "log format: text (logfmt) or json")
+	logFile := flag.String("log-file", "-", "file to append logs to, - for stderr")
+	flag.Parse()
+	if err := setLogLevel(*logLevelName); err != nil {
+		log.Fatalln(err)
+	}
+	logOutput, err := openLogOutput(*logFile)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	logger, err := newLogger(logOutput, *logFormat)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	slog.SetDefault(logger)
+	if err := loadMOTD(motdFile); err != nil {
+		slog.Error("loading message of the day", "err", err)
+	}
+	if err := loadOperators(*opersFile); err != nil {
+		slog.Error("loading operators", "err", err)
+	}
+	if tlsConfig, err = serverTLSConfig(tlsFlags); err != nil {
+		fatal("configuring TLS", err)
+	}
+	if err := loadRateLimits(*rateLimitsFile); err != nil {
+		fatal("loading rate limits", err)
+	}
+	if *auditLog != "" {
+		sink, err := openAuditSink(*auditLog, *auditMaxSize, *auditKeep)
+		if err != nil {
+			fatal("opening audit log", err)
+		}
+		auditFile = sink
+	}
+
+	stdin := bufio.NewScanner(os.Stdin)
+	ask := func(question string) string {
+		fmt.Print(question)
+		stdin.Scan()
+		return strings.TrimSpace(stdin.Text())
+	}
+	if ask("Import data? (y/n) ") == "y" {
+		slog.Info("importing data")
+		report, err := importData()
 		if err != nil {
-			log.Println("Failed to import")
+			slog.Error("importing data", "err", err)
 			fmt.Println("Failed to import")
+		} else {
+			slog.Info(report.toString())
 		}
 	} else {
-		log.Println("Skipped importing")
+		slog.Info("skipped importing")
 	}
-	fmt.Println("Starting server, enter q to quit")
 	wrapHandler()
-	for inp != "q" {
-		fmt.Scan(&inp)
-	}
-	fmt.Print("Export data? (y/n) ")
-	fmt.Scan(&inp)
-	if inp == "y" {
-		log.Println("Exporting data")
-		_, err := exportData()
+	adminShell(stdin, os.Stdout)
+	shuttingDown.Store(true)
+	dbLock.Lock()
+	broadcastNotice("The server is shutting down")
+	dbLock.Unlock()
+	if ask("Export data? (y/n) ") == "y" {
+		merge := ask("Merge with existing snapshot or replace it? (m/r) ") == "m"
+		slog.Info("exporting data", "file", snapshotFile, "merge", merge)
+		dbLock.Lock()
+		_, err := exportData(merge)
+		dbLock.Unlock()
 		if err != nil {
-			log.Println("Failed to export")
+			slog.Error("exporting data", "err", err)
 			fmt.Println("Failed to export")
 		}
 	} else {
-		log.Println("Skipped exporting")
+		slog.Info("skipped exporting")
 	}
 }
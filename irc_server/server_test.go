@@ -0,0 +1,968 @@
+package main
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// point the snapshot and legacy files at a fresh directory
+func useTempDir(t *testing.T) string {
+	dir := t.TempDir()
+	snapshotFile = filepath.Join(dir, "snapshot.json")
+	legacyFiles = []string{
+		filepath.Join(dir, "users.json"),
+		filepath.Join(dir, "channels.json"),
+		filepath.Join(dir, "messages.json"),
+	}
+	return dir
+}
+
+// Test Case 1:
+// Export a snapshot and import it back
+func TestSnapshotRoundTrip(t *testing.T) {
+	useTempDir(t)
+	Users = map[string]User{"Matt": {Nickname: "Matt"}}
+	ChatChannels = map[string]*ChatChannel{
+		"General": {Chan: Channel{ChannelName: "General"}, Chats: []Chat{{Timestamp: 1, Sender: "Matt", Receiver: "#General", Text: "hi"}}},
+	}
+	PrivateMessages = map[string]map[string][]Chat{"Matt": {}}
+	if _, err := exportData(false); err != nil {
+		t.Fatalf("exportData(false) = %s", err)
+	}
+	Users, ChatChannels, PrivateMessages = nil, nil, nil
+	report, err := importData()
+	if err != nil {
+		t.Fatalf("importData() = %s", err)
+	}
+	if report.Users != 1 || report.Channels != 1 || report.ChannelChats != 1 {
+		t.Errorf("importData() = %s; Should be 1 user, 1 channel, 1 channel chat", report.toString())
+	}
+}
+
+// Test Case 2:
+// Refuse to import a snapshot whose data does not match its checksum
+func TestSnapshotChecksum(t *testing.T) {
+	useTempDir(t)
+	Users = map[string]User{"Matt": {Nickname: "Matt"}}
+	ChatChannels = map[string]*ChatChannel{}
+	PrivateMessages = map[string]map[string][]Chat{}
+	if _, err := exportData(false); err != nil {
+		t.Fatalf("exportData(false) = %s", err)
+	}
+	dat, _ := ioutil.ReadFile(snapshotFile)
+	dat = []byte(strings.Replace(string(dat), `"Matt"`, `"Mallory"`, 1))
+	ioutil.WriteFile(snapshotFile, dat, 0660)
+	if _, err := importData(); err == nil || !strings.Contains(err.Error(), "checksum") {
+		t.Errorf("importData() = %v; Should be a checksum error", err)
+	}
+	if _, ok := Users["Matt"]; !ok {
+		t.Errorf("importData() replaced Users after failing")
+	}
+}
+
+// Test Case 3:
+// Upgrade the legacy export files, including ones written by the old append mode
+func TestImportLegacyFiles(t *testing.T) {
+	dir := useTempDir(t)
+	ioutil.WriteFile(filepath.Join(dir, "users.json"),
+		[]byte(`{"Matt":{"nickname":"Matt","id":0,"connection":"General"}}{"Jass":{"nickname":"Jass","id":0,"connection":""}}`), 0660)
+	ioutil.WriteFile(filepath.Join(dir, "channels.json"),
+		[]byte(`{"General":{"Chan":{"channelname":"General","id":0,"operators":[],"connected":["Matt"]},"Chats":[]}}`), 0660)
+	ioutil.WriteFile(filepath.Join(dir, "messages.json"), []byte(``), 0660)
+	report, err := importData()
+	if err != nil {
+		t.Fatalf("importData() = %s", err)
+	}
+	if report.UpgradedFrom != 0 || report.Users != 2 || report.Channels != 1 {
+		t.Errorf("importData() = %s; Should be 2 users and 1 channel upgraded from v0", report.toString())
+	}
+}
+
+// Test Case 4:
+// Banning a user removes them from the channel and keeps them out
+func TestChannelBan(t *testing.T) {
+	Users = map[string]User{"Matt": {Nickname: "Matt"}}
+	ChatChannels = map[string]*ChatChannel{
+		"General": {Chan: Channel{ChannelName: "General", Operators: []string{"Kobo"}}, Chats: []Chat{}},
+	}
+	PrivateMessages = map[string]map[string][]Chat{"Matt": {}}
+	joinUser("Matt", "General")
+	if err := setChannelMode("Kobo", "General", "+b", "Matt"); err != nil {
+		t.Fatalf("setChannelMode(+b) = %s", err)
+	}
+	if Users["Matt"].Connection != "" || len(ChatChannels["General"].Chan.Connected) != 0 {
+		t.Errorf("setChannelMode(+b) left Matt in General")
+	}
+	if !isBanned("General", "Matt") {
+		t.Errorf("isBanned('General', 'Matt') = false; Should be true")
+	}
+	if len(AuditLog) == 0 || AuditLog[len(AuditLog)-1].Action != "mode +b" {
+		t.Errorf("setChannelMode(+b) was not audited")
+	}
+}
+
+// Test Case 5:
+// Rotate the audit log file and query across the rotated files
+func TestAuditRotation(t *testing.T) {
+	dir := t.TempDir()
+	sink, err := openAuditSink(filepath.Join(dir, "audit.jsonl"), 200, 2)
+	if err != nil {
+		t.Fatalf("openAuditSink() = %s", err)
+	}
+	auditFile = sink
+	defer func() { auditFile = nil }()
+	for i := 0; i < 6; i++ {
+		audit("Kobo", "join", "General", "")
+	}
+	audit("Jass", "create channel", "Random", "")
+	entries, err := queryAudit(auditQuery{Actor: "Jass"})
+	if err != nil || len(entries) != 1 || entries[0].Target != "Random" {
+		t.Errorf("queryAudit(Jass) = %v, %v; Should be the one Random entry", entries, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "audit.jsonl.2")); err != nil {
+		t.Errorf("audit log was not rotated twice: %s", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "audit.jsonl.3")); err == nil {
+		t.Errorf("audit log kept more than 2 rotated files")
+	}
+}
+
+// Test Case 6:
+// Requests over a route's burst are refused with 429 and Retry-After
+func TestRateLimit(t *testing.T) {
+	RateLimits["/limited"] = rateLimit{Rate: 1, Burst: 2}
+	router := mux.NewRouter()
+	router.Use(rateLimitRequests)
+	router.HandleFunc("/limited", func(w http.ResponseWriter, r *http.Request) {})
+	var codes []int
+	var retry string
+	for i := 0; i < 3; i++ {
+		req := httptest.NewRequest("GET", "/limited", nil)
+		req.Header.Set("X-Irc-User", "Flooder")
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		codes = append(codes, rec.Code)
+		retry = rec.Header().Get("Retry-After")
+	}
+	if codes[0] != 200 || codes[1] != 200 || codes[2] != http.StatusTooManyRequests || retry != "1" {
+		t.Errorf("codes = %v, Retry-After = %q; Should be [200 200 429] and 1", codes, retry)
+	}
+}
+
+// Test Case 17:
+// Flooding under someone else's X-Irc-User, without their token, only limits
+// the flooder's IP and never mutes or kills the named user
+func TestRateLimitSpoofedUser(t *testing.T) {
+	RateLimits["/spoofed"] = rateLimit{Rate: 0.001, Burst: 1}
+	dbLock.Lock()
+	Users = map[string]User{"Victim": {Nickname: "Victim"}}
+	Killed = make(map[string]string)
+	dbLock.Unlock()
+	router := mux.NewRouter()
+	router.Use(rateLimitRequests)
+	router.HandleFunc("/spoofed", func(w http.ResponseWriter, r *http.Request) {})
+	for i := 0; i < flood.KillAfter+5; i++ {
+		req := httptest.NewRequest("GET", "/spoofed", nil)
+		req.Header.Set("X-Irc-User", "Victim")
+		router.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	dbLock.Lock()
+	defer dbLock.Unlock()
+	if _, killed := Killed["Victim"]; killed || mutedFor("Victim") > 0 {
+		t.Errorf("Victim killed %t, muted for %s after a spoofed flood; Should be neither", killed, mutedFor("Victim"))
+	}
+}
+
+// writes a fresh self-signed certificate for cn to cert.pem and key.pem in dir
+func writeTestCert(t *testing.T, dir string, cn string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+	ioutil.WriteFile(filepath.Join(dir, "cert.pem"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(filepath.Join(dir, "key.pem"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+}
+
+// Test Case 7:
+// Serve a renewed certificate without restarting
+func TestCertReload(t *testing.T) {
+	dir := t.TempDir()
+	writeTestCert(t, dir, "old.example")
+	config, err := serverTLSConfig(tlsSettings{CertFile: filepath.Join(dir, "cert.pem"), KeyFile: filepath.Join(dir, "key.pem")})
+	if err != nil {
+		t.Fatalf("serverTLSConfig() = %s", err)
+	}
+	cert, _ := config.GetCertificate(nil)
+	leaf, _ := x509.ParseCertificate(cert.Certificate[0])
+	if leaf.Subject.CommonName != "old.example" {
+		t.Fatalf("GetCertificate() = %s; Should be old.example", leaf.Subject.CommonName)
+	}
+	writeTestCert(t, dir, "new.example")
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(filepath.Join(dir, "cert.pem"), later, later)
+	cert, _ = config.GetCertificate(nil)
+	leaf, _ = x509.ParseCertificate(cert.Certificate[0])
+	if leaf.Subject.CommonName != "new.example" {
+		t.Errorf("GetCertificate() = %s after renewal; Should be new.example", leaf.Subject.CommonName)
+	}
+}
+
+// Test Case 8:
+// Report not ready once the server is shutting down
+func TestReadyz(t *testing.T) {
+	useTempDir(t)
+	rec := httptest.NewRecorder()
+	readyz(rec, httptest.NewRequest("GET", "/readyz", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("readyz() = %d %s; Should be 200", rec.Code, rec.Body.String())
+	}
+	shuttingDown.Store(true)
+	defer shuttingDown.Store(false)
+	rec = httptest.NewRecorder()
+	readyz(rec, httptest.NewRequest("GET", "/readyz", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("readyz() while shutting down = %d; Should be 503", rec.Code)
+	}
+}
+
+// Test Case 9:
+// Notices reach online users only, marked as notices, and the MOTD comes from its file
+func TestServerNotice(t *testing.T) {
+	dir := useTempDir(t)
+	Users = map[string]User{"Matt": {Nickname: "Matt"}, "Kobo": {Nickname: "Kobo"}}
+	PrivateMessages = map[string]map[string][]Chat{}
+	LastSeen = map[string]int64{"Matt": time.Now().Unix()}
+	if n := adminNotice(consoleActor, "restarting at noon"); n != 1 {
+		t.Errorf("adminNotice() = %d; Should be 1", n)
+	}
+	chats := PrivateMessages[serverName]["Matt"]
+	if len(chats) != 1 || chats[0].Kind != chatKindNotice || chats[0].Text != "restarting at noon" {
+		t.Errorf("adminNotice() delivered %v; Should be one notice to Matt", chats)
+	}
+	if len(PrivateMessages[serverName]["Kobo"]) != 0 {
+		t.Errorf("adminNotice() reached Kobo, who is offline")
+	}
+	name := filepath.Join(dir, "motd.txt")
+	ioutil.WriteFile(name, []byte("Be nice\n"), 0644)
+	defer func(old string) { motd = old }(motd)
+	if err := loadMOTD(name); err != nil || motd != "Be nice" {
+		t.Errorf("loadMOTD() = %q, %v; Should be 'Be nice'", motd, err)
+	}
+}
+
+// ircExpect reads lines from the IRC connection until one contains want
+func ircExpect(t *testing.T, conn net.Conn, r *bufio.Reader, want string) string {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("waiting for %q: %s", want, err)
+		}
+		if strings.Contains(line, want) {
+			return line
+		}
+	}
+}
+
+// dialTestIRC connects to the IRC listener through a pipe; the connection is
+// closed, and its handler finished, when the test ends
+func dialTestIRC(t *testing.T) (net.Conn, *bufio.Reader, func(string)) {
+	client, server := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		handleIRCConn(server)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		client.Close()
+		<-done
+	})
+	send := func(line string) {
+		client.SetWriteDeadline(time.Now().Add(2 * time.Second))
+		if _, err := client.Write([]byte(line + "\r\n")); err != nil {
+			t.Fatalf("sending %q: %s", line, err)
+		}
+	}
+	return client, bufio.NewReader(client), send
+}
+
+// Test Case 10:
+// Negotiate capabilities over IRC, then get a tagged echo and the chat history
+func TestIRCCapabilities(t *testing.T) {
+	dbLock.Lock()
+	Users = map[string]User{}
+	PrivateMessages = map[string]map[string][]Chat{}
+	ChatChannels = map[string]*ChatChannel{
+		"General": {Chan: Channel{ChannelName: "General"}, Chats: []Chat{}},
+	}
+	IRCClients = map[string]*ircClient{}
+	dbLock.Unlock()
+	client, r, send := dialTestIRC(t)
+	send("CAP LS 302")
+	ircExpect(t, client, r, "draft/chathistory")
+	send("NICK Matt")
+	send("USER matt 0 * :Matt")
+	send("CAP REQ :server-time message-tags echo-message batch")
+	ircExpect(t, client, r, " ACK :server-time")
+	send("CAP END")
+	ircExpect(t, client, r, " 001 Matt ")
+	send("JOIN #General")
+	ircExpect(t, client, r, " 366 Matt #General ")
+	send("PRIVMSG #General :hello there")
+	echo := ircExpect(t, client, r, "PRIVMSG #General :hello there")
+	if !strings.HasPrefix(echo, "@time=") || !strings.Contains(echo, "msgid=") {
+		t.Errorf("echo = %q; Should carry time and msgid tags", echo)
+	}
+	send("CHATHISTORY LATEST #General * 10")
+	ircExpect(t, client, r, "BATCH +")
+	if line := ircExpect(t, client, r, "PRIVMSG"); !strings.Contains(line, "batch=") {
+		t.Errorf("history = %q; Should be in the batch", line)
+	}
+	ircExpect(t, client, r, "BATCH -")
+	send("QUIT :bye")
+	ircExpect(t, client, r, "ERROR")
+}
+
+// Test Case 11:
+// Log in with SASL PLAIN, show the account in WHOIS and make it a channel operator
+func TestIRCSASLPlain(t *testing.T) {
+	dbLock.Lock()
+	Users = map[string]User{}
+	PrivateMessages = map[string]map[string][]Chat{}
+	ChatChannels = map[string]*ChatChannel{
+		"General": {Chan: Channel{ChannelName: "General", Operators: []string{"matt"}}, Chats: []Chat{}},
+	}
+	IRCClients = map[string]*ircClient{}
+	Accounts = map[string]Account{}
+	err := createAccount(consoleActor, "matt", "hunter2")
+	dbLock.Unlock()
+	if err != nil {
+		t.Fatalf("createAccount() = %s", err)
+	}
+	client, r, send := dialTestIRC(t)
+	send("CAP LS 302")
+	ircExpect(t, client, r, "sasl=PLAIN")
+	send("CAP REQ :sasl")
+	ircExpect(t, client, r, " ACK ")
+	send("AUTHENTICATE PLAIN")
+	ircExpect(t, client, r, "AUTHENTICATE +")
+	send("AUTHENTICATE " + base64.StdEncoding.EncodeToString([]byte("\x00matt\x00wrong")))
+	ircExpect(t, client, r, " 904 ")
+	send("AUTHENTICATE PLAIN")
+	ircExpect(t, client, r, "AUTHENTICATE +")
+	send("AUTHENTICATE " + base64.StdEncoding.EncodeToString([]byte("\x00matt\x00hunter2")))
+	ircExpect(t, client, r, " 903 ")
+	send("NICK Matt")
+	send("USER matt 0 * :Matt")
+	send("CAP END")
+	ircExpect(t, client, r, " 001 Matt ")
+	send("WHOIS Matt")
+	ircExpect(t, client, r, " 330 Matt Matt matt ")
+	dbLock.Lock()
+	op := isChannelOperator("General", "Matt")
+	dbLock.Unlock()
+	if !op {
+		t.Errorf("isChannelOperator('General', 'Matt') = false; Should be true, Matt is logged in as matt")
+	}
+	send("QUIT")
+	ircExpect(t, client, r, "ERROR")
+}
+
+// Test Case 12:
+// Polling as a registered nickname without identifying renames the user once
+// the grace period is up, and keeps being refused until they identify, while
+// identified polls go through
+func TestNickOwnership(t *testing.T) {
+	dbLock.Lock()
+	defer dbLock.Unlock()
+	Users = map[string]User{"Matt": {Nickname: "Matt"}}
+	PrivateMessages = map[string]map[string][]Chat{"Matt": {}}
+	Accounts = map[string]Account{}
+	NickSessions = map[string]string{}
+	Identified = map[string]string{}
+	nickDeadlines = map[string]time.Time{}
+	nickGuests = map[string]string{}
+	if err := registerNick("Matt", "Matt", "hunter2"); err != nil {
+		t.Fatalf("registerNick() = %s", err)
+	}
+	router := mux.NewRouter()
+	router.HandleFunc("/chat/recv/{identifier}/{lastrecv}", recvChat)
+	handleNickServRequests(router)
+	poll := func(token string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/chat/recv/-Matt/0", nil)
+		req.Header.Set(nickTokenHeader, token)
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+	if rec := poll(""); rec.Code != http.StatusOK {
+		t.Errorf("unidentified poll in grace period = %d; Should be 200", rec.Code)
+	}
+	nickDeadlines["Matt"] = time.Now().Add(-time.Second)
+	rec := poll("")
+	if rec.Code != http.StatusConflict || !strings.Contains(rec.Body.String(), "Guest") {
+		t.Errorf("unidentified poll after grace period = %d %s; Should be 409 with a Guest nick", rec.Code, rec.Body.String())
+	}
+	if again := poll(""); again.Code != http.StatusConflict || again.Body.String() != rec.Body.String() {
+		t.Errorf("second unidentified poll = %d %s; Should still be 409 with the same Guest nick", again.Code, again.Body.String())
+	}
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest("POST", "/nickserv/identify", strings.NewReader(`{"user":"Matt","password":"hunter2"}`)))
+	sessions := NickSessions
+	if rec.Code != http.StatusOK || len(sessions) != 1 {
+		t.Fatalf("identify = %d %s; Should be 200 with a token", rec.Code, rec.Body.String())
+	}
+	nickDeadlines["Matt"] = time.Now().Add(-time.Second)
+	for tok := range sessions {
+		if rec := poll(tok); rec.Code != http.StatusOK {
+			t.Errorf("identified poll = %d; Should be 200", rec.Code)
+		}
+	}
+}
+
+// Test Case 13:
+// A registered channel keeps its access list: the founder's ops are auto-opped
+// on join, a restricted channel turns away everyone else, and the founder can
+// hand the channel over
+func TestChanServ(t *testing.T) {
+	dbLock.Lock()
+	defer dbLock.Unlock()
+	Users = map[string]User{"Matt": {Nickname: "Matt"}, "Kobo": {Nickname: "Kobo"}, "Eve": {Nickname: "Eve"}}
+	PrivateMessages = map[string]map[string][]Chat{"Matt": {}, "Kobo": {}, "Eve": {}}
+	ChatChannels = map[string]*ChatChannel{
+		"General": {Chan: Channel{ChannelName: "General", Operators: []string{"Matt"}, Connected: []string{}}, Chats: []Chat{}},
+	}
+	Accounts = map[string]Account{}
+	Identified = map[string]string{"Matt": "Matt", "Kobo": "Kobo"}
+	createAccount("Matt", "Matt", "hunter2")
+	createAccount("Kobo", "Kobo", "hunter3")
+	if _, err := chanServCommand("Kobo", "Kobo", "REGISTER #General"); err == nil {
+		t.Errorf("REGISTER by a non-operator succeeded; Should be refused")
+	}
+	for _, command := range []string{"REGISTER #General", "ACCESS #General ADD Kobo op", "SET #General RESTRICTED on"} {
+		if _, err := chanServCommand("Matt", "Matt", command); err != nil {
+			t.Fatalf("%s = %s", command, err)
+		}
+	}
+	router := mux.NewRouter()
+	router.HandleFunc("/join", joinChannel)
+	join := func(user string) int {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest("POST", "/join", strings.NewReader(`{"user":"`+user+`","channel":"General"}`)))
+		return rec.Code
+	}
+	if code := join("Eve"); code != http.StatusForbidden {
+		t.Errorf("Eve joining a restricted channel = %d; Should be 403", code)
+	}
+	if code := join("Kobo"); code != http.StatusOK || !isChannelOperator("General", "Kobo") {
+		t.Errorf("Kobo joining = %d, operator %t; Should be 200 and auto-opped", code, isChannelOperator("General", "Kobo"))
+	}
+	if canSetMode("General", "Kobo", "-o", "Matt") {
+		t.Errorf("an op may deop the founder; Should be refused")
+	}
+	if _, err := chanServCommand("Kobo", "Kobo", "TRANSFER #General Kobo"); err == nil {
+		t.Errorf("TRANSFER by an op succeeded; Should be founder only")
+	}
+	if _, err := chanServCommand("Matt", "Matt", "TRANSFER #General Kobo"); err != nil {
+		t.Fatalf("TRANSFER = %s", err)
+	}
+	ch := ChatChannels["General"].Chan
+	if ch.Founder != "Kobo" || ch.Access["Matt"] != "op" {
+		t.Errorf("after TRANSFER founder = %q, Matt = %q; Should be Kobo and op", ch.Founder, ch.Access["Matt"])
+	}
+	// creating a channel cannot register it; only ChanServ can
+	router.HandleFunc("/channel", createChatChannel).Methods("POST")
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest("POST", "/channel", strings.NewReader(`{"channelname":"X","founder":"nobody","access":{"Eve":"op"},"archived":true}`)))
+	if cc := ChatChannels["X"]; rec.Code != http.StatusOK || cc == nil || cc.Chan.Founder != "" || cc.Chan.Access != nil || cc.Chan.Archived {
+		t.Fatalf("POST /channel with a founder = %d, %+v; Should create it unregistered", rec.Code, cc)
+	}
+	if _, err := chanServCommand("Eve", "", "INFO #X"); err == nil {
+		t.Errorf("INFO of an unregistered channel succeeded; Should say it is not registered")
+	}
+	ChatChannels["X"].Chan.Founder = "Kobo"
+	if _, err := chanServCommand("Kobo", "Kobo", "INFO #X"); err != nil {
+		t.Errorf("INFO of a channel without settings = %s; Should use the defaults", err)
+	}
+}
+
+// Test Case 14:
+// Only a channel's owner may rename or archive it; renaming keeps its history
+// and moves every member, and archived channels refuse new chats but can still
+// be searched
+func TestChannelManagement(t *testing.T) {
+	dbLock.Lock()
+	defer dbLock.Unlock()
+	Users = map[string]User{"Matt": {Nickname: "Matt", Connection: "General1"}, "Kobo": {Nickname: "Kobo", Connection: "General1"}}
+	PrivateMessages = map[string]map[string][]Chat{"Matt": {}, "Kobo": {}}
+	Accounts = map[string]Account{}
+	ChatChannels = map[string]*ChatChannel{
+		"General1": {
+			Chan:  Channel{ChannelName: "General", ID: 1, Operators: []string{"Matt"}, Connected: []string{"Matt", "Kobo"}},
+			Chats: []Chat{{ID: 1, Sender: "Kobo", Receiver: "#General1", Text: "Hello World"}},
+		},
+	}
+	router := mux.NewRouter()
+	router.HandleFunc("/chat/send", sendChat)
+	handleChannelRequests(router)
+	post := func(path string, body string) int {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest("POST", path, strings.NewReader(body)))
+		return rec.Code
+	}
+	if code := post("/channel/General1/rename", `{"user":"Kobo","name":"Lobby"}`); code != http.StatusForbidden {
+		t.Errorf("rename by a member = %d; Should be 403", code)
+	}
+	if code := post("/channel/General1/rename", `{"user":"Matt","name":"Lobby"}`); code != http.StatusOK {
+		t.Fatalf("rename by the owner = %d; Should be 200", code)
+	}
+	cc, ok := ChatChannels["Lobby"]
+	if !ok || len(cc.Chats) != 1 || cc.Chats[0].Receiver != "#Lobby" || Users["Kobo"].Connection != "Lobby" {
+		t.Fatalf("after rename channel %t, chats %v, Kobo in %q; Should keep history and members", ok, cc, Users["Kobo"].Connection)
+	}
+	if code := post("/channel/Lobby/archive", `{"user":"Matt","archived":true}`); code != http.StatusOK {
+		t.Fatalf("archive by the owner = %d; Should be 200", code)
+	}
+	if code := post("/chat/send", `{"sender":"Kobo","receiver":"#Lobby","text":"hi"}`); code != http.StatusForbidden {
+		t.Errorf("chat to an archived channel = %d; Should be 403", code)
+	}
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest("GET", "/chatchannel/Lobby/search?q=world", nil))
+	if !strings.Contains(rec.Body.String(), "Hello World") {
+		t.Errorf("search of an archived channel = %s; Should find the old chat", rec.Body.String())
+	}
+}
+
+// Test Case 15:
+// Polling with ?after=<id> returns chats sent in the same second as the last
+// one seen, which a timestamp cannot tell apart, and an ID from before a
+// restart falls back to the timestamp
+func TestRecvChatAfterID(t *testing.T) {
+	dbLock.Lock()
+	defer dbLock.Unlock()
+	Users = map[string]User{"Matt": {Nickname: "Matt", Connection: "General"}}
+	PrivateMessages = map[string]map[string][]Chat{"Matt": {}}
+	ChatChannels = map[string]*ChatChannel{
+		"General": {
+			Chan: Channel{ChannelName: "General", Connected: []string{"Matt"}},
+			Chats: []Chat{
+				{ID: 1, Timestamp: 100, Sender: "Matt", Receiver: "#General", Text: "one"},
+				{ID: 2, Timestamp: 100, Sender: "Matt", Receiver: "#General", Text: "two"},
+			},
+		},
+	}
+	chatSeq = 2
+	router := mux.NewRouter()
+	router.HandleFunc("/chat/recv/{identifier}/{lastrecv}", recvChat)
+	recv := func(path string) []Chat {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		var chats []Chat
+		json.Unmarshal(rec.Body.Bytes(), &chats)
+		return chats
+	}
+	if chats := recv("/chat/recv/+General/100?after=1"); len(chats) != 1 || chats[0].Text != "two" {
+		t.Errorf("after=1 returned %v; Should return only the second chat", chats)
+	}
+	if chats := recv("/chat/recv/+General/99?after=50"); len(chats) != 2 {
+		t.Errorf("after=50 with chatSeq 2 returned %v; Should fall back to the timestamp", chats)
+	}
+}
+
+// Test Case 16:
+// Channel history returns the newest chats up to the limit, oldest first, and
+// pages further back with before
+func TestChannelHistory(t *testing.T) {
+	dbLock.Lock()
+	defer dbLock.Unlock()
+	cc := &ChatChannel{Chan: Channel{ChannelName: "General"}}
+	for i := int64(1); i <= 5; i++ {
+		cc.Chats = append(cc.Chats, Chat{ID: i, Timestamp: 100 + i, Sender: "Matt", Receiver: "#General", Text: strconv.FormatInt(i, 10)})
+	}
+	ChatChannels = map[string]*ChatChannel{"General": cc}
+	router := mux.NewRouter()
+	handleChannelRequests(router)
+	history := func(query string) string {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest("GET", "/chatchannel/General/history"+query, nil))
+		var chats []Chat
+		json.Unmarshal(rec.Body.Bytes(), &chats)
+		var texts []string
+		for _, chat := range chats {
+			texts = append(texts, chat.Text)
+		}
+		return strings.Join(texts, ",")
+	}
+	if got := history("?limit=2"); got != "4,5" {
+		t.Errorf("limit=2 returned %q; Should be 4,5", got)
+	}
+	if got := history("?limit=2&before=4"); got != "2,3" {
+		t.Errorf("limit=2&before=4 returned %q; Should be 2,3", got)
+	}
+	if got := history("?before=2"); got != "1" {
+		t.Errorf("before=2 returned %q; Should be 1", got)
+	}
+}
+
+// Test Case 18:
+// A private message to someone who is not a user is refused instead of being
+// stored under a made up name
+func TestPrivateMessageUnknownUser(t *testing.T) {
+	dbLock.Lock()
+	defer dbLock.Unlock()
+	Users = map[string]User{"Matt": {Nickname: "Matt"}, "Kobo": {Nickname: "Kobo"}}
+	PrivateMessages = map[string]map[string][]Chat{"Matt": {"Kobo": {}}, "Kobo": {"Matt": {}}}
+	Accounts = map[string]Account{}
+	router := mux.NewRouter()
+	router.HandleFunc("/chat/send", sendChat)
+	send := func(body string) int {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest("POST", "/chat/send", strings.NewReader(body)))
+		return rec.Code
+	}
+	if code := send(`{"sender":"Matt","receiver":"@Nobody","text":"hi"}`); code != http.StatusNotFound {
+		t.Errorf("private message to an unknown user = %d; Should be 404", code)
+	}
+	if _, ok := PrivateMessages["Matt"]["Nobody"]; ok {
+		t.Errorf("private message to an unknown user was stored")
+	}
+	if code := send(`{"sender":"Matt","receiver":"@Kobo","text":"hi"}`); code != http.StatusOK {
+		t.Errorf("private message to Kobo = %d; Should be 200", code)
+	}
+}
+
+// Test Case 20:
+// A merge export keeps what only the old snapshot has, but not channels and
+// accounts deleted, renamed away or dropped since it was written
+func TestMergeExportDeletions(t *testing.T) {
+	useTempDir(t)
+	dbLock.Lock()
+	defer dbLock.Unlock()
+	Users = map[string]User{"Matt": {Nickname: "Matt"}}
+	PrivateMessages = map[string]map[string][]Chat{"Matt": {}}
+	ChatChannels = map[string]*ChatChannel{
+		"General": {Chan: Channel{ChannelName: "General", Connected: []string{}}, Chats: []Chat{}},
+		"Random":  {Chan: Channel{ChannelName: "Random", Connected: []string{}}, Chats: []Chat{}},
+		"Old":     {Chan: Channel{ChannelName: "Old", Connected: []string{}}, Chats: []Chat{}},
+	}
+	Accounts = map[string]Account{}
+	Identified = map[string]string{}
+	createAccount("Matt", "Matt", "hunter2")
+	createAccount("Kobo", "Kobo", "hunter3")
+	if _, err := exportData(false); err != nil {
+		t.Fatalf("exportData(false) = %s", err)
+	}
+	if err := adminDeleteChannel("admin", "General"); err != nil {
+		t.Fatalf("adminDeleteChannel() = %s", err)
+	}
+	if err := adminRenameChannel("admin", "Random", "Lobby"); err != nil {
+		t.Fatalf("adminRenameChannel() = %s", err)
+	}
+	if err := dropAccount("admin", "Kobo"); err != nil {
+		t.Fatalf("dropAccount() = %s", err)
+	}
+	// as if Old had been lost from memory, which the merge exists for
+	delete(ChatChannels, "Old")
+	if _, err := exportData(true); err != nil {
+		t.Fatalf("exportData(true) = %s", err)
+	}
+	data, _, err := readSnapshot(snapshotFile)
+	if err != nil {
+		t.Fatalf("readSnapshot() = %s", err)
+	}
+	for _, name := range []string{"General", "Random"} {
+		if _, ok := data.ChatChannels[name]; ok {
+			t.Errorf("merge export brought back channel %s", name)
+		}
+	}
+	if _, ok := data.ChatChannels["Old"]; !ok {
+		t.Errorf("merge export lost channel Old; Should carry it over from the old snapshot")
+	}
+	if _, ok := data.ChatChannels["Lobby"]; !ok {
+		t.Errorf("merge export lost the renamed channel Lobby")
+	}
+	if _, ok := data.Accounts["Kobo"]; ok {
+		t.Errorf("merge export brought back the dropped account Kobo")
+	}
+}
+
+// Test Case 21:
+// Creating a channel is audited as whoever the request proves it comes from,
+// not the creator it claims, and a corrupt audit file is an error rather than
+// a short answer
+func TestAuditChannelCreator(t *testing.T) {
+	dbLock.Lock()
+	defer dbLock.Unlock()
+	ChatChannels = map[string]*ChatChannel{}
+	NickSessions = map[string]string{}
+	Identified = map[string]string{}
+	AuditLog = nil
+	router := mux.NewRouter()
+	router.HandleFunc("/channel", createChatChannel).Methods("POST")
+	req := httptest.NewRequest("POST", "/channel", strings.NewReader(`{"channelname":"General","creator":"Matt"}`))
+	req.Header.Set("X-Irc-User", "Matt")
+	router.ServeHTTP(httptest.NewRecorder(), req)
+	if len(AuditLog) != 1 {
+		t.Fatalf("audit log has %d entries; Should have the channel creation", len(AuditLog))
+	}
+	if entry := AuditLog[0]; entry.Actor != req.RemoteAddr || !strings.Contains(entry.Detail, "Matt, unverified") {
+		t.Errorf("audit entry = %+v; Should be by %s with Matt as an unverified claim", entry, req.RemoteAddr)
+	}
+
+	dir := t.TempDir()
+	sink, err := openAuditSink(filepath.Join(dir, "audit.jsonl"), 1<<20, 1)
+	if err != nil {
+		t.Fatalf("openAuditSink() = %s", err)
+	}
+	defer sink.f.Close()
+	ioutil.WriteFile(filepath.Join(dir, "audit.jsonl"), []byte(strings.Repeat("x", bufio.MaxScanTokenSize+1)+"\n"), 0600)
+	if _, err := sink.read(); err == nil {
+		t.Errorf("read() of a line too long to scan = nil; Should be an error")
+	}
+}
+
+// Test Case 22:
+// Requests are counted and timed by route template, and both show up in the
+// /metrics exposition
+func TestInstrumentRequests(t *testing.T) {
+	dbLock.Lock()
+	defer dbLock.Unlock()
+	router := mux.NewRouter()
+	router.Use(instrumentRequests)
+	router.HandleFunc("/probe/{id}", func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(20 * time.Millisecond)
+		w.WriteHeader(http.StatusTeapot)
+	})
+	router.HandleFunc("/metrics", metricsHandler).Methods("GET")
+	for _, path := range []string{"/probe/1", "/probe/2"} {
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body := rec.Body.String()
+	for _, line := range []string{
+		"# TYPE irc_http_requests_total counter",
+		`irc_http_requests_total{route="/probe/{id}",method="GET",code="418"} 2`,
+		"# TYPE irc_http_request_duration_seconds histogram",
+		`irc_http_request_duration_seconds_bucket{route="/probe/{id}",le="0.001"} 0`,
+		`irc_http_request_duration_seconds_bucket{route="/probe/{id}",le="5"} 2`,
+		`irc_http_request_duration_seconds_bucket{route="/probe/{id}",le="+Inf"} 2`,
+		`irc_http_request_duration_seconds_count{route="/probe/{id}"} 2`,
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("/metrics is missing %q", line)
+		}
+	}
+	if !strings.Contains(body, `irc_http_request_duration_seconds_sum{route="/probe/{id}"} 0.`) {
+		t.Errorf("/metrics has no sum under a second for /probe/{id}:\n%s", body)
+	}
+}
+
+// Test Case 23:
+// Naming the user of a request without a NickServ token does not wait on
+// dbLock, which the logging and rate limiting middleware run outside of
+func TestRequestUserWithoutToken(t *testing.T) {
+	dbLock.Lock()
+	defer dbLock.Unlock()
+	done := make(chan string, 1)
+	go func() {
+		req := httptest.NewRequest("GET", "/channels", nil)
+		req.Header.Set("X-Irc-User", "Matt")
+		done <- requestUser(req)
+	}()
+	select {
+	case user := <-done:
+		if user != "" {
+			t.Errorf("requestUser() without a token = %q; Should be no one", user)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("requestUser() without a token waited on dbLock")
+	}
+}
+
+// Test Case 24:
+// The health checks answer while dbLock is held, even for a request that
+// claims a user with a NickServ token
+func TestHealthWithoutDBLock(t *testing.T) {
+	useTempDir(t)
+	dbLock.Lock()
+	defer dbLock.Unlock()
+	router := healthRouter()
+	for _, path := range []string{"/healthz", "/readyz"} {
+		done := make(chan int, 1)
+		go func() {
+			req := httptest.NewRequest("GET", path, nil)
+			req.Header.Set("X-Irc-User", "Matt")
+			req.Header.Set(nickTokenHeader, "token")
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+			done <- rec.Code
+		}()
+		select {
+		case code := <-done:
+			if code != http.StatusOK {
+				t.Errorf("%s = %d; Should be 200", path, code)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%s waited on dbLock", path)
+		}
+	}
+}
+
+// Test Case 25:
+// A flood without a NickServ token is refused over its IP's limit without
+// waiting on dbLock
+func TestRateLimitWithoutDBLock(t *testing.T) {
+	RateLimits["/flooded"] = rateLimit{Rate: 0.001, Burst: 1}
+	router := mux.NewRouter()
+	router.Use(rateLimitRequests)
+	router.HandleFunc("/flooded", func(w http.ResponseWriter, r *http.Request) {})
+	dbLock.Lock()
+	defer dbLock.Unlock()
+	done := make(chan []int, 1)
+	go func() {
+		var codes []int
+		for i := 0; i < 3; i++ {
+			req := httptest.NewRequest("GET", "/flooded", nil)
+			req.Header.Set("X-Irc-User", "Matt")
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+			codes = append(codes, rec.Code)
+		}
+		done <- codes
+	}()
+	select {
+	case codes := <-done:
+		if codes[0] != http.StatusOK || codes[1] != http.StatusTooManyRequests || codes[2] != http.StatusTooManyRequests {
+			t.Errorf("flood answered %v; Should be 200 and then 429s", codes)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("rate limiting waited on dbLock")
+	}
+}
+
+// Test Case 26:
+// WHOIS shows the account of users who identified over HTTP, as it does for
+// IRC connections, and none for users who have not
+func TestWhoisHTTPAccount(t *testing.T) {
+	dbLock.Lock()
+	Users = map[string]User{"Kobo": {Nickname: "Kobo"}, "Eve": {Nickname: "Eve"}}
+	PrivateMessages = map[string]map[string][]Chat{"Kobo": {}, "Eve": {}}
+	ChatChannels = map[string]*ChatChannel{}
+	IRCClients = map[string]*ircClient{}
+	Accounts = map[string]Account{}
+	Identified = map[string]string{"Kobo": "kobo"}
+	dbLock.Unlock()
+	client, r, send := dialTestIRC(t)
+	send("NICK Matt")
+	send("USER matt 0 * :Matt")
+	ircExpect(t, client, r, " 001 Matt ")
+	send("WHOIS Kobo")
+	ircExpect(t, client, r, " 330 Matt Kobo kobo ")
+	send("WHOIS Eve")
+	for {
+		line := ircExpect(t, client, r, " Eve ")
+		if strings.Contains(line, " 330 ") {
+			t.Errorf("WHOIS Eve = %q; Should show no account", line)
+		}
+		if strings.Contains(line, " 318 ") {
+			break
+		}
+	}
+	send("QUIT")
+	ircExpect(t, client, r, "ERROR")
+}
+
+// Test Case 27:
+// OPER binds the session to, and audits it as, the user the request proves
+// it comes from, refusing requests that prove no one or claim someone else
+func TestOperLoginProvenUser(t *testing.T) {
+	dbLock.Lock()
+	defer dbLock.Unlock()
+	Users = map[string]User{"Matt": {Nickname: "Matt"}, "Kobo": {Nickname: "Kobo"}}
+	NickSessions = map[string]string{"matt-token": "Matt"}
+	Identified = map[string]string{"Matt": "matt"}
+	OperSessions = map[string]operSession{}
+	hash, _ := bcrypt.GenerateFromPassword([]byte("hunter2"), bcrypt.MinCost)
+	OperAccounts = map[string]string{"root": string(hash)}
+	AuditLog = nil
+	router := mux.NewRouter()
+	router.HandleFunc("/oper", operLogin).Methods("POST")
+	oper := func(user string, token string, body string) int {
+		req := httptest.NewRequest("POST", "/oper", strings.NewReader(body))
+		if user != "" {
+			req.Header.Set("X-Irc-User", user)
+		}
+		if token != "" {
+			req.Header.Set(nickTokenHeader, token)
+		}
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	for _, tc := range []struct {
+		user  string
+		token string
+		body  string
+	}{
+		{"", "", `{"user":"Matt","name":"root","password":"hunter2"}`},
+		{"Kobo", "", `{"user":"Kobo","name":"root","password":"hunter2"}`},
+		{"Matt", "matt-token", `{"user":"Kobo","name":"root","password":"hunter2"}`},
+	} {
+		if code := oper(tc.user, tc.token, tc.body); code != http.StatusForbidden {
+			t.Errorf("OPER as %q with token %q and body %s = %d; Should be 403", tc.user, tc.token, tc.body, code)
+		}
+	}
+	for _, entry := range AuditLog {
+		if entry.Actor == "Matt" || entry.Actor == "Kobo" {
+			t.Errorf("refused OPER audited as %s; Should be the remote address", entry.Actor)
+		}
+	}
+	if len(OperSessions) != 0 {
+		t.Fatalf("refused OPER requests made %d sessions", len(OperSessions))
+	}
+	if code := oper("Matt", "matt-token", `{"user":"Matt","name":"root","password":"hunter2"}`); code != http.StatusOK {
+		t.Fatalf("OPER by identified Matt = %d; Should be 200", code)
+	}
+	for _, session := range OperSessions {
+		if session.User != "Matt" {
+			t.Errorf("oper session user = %q; Should be Matt", session.User)
+		}
+	}
+	if last := AuditLog[len(AuditLog)-1]; last.Actor != "Matt" || last.Action != "oper" {
+		t.Errorf("last audit entry = %+v; Should be Matt's oper", last)
+	}
+}
@@ -0,0 +1,445 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// nickServ is the services pseudo-user that owns nickname registration
+const nickServ = "NickServ"
+
+// nickTokenHeader carries the token /nickserv/identify hands out; HTTP
+// requests acting as a registered nickname must send it
+const nickTokenHeader = "X-Nick-Token"
+
+// nickGrace is how long users on a nickname registered to an account they have
+// not identified to get before they are renamed
+var nickGrace = time.Minute
+
+// NickSessions map of token to the user identifier it was issued to
+var NickSessions = make(map[string]string)
+
+// Identified map of user identifier to the account they identified to over
+// HTTP; IRC connections keep theirs in ircClient.account
+var Identified = make(map[string]string)
+
+// nickDeadlines map of user identifier to when unidentified HTTP users on it
+// are renamed; it stays expired until someone identifies to the nickname
+var nickDeadlines = make(map[string]time.Time)
+
+// nickGuests map of user identifier to the guest nickname its unidentified
+// users were renamed to, so polling the old nickname again does not pile up
+// guests
+var nickGuests = make(map[string]string)
+
+// reservedNick reports whether name belongs to services or the server
+func reservedNick(name string) bool {
+	return strings.EqualFold(name, nickServ) || strings.EqualFold(name, chanServ) || name == serverName
+}
+
+// nickOwner is the account nick is registered to, if any: the account with
+// the same name, or the one that grouped it
+func nickOwner(nick string) string {
+	if _, ok := Accounts[nick]; ok {
+		return nick
+	}
+	for name, account := range Accounts {
+		for _, n := range account.Nicks {
+			if n == nick {
+				return name
+			}
+		}
+	}
+	return ""
+}
+
+// registerNick creates an account named after nick, which owns it
+func registerNick(actor string, nick string, password string) error {
+	if owner := nickOwner(nick); owner != "" {
+		return fmt.Errorf("%s is already registered to %s", nick, owner)
+	}
+	return createAccount(actor, nick, password)
+}
+
+// groupNick registers nick to an existing account as well
+func groupNick(account string, nick string) error {
+	if owner := nickOwner(nick); owner != "" {
+		return fmt.Errorf("%s is already registered to %s", nick, owner)
+	}
+	a, ok := Accounts[account]
+	if !ok {
+		return fmt.Errorf("no such account %q", account)
+	}
+	a.Nicks = append(a.Nicks, nick)
+	Accounts[account] = a
+	audit(account, "group", nick, "")
+	return nil
+}
+
+// nickAuthorized reports whether being identified to account, or knowing
+// password, proves ownership of nick
+func nickAuthorized(nick string, account string, password string) bool {
+	owner := nickOwner(nick)
+	return owner != "" && (account == owner || (password != "" && checkAccountPassword(owner, password)))
+}
+
+// ghostNick frees nick for its owner: an IRC connection on it is closed, HTTP
+// tokens for it are revoked, and unidentified HTTP users on it are renamed on
+// their next poll
+func ghostNick(actor string, nick string) {
+	disconnectIRC(nick, "GHOST command used by "+actor)
+	for token, key := range NickSessions {
+		if key == nick {
+			delete(NickSessions, token)
+		}
+	}
+	delete(Identified, nick)
+	nickDeadlines[nick] = time.Now()
+	delete(nickGuests, nick)
+	audit(actor, "ghost", nick, "")
+}
+
+// guestNick picks an unused Guest nickname
+func guestNick() string {
+	for {
+		nick := fmt.Sprintf("Guest%04d", rand.Intn(10000))
+		if _, ok := Users[nick]; !ok {
+			return nick
+		}
+	}
+}
+
+// moveMember puts to in the channel from is in, in from's place, without
+// telling anyone; IRC clients see a NICK instead
+func moveMember(from string, to string) {
+	ch := Users[from].Connection
+	cc, ok := ChatChannels[ch]
+	if !ok {
+		return
+	}
+	removeFromChannel(to)
+	for i, member := range cc.Chan.Connected {
+		if member == from {
+			cc.Chan.Connected[i] = to
+		}
+	}
+	user := Users[to]
+	user.Connection = ch
+	Users[to] = user
+	user = Users[from]
+	user.Connection = ""
+	Users[from] = user
+}
+
+// nickServNotice sends text to the user as a notice from NickServ
+func nickServNotice(to string, text string) {
+	storeChat(Chat{
+		Timestamp: time.Now().Unix(),
+		Sender:    nickServ,
+		Receiver:  "@" + to,
+		Text:      text,
+		Kind:      chatKindNotice,
+	})
+}
+
+// httpIdentified reports whether the request carries a token issued to key
+func httpIdentified(r *http.Request, key string) bool {
+	token := r.Header.Get(nickTokenHeader)
+	return token != "" && NickSessions[token] == key && Identified[key] != ""
+}
+
+// identifiedAs is the account the user is logged in to, if any
+func identifiedAs(key string) string {
+	if c, ok := IRCClients[key]; ok {
+		return c.account
+	}
+	return Identified[key]
+}
+
+// checkNick enforces nickname ownership on HTTP requests acting as key: users
+// on a nickname registered to an account they have not identified to are
+// warned, and once nickGrace is up their requests are refused and their
+// polls rename them to a guest nickname
+func checkNick(w http.ResponseWriter, r *http.Request, key string, rename bool) bool {
+	owner := nickOwner(key)
+	if owner == "" || (httpIdentified(r, key) && Identified[key] == owner) {
+		return true
+	}
+	deadline, ok := nickDeadlines[key]
+	if !ok {
+		deadline = time.Now().Add(nickGrace)
+		nickDeadlines[key] = deadline
+		nickServNotice(key, fmt.Sprintf("This nickname is registered. Identify with /identify within %s or you will be renamed", nickGrace))
+	}
+	if time.Now().Before(deadline) {
+		return true
+	}
+	if !rename {
+		http.Error(w, "nickname "+key+" is registered to an account, identify with /identify", http.StatusForbidden)
+		return false
+	}
+	guest, ok := nickGuests[key]
+	if _, exists := Users[guest]; !ok || !exists {
+		guest = guestNick()
+		Users[guest] = User{Nickname: guest}
+		addPrivateMessages(guest)
+		nickGuests[key] = guest
+		audit(nickServ, "rename", key, guest)
+	}
+	w.WriteHeader(http.StatusConflict)
+	json.NewEncoder(w).Encode(map[string]string{"nick": guest})
+	return false
+}
+
+// nickServRequest is the body accepted by the /nickserv endpoints
+type nickServRequest struct {
+	User     string `json:"user"`
+	Account  string `json:"account"`
+	Target   string `json:"target"`
+	Password string `json:"password"`
+}
+
+func readNickServRequest(r *http.Request) nickServRequest {
+	var req nickServRequest
+	reqBody, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		reqLogger(r).Error("reading request body", "func", "readNickServRequest", "err", err)
+	}
+	json.Unmarshal(reqBody, &req)
+	return req
+}
+
+// issueNickToken identifies key to account over HTTP
+func issueNickToken(w http.ResponseWriter, key string, account string) {
+	token := newToken()
+	NickSessions[token] = key
+	Identified[key] = account
+	delete(nickDeadlines, key)
+	delete(nickGuests, key)
+	json.NewEncoder(w).Encode(map[string]string{"token": token, "account": account, "nick": key})
+}
+
+// GET /nickserv/info/{nick}
+func nickServInfo(w http.ResponseWriter, r *http.Request) {
+	nick := mux.Vars(r)["nick"]
+	owner := nickOwner(nick)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"nick":       nick,
+		"registered": owner != "",
+		"account":    owner,
+	})
+}
+
+// POST /nickserv/register registers the user's nickname to a new account
+func nickServRegister(w http.ResponseWriter, r *http.Request) {
+	req := readNickServRequest(r)
+	if _, ok := Users[req.User]; !ok {
+		http.Error(w, "no such user", http.StatusNotFound)
+		return
+	}
+	if !checkNick(w, r, req.User, false) {
+		return
+	}
+	if err := registerNick(req.User, req.User, req.Password); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	issueNickToken(w, req.User, req.User)
+}
+
+// POST /nickserv/identify logs the user in to an account, by default the one
+// their nickname is registered to
+func nickServIdentify(w http.ResponseWriter, r *http.Request) {
+	req := readNickServRequest(r)
+	account := req.Account
+	if account == "" {
+		account = nickOwner(req.User)
+	} else if owner := nickOwner(account); owner != "" {
+		account = owner
+	}
+	if _, ok := Users[req.User]; !ok {
+		http.Error(w, "no such user", http.StatusNotFound)
+		return
+	}
+	if account == "" || !checkAccountPassword(account, req.Password) {
+		audit(req.User, "identify failed", account, "")
+		http.Error(w, "invalid account or password", http.StatusUnauthorized)
+		return
+	}
+	audit(req.User, "identify", account, "")
+	issueNickToken(w, req.User, account)
+}
+
+// ghostRequest checks that the user owns the target nickname, by being
+// identified to its account or by sending its password, and ghosts it
+func ghostRequest(w http.ResponseWriter, r *http.Request) (nickServRequest, bool) {
+	req := readNickServRequest(r)
+	account := ""
+	if httpIdentified(r, req.User) {
+		account = Identified[req.User]
+	}
+	if !nickAuthorized(req.Target, account, req.Password) {
+		audit(req.User, "ghost failed", req.Target, "")
+		http.Error(w, "you do not own "+req.Target, http.StatusForbidden)
+		return req, false
+	}
+	ghostNick(req.User, req.Target)
+	return req, true
+}
+
+// POST /nickserv/ghost disconnects whoever is using the target nickname
+func nickServGhost(w http.ResponseWriter, r *http.Request) {
+	if req, ok := ghostRequest(w, r); ok {
+		json.NewEncoder(w).Encode(map[string]string{"ghosted": req.Target})
+	}
+}
+
+// POST /nickserv/recover ghosts the target nickname and hands it, identified,
+// to the user
+func nickServRecover(w http.ResponseWriter, r *http.Request) {
+	req, ok := ghostRequest(w, r)
+	if !ok {
+		return
+	}
+	if _, exists := Users[req.Target]; !exists {
+		Users[req.Target] = User{Nickname: req.Target}
+		addPrivateMessages(req.Target)
+	}
+	audit(req.User, "recover", req.Target, "")
+	issueNickToken(w, req.Target, nickOwner(req.Target))
+}
+
+// adds the /nickserv endpoints
+func handleNickServRequests(router *mux.Router) {
+	router.HandleFunc("/nickserv/info/{nick}", nickServInfo).Methods("GET")
+	router.HandleFunc("/nickserv/register", nickServRegister).Methods("POST")
+	router.HandleFunc("/nickserv/identify", nickServIdentify).Methods("POST")
+	router.HandleFunc("/nickserv/ghost", nickServGhost).Methods("POST")
+	router.HandleFunc("/nickserv/recover", nickServRecover).Methods("POST")
+}
+
+const nickServHelp = `REGISTER <password>              registers your nickname to a new account
+IDENTIFY [account] <password>    logs you in to an account
+GROUP                            registers your nickname to the account you are logged in to
+GHOST <nick> [password]          disconnects whoever is using a nickname you own
+RECOVER <nick> [password]        ghosts a nickname you own and switches you to it
+INFO <nick>                      shows which account a nickname is registered to`
+
+// nickserv runs a command sent to NickServ from IRC
+func (c *ircClient) nickserv(text string) {
+	reply := func(format string, args ...interface{}) {
+		c.write(formatIRC("", servicesMask(nickServ), "NOTICE", c.nick, fmt.Sprintf(format, args...)))
+	}
+	tok := strings.Fields(text)
+	arg := func(i int) string {
+		if i < len(tok) {
+			return tok[i]
+		}
+		return ""
+	}
+	switch strings.ToUpper(arg(0)) {
+	case "REGISTER":
+		if err := registerNick(c.nick, c.nick, arg(1)); err != nil {
+			reply("%s", err)
+			return
+		}
+		c.account = c.nick
+		c.notifyAccount()
+		reply("%s is now registered to your account %s", c.nick, c.account)
+	case "IDENTIFY":
+		account, password := nickOwner(c.nick), arg(1)
+		if len(tok) > 2 {
+			account, password = arg(1), arg(2)
+			if owner := nickOwner(account); owner != "" {
+				account = owner
+			}
+		}
+		if account == "" || !checkAccountPassword(account, password) {
+			audit(c.nick, "identify failed", account, "")
+			reply("Invalid account or password")
+			return
+		}
+		c.account = account
+		audit(c.nick, "identify", account, "")
+		c.numeric("900", ircMask(c.nick), account, "You are now logged in as "+account)
+		c.notifyAccount()
+		reply("You are now identified for %s", account)
+	case "GROUP":
+		if c.account == "" {
+			reply("Identify first")
+		} else if err := groupNick(c.account, c.nick); err != nil {
+			reply("%s", err)
+		} else {
+			reply("%s is now registered to your account %s", c.nick, c.account)
+		}
+	case "GHOST", "RECOVER":
+		target := arg(1)
+		if !nickAuthorized(target, c.account, arg(2)) {
+			audit(c.nick, "ghost failed", target, "")
+			reply("You do not own %s", target)
+			return
+		}
+		if target == c.nick {
+			reply("You are already using %s", target)
+			return
+		}
+		ghostNick(c.nick, target)
+		reply("%s has been ghosted", target)
+		if strings.ToUpper(arg(0)) == "RECOVER" {
+			if c.account == "" {
+				c.account = nickOwner(target)
+				c.notifyAccount()
+			}
+			audit(c.nick, "recover", target, "")
+			c.rename(target)
+		}
+	case "INFO":
+		if owner := nickOwner(arg(1)); owner != "" {
+			reply("%s is registered to %s since %s", arg(1), owner, time.Unix(Accounts[owner].Created, 0).UTC().Format(time.RFC1123))
+		} else {
+			reply("%s is not registered", arg(1))
+		}
+	default:
+		for _, line := range strings.Split(nickServHelp, "\n") {
+			reply("%s", line)
+		}
+	}
+}
+
+// warnNick starts the grace period of a client on a nickname registered to an
+// account it is not logged in to
+func (c *ircClient) warnNick() {
+	if !c.mustIdentify() {
+		return
+	}
+	c.nickDeadline = time.Now().Add(nickGrace)
+	c.write(formatIRC("", servicesMask(nickServ), "NOTICE", c.nick,
+		fmt.Sprintf("This nickname is registered. Log in with SASL or /msg %s IDENTIFY <password> within %s or you will be renamed", nickServ, nickGrace)))
+}
+
+// enforceNicks renames IRC clients whose grace period ran out
+func enforceNicks() {
+	for range time.Tick(time.Second) {
+		now := time.Now()
+		dbLock.Lock()
+		var expired []*ircClient
+		for _, c := range IRCClients {
+			if c.mustIdentify() && !c.nickDeadline.IsZero() && now.After(c.nickDeadline) {
+				expired = append(expired, c)
+			}
+		}
+		for _, c := range expired {
+			old := c.nick
+			c.rename(guestNick())
+			audit(nickServ, "rename", old, c.nick)
+		}
+		dbLock.Unlock()
+	}
+}
@@ -0,0 +1,409 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// snapshotVersion is the schema version written by exportData; snapshots with
+// an older version are upgraded by importData through snapshotUpgrades
+const snapshotVersion = 2
+
+// snapshotFile is where exportData writes and importData reads the snapshot
+var snapshotFile = "snapshot.json"
+
+// legacy export files, read by importData only when there is no snapshotFile
+var legacyFiles = []string{"users.json", "channels.json", "messages.json"}
+
+// deletedChannels and deletedAccounts record what was deleted, renamed away or
+// dropped since the last export, so a merge does not bring it back from the
+// old snapshot
+var deletedChannels = make(map[string]bool)
+var deletedAccounts = make(map[string]bool)
+
+// Snapshot struct is the envelope written to disk, where Data is the
+// snapshotData marshaled with the schema given by Version, and Checksum is the
+// hex encoded sha256 of Data
+type Snapshot struct {
+	Version  int             `json:"version"`
+	Created  int64           `json:"created"`
+	Checksum string          `json:"checksum"`
+	Data     json.RawMessage `json:"data"`
+}
+
+// snapshotData struct holds every map that makes up the server's state
+type snapshotData struct {
+	Users           map[string]User              `json:"users"`
+	ChatChannels    map[string]*ChatChannel      `json:"chatchannels"`
+	PrivateMessages map[string]map[string][]Chat `json:"privatemessages"`
+	Accounts        map[string]Account           `json:"accounts"`
+}
+
+// snapshotUpgrades maps a schema version to the function that converts Data of
+// that version into Data of the next version
+var snapshotUpgrades = map[int]func(json.RawMessage) (json.RawMessage, error){
+	// version 0 is the three legacy export files, which importData has
+	// already combined into the version 1 layout
+	0: func(dat json.RawMessage) (json.RawMessage, error) { return dat, nil },
+	// version 2 added accounts, which version 1 snapshots have none of
+	1: func(dat json.RawMessage) (json.RawMessage, error) { return dat, nil },
+}
+
+// ImportReport struct describes what importData loaded
+type ImportReport struct {
+	File            string
+	Version         int
+	UpgradedFrom    int
+	Users           int
+	Channels        int
+	ChannelChats    int
+	PrivateMessages int
+	Accounts        int
+	Warnings        []string
+}
+
+func (r ImportReport) toString() string {
+	s := fmt.Sprintf("loaded %s (schema v%d", r.File, r.Version)
+	if r.UpgradedFrom != r.Version {
+		s += fmt.Sprintf(", upgraded from v%d", r.UpgradedFrom)
+	}
+	s += fmt.Sprintf("): %d users, %d channels, %d channel chats, %d private messages, %d accounts",
+		r.Users, r.Channels, r.ChannelChats, r.PrivateMessages, r.Accounts)
+	for _, w := range r.Warnings {
+		s += "\n  warning: " + w
+	}
+	return s
+}
+
+func checksum(dat []byte) string {
+	sum := sha256.Sum256(dat)
+	return hex.EncodeToString(sum[:])
+}
+
+// writeFileAtomic writes dat to a temporary file next to name, syncs it and
+// renames it over name, so a crash leaves either the old or the new file
+func writeFileAtomic(name string, dat []byte) error {
+	dir := filepath.Dir(name)
+	tmp, err := ioutil.TempFile(dir, "."+filepath.Base(name)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("error: writeFileAtomic, creating temporary file: %s", err)
+	}
+	// only does anything if we bail out before the rename
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(dat); err != nil {
+		tmp.Close()
+		return fmt.Errorf("error: writeFileAtomic, writing to %s: %s", tmp.Name(), err)
+	}
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("error: writeFileAtomic, syncing %s: %s", tmp.Name(), err)
+	}
+	if err = tmp.Close(); err != nil {
+		return fmt.Errorf("error: writeFileAtomic, closing %s: %s", tmp.Name(), err)
+	}
+	if err = os.Rename(tmp.Name(), name); err != nil {
+		return fmt.Errorf("error: writeFileAtomic, renaming %s to %s: %s", tmp.Name(), name, err)
+	}
+	// make the rename itself durable
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
+
+// readSnapshot reads and verifies the snapshot in name, upgrading its data to
+// snapshotVersion, and returns the decoded data along with its original version
+func readSnapshot(name string) (*snapshotData, int, error) {
+	raw, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error: readSnapshot, reading %s: %s", name, err)
+	}
+	var snap Snapshot
+	if err = json.Unmarshal(raw, &snap); err != nil {
+		return nil, 0, fmt.Errorf("error: readSnapshot, unmarshaling %s: %s", name, err)
+	}
+	if snap.Version < 1 || snap.Version > snapshotVersion {
+		return nil, 0, fmt.Errorf("error: readSnapshot, %s has unsupported schema version %d", name, snap.Version)
+	}
+	// the checksum covers the compact encoding, so the file may be reformatted
+	var compact bytes.Buffer
+	if err = json.Compact(&compact, snap.Data); err != nil {
+		return nil, 0, fmt.Errorf("error: readSnapshot, compacting data in %s: %s", name, err)
+	}
+	if sum := checksum(compact.Bytes()); sum != snap.Checksum {
+		return nil, 0, fmt.Errorf("error: readSnapshot, %s is corrupt: checksum is %s, expected %s", name, sum, snap.Checksum)
+	}
+	data, err := upgradeSnapshot(snap.Version, snap.Data)
+	if err != nil {
+		return nil, 0, err
+	}
+	return data, snap.Version, nil
+}
+
+// readLegacyFiles combines the old users.json, channels.json and messages.json
+// export files into version 0 snapshot data; the old append mode wrote whole
+// JSON objects one after another, so each file is read as a stream of objects
+// whose keys are merged, with later objects winning
+func readLegacyFiles() (json.RawMessage, error) {
+	parts := make([]map[string]json.RawMessage, len(legacyFiles))
+	for i, name := range legacyFiles {
+		f, err := os.Open(name)
+		if err != nil {
+			return nil, fmt.Errorf("error: readLegacyFiles, opening %s: %s", name, err)
+		}
+		parts[i] = make(map[string]json.RawMessage)
+		dec := json.NewDecoder(f)
+		for dec.More() {
+			obj := make(map[string]json.RawMessage)
+			if err = dec.Decode(&obj); err != nil {
+				f.Close()
+				return nil, fmt.Errorf("error: readLegacyFiles, decoding %s: %s", name, err)
+			}
+			for k, v := range obj {
+				parts[i][k] = v
+			}
+		}
+		f.Close()
+	}
+	return json.Marshal(map[string]interface{}{
+		"users":           parts[0],
+		"chatchannels":    parts[1],
+		"privatemessages": parts[2],
+	})
+}
+
+func upgradeSnapshot(version int, dat json.RawMessage) (*snapshotData, error) {
+	var err error
+	for v := version; v < snapshotVersion; v++ {
+		dat, err = snapshotUpgrades[v](dat)
+		if err != nil {
+			return nil, fmt.Errorf("error: upgradeSnapshot, upgrading schema v%d to v%d: %s", v, v+1, err)
+		}
+	}
+	var data snapshotData
+	dec := json.NewDecoder(strings.NewReader(string(dat)))
+	dec.DisallowUnknownFields()
+	if err = dec.Decode(&data); err != nil {
+		return nil, fmt.Errorf("error: upgradeSnapshot, unmarshaling schema v%d data: %s", snapshotVersion, err)
+	}
+	return &data, nil
+}
+
+// validateSnapshot checks that data is consistent with itself, returning an
+// error for anything that cannot be loaded and warnings for anything repaired
+func validateSnapshot(data *snapshotData) ([]string, error) {
+	var warnings []string
+	if data.Users == nil {
+		data.Users = make(map[string]User)
+	}
+	if data.ChatChannels == nil {
+		data.ChatChannels = make(map[string]*ChatChannel)
+	}
+	if data.PrivateMessages == nil {
+		data.PrivateMessages = make(map[string]map[string][]Chat)
+	}
+	if data.Accounts == nil {
+		data.Accounts = make(map[string]Account)
+	}
+	for k, a := range data.Accounts {
+		if a.Name != k {
+			return nil, fmt.Errorf("error: validateSnapshot, account %q is stored under key %q", a.Name, k)
+		}
+	}
+	for k, u := range data.Users {
+		if u.Nickname == "" {
+			return nil, fmt.Errorf("error: validateSnapshot, user %q has no nickname", k)
+		}
+		if u.toString() != k {
+			return nil, fmt.Errorf("error: validateSnapshot, user %q is stored under key %q", u.toString(), k)
+		}
+		if _, ok := data.ChatChannels[u.Connection]; u.Connection != "" && !ok {
+			warnings = append(warnings, fmt.Sprintf("user %q was connected to missing channel %q, disconnected", k, u.Connection))
+			u.Connection = ""
+			data.Users[k] = u
+		}
+	}
+	for k, c := range data.ChatChannels {
+		if c == nil {
+			return nil, fmt.Errorf("error: validateSnapshot, channel %q is null", k)
+		}
+		if c.Chan.toString() != k {
+			return nil, fmt.Errorf("error: validateSnapshot, channel %q is stored under key %q", c.Chan.toString(), k)
+		}
+		if c.Chats == nil {
+			c.Chats = []Chat{}
+		}
+		if _, ok := data.Accounts[c.Chan.Founder]; c.Chan.Founder != "" && !ok {
+			warnings = append(warnings, fmt.Sprintf("channel %q was founded by missing account %q, unregistered", k, c.Chan.Founder))
+			unregisterChannel(c)
+		} else if c.Chan.Founder != "" && c.Chan.Settings == nil {
+			c.Chan.Settings = &ChannelSettings{AutoOp: true}
+		}
+	}
+	for from, inbox := range data.PrivateMessages {
+		if _, ok := data.Users[from]; !ok {
+			warnings = append(warnings, fmt.Sprintf("private messages from unknown user %q", from))
+		}
+		if inbox == nil {
+			data.PrivateMessages[from] = make(map[string][]Chat)
+		}
+	}
+	// every user needs an inbox, see createUser
+	for k := range data.Users {
+		if _, ok := data.PrivateMessages[k]; !ok {
+			data.PrivateMessages[k] = make(map[string][]Chat)
+		}
+	}
+	sort.Strings(warnings)
+	return warnings, nil
+}
+
+func currentSnapshotData() *snapshotData {
+	return &snapshotData{
+		Users:           Users,
+		ChatChannels:    ChatChannels,
+		PrivateMessages: PrivateMessages,
+		Accounts:        Accounts,
+	}
+}
+
+// mergeSnapshotData adds everything in old that is missing from cur to cur,
+// except channels and accounts deleted since; whatever is in memory wins over
+// what was exported before
+func mergeSnapshotData(cur, old *snapshotData) *snapshotData {
+	merged := &snapshotData{
+		Users:           make(map[string]User),
+		ChatChannels:    make(map[string]*ChatChannel),
+		PrivateMessages: make(map[string]map[string][]Chat),
+		Accounts:        make(map[string]Account),
+	}
+	for _, d := range []*snapshotData{old, cur} {
+		for k, v := range d.Accounts {
+			if d != old || !deletedAccounts[k] {
+				merged.Accounts[k] = v
+			}
+		}
+		for k, v := range d.Users {
+			merged.Users[k] = v
+		}
+		for k, v := range d.ChatChannels {
+			if d != old || !deletedChannels[k] {
+				merged.ChatChannels[k] = v
+			}
+		}
+		for from, inbox := range d.PrivateMessages {
+			if _, ok := merged.PrivateMessages[from]; !ok {
+				merged.PrivateMessages[from] = make(map[string][]Chat)
+			}
+			for to, chats := range inbox {
+				merged.PrivateMessages[from][to] = chats
+			}
+		}
+	}
+	return merged
+}
+
+// exportData writes the server's state to snapshotFile; if merge is true,
+// data only found in the existing snapshot is carried over, otherwise the
+// snapshot is replaced outright
+func exportData(merge bool) (bool, error) {
+	data := currentSnapshotData()
+	if merge {
+		old, _, err := readSnapshot(snapshotFile)
+		if err == nil {
+			data = mergeSnapshotData(data, old)
+		} else if _, statErr := os.Stat(snapshotFile); !os.IsNotExist(statErr) {
+			return false, fmt.Errorf("error: exportData, refusing to merge with unreadable snapshot: %s", err)
+		}
+	}
+	dat, err := json.Marshal(data)
+	if err != nil {
+		return false, fmt.Errorf("error: exportData, marshaling snapshot data: %s", err)
+	}
+	snap := Snapshot{
+		Version:  snapshotVersion,
+		Created:  time.Now().Unix(),
+		Checksum: checksum(dat),
+		Data:     dat,
+	}
+	dat, err = json.MarshalIndent(snap, "", "\t")
+	if err != nil {
+		return false, fmt.Errorf("error: exportData, marshaling snapshot: %s", err)
+	}
+	if err = writeFileAtomic(snapshotFile, dat); err != nil {
+		return false, fmt.Errorf("error: exportData, writing %s: %s", snapshotFile, err)
+	}
+	// the snapshot on disk no longer has them either
+	deletedChannels = make(map[string]bool)
+	deletedAccounts = make(map[string]bool)
+	return true, nil
+}
+
+// importData loads snapshotFile, or the legacy export files if it does not
+// exist, and only replaces the server's state if all of it validates
+func importData() (ImportReport, error) {
+	var data *snapshotData
+	var raw json.RawMessage
+	var err error
+	report := ImportReport{File: snapshotFile, Version: snapshotVersion}
+	if _, statErr := os.Stat(snapshotFile); os.IsNotExist(statErr) {
+		report.File = strings.Join(legacyFiles, ", ")
+		raw, err = readLegacyFiles()
+		if err != nil {
+			return report, fmt.Errorf("error: importData, %s", err)
+		}
+		data, err = upgradeSnapshot(0, raw)
+		if err != nil {
+			return report, fmt.Errorf("error: importData, %s", err)
+		}
+	} else {
+		data, report.UpgradedFrom, err = readSnapshot(snapshotFile)
+		if err != nil {
+			return report, fmt.Errorf("error: importData, %s", err)
+		}
+	}
+	report.Warnings, err = validateSnapshot(data)
+	if err != nil {
+		return report, fmt.Errorf("error: importData, %s", err)
+	}
+	Users = data.Users
+	ChatChannels = data.ChatChannels
+	PrivateMessages = data.PrivateMessages
+	Accounts = data.Accounts
+	report.Users = len(Users)
+	report.Accounts = len(Accounts)
+	report.Channels = len(ChatChannels)
+	chatSeq = 0
+	for _, c := range ChatChannels {
+		report.ChannelChats += len(c.Chats)
+		chatSeq = maxChatID(chatSeq, c.Chats)
+	}
+	for _, inbox := range PrivateMessages {
+		for _, chats := range inbox {
+			report.PrivateMessages += len(chats)
+			chatSeq = maxChatID(chatSeq, chats)
+		}
+	}
+	return report, nil
+}
+
+// maxChatID is the larger of id and the IDs of chats, so new chats never
+// reuse an imported ID
+func maxChatID(id int64, chats []Chat) int64 {
+	for _, chat := range chats {
+		if chat.ID > id {
+			id = chat.ID
+		}
+	}
+	return id
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// certReloader struct serves the certificate in certFile and keyFile, loading
+// it again whenever either file changes, so certificates can be renewed
+// without restarting the server
+type certReloader struct {
+	mu       sync.Mutex
+	certFile string
+	keyFile  string
+	modTime  time.Time
+	cert     *tls.Certificate
+}
+
+func newCertReloader(certFile string, keyFile string) (*certReloader, error) {
+	c := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := c.reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// latestModTime is the newer of the two files' modification times
+func (c *certReloader) latestModTime() (time.Time, error) {
+	var latest time.Time
+	for _, name := range []string{c.certFile, c.keyFile} {
+		info, err := os.Stat(name)
+		if err != nil {
+			return latest, fmt.Errorf("error: certReloader, checking %s: %s", name, err)
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+func (c *certReloader) reload() error {
+	modTime, err := c.latestModTime()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return fmt.Errorf("error: certReloader, loading %s and %s: %s", c.certFile, c.keyFile, err)
+	}
+	c.cert = &cert
+	c.modTime = modTime
+	return nil
+}
+
+// GetCertificate is used as tls.Config.GetCertificate; if reloading fails the
+// previous certificate keeps being served
+func (c *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if modTime, err := c.latestModTime(); err == nil && modTime.After(c.modTime) {
+		if err = c.reload(); err != nil {
+			slog.Error("reloading TLS certificate", "err", err)
+		} else {
+			slog.Info("reloaded TLS certificate", "file", c.certFile)
+		}
+	}
+	return c.cert, nil
+}
+
+// tlsSettings struct is what the tls flags configure
+type tlsSettings struct {
+	CertFile   string
+	KeyFile    string
+	ClientCA   string
+	ClientAuth string
+}
+
+var tlsFlags tlsSettings
+
+// serverTLSConfig builds the tls.Config shared by every listener, or returns
+// nil when no certificate is configured and listeners should stay plain
+func serverTLSConfig(s tlsSettings) (*tls.Config, error) {
+	if s.CertFile == "" && s.KeyFile == "" {
+		return nil, nil
+	}
+	reloader, err := newCertReloader(s.CertFile, s.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: reloader.GetCertificate,
+	}
+	switch s.ClientAuth {
+	case "", "none":
+		config.ClientAuth = tls.NoClientCert
+	case "request":
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	case "require":
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return nil, fmt.Errorf("error: serverTLSConfig, unknown client auth %q, use none, request or require", s.ClientAuth)
+	}
+	if config.ClientAuth != tls.NoClientCert {
+		if s.ClientCA == "" {
+			return nil, fmt.Errorf("error: serverTLSConfig, client certificates need a CA bundle")
+		}
+		pem, err := ioutil.ReadFile(s.ClientCA)
+		if err != nil {
+			return nil, fmt.Errorf("error: serverTLSConfig, reading %s: %s", s.ClientCA, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("error: serverTLSConfig, no certificates found in %s", s.ClientCA)
+		}
+		config.ClientCAs = pool
+	}
+	return config, nil
+}